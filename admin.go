@@ -0,0 +1,62 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"net/http"
+	"strings"
+
+	"code.crute.us/mcrute/ses-smtpd-proxy/smtpd"
+)
+
+// newAdminHandler creates the handler for the admin HTTP server, which
+// allows operators to control the running proxy. Every request must
+// carry token as a bearer token. suppression may be nil if no
+// suppression list is configured.
+func newAdminHandler(token string, s *smtpd.Server, reloader *configReloader, suppression suppressionList) http.Handler {
+	sm := http.NewServeMux()
+	sm.Handle("/maintenance", &maintenanceHandler{server: s})
+	sm.HandleFunc("/sessions", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]int64{
+			"active": s.ActiveConnections(),
+			"peak":   s.PeakConnections(),
+		})
+	})
+	sm.HandleFunc("/reload", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		reloadCertificates()
+		if err := reloader.reload(); err != nil {
+			http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	})
+	if suppression != nil {
+		sm.Handle("/suppression", &suppressionAdminHandler{suppression: suppression})
+	}
+	return &bearerAuth{token: token, next: sm}
+}
+
+// bearerAuth rejects requests without the expected bearer token.
+type bearerAuth struct {
+	token string
+	next  http.Handler
+}
+
+func (a *bearerAuth) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	got, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !ok || subtle.ConstantTimeCompare([]byte(got), []byte(a.token)) != 1 {
+		w.Header().Set("WWW-Authenticate", "Bearer")
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+	a.next.ServeHTTP(w, r)
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"code.crute.us/mcrute/ses-smtpd-proxy/smtpd"
+)
+
+func TestAdminHandlerRequiresToken(t *testing.T) {
+	s := &smtpd.Server{}
+	suppression := newMemorySuppressionList()
+	suppression.suppress(context.Background(), suppressionEntry{Address: "user@example.com", Reason: "bounce"})
+	h := newAdminHandler("secret", s, nil, suppression)
+
+	for _, tc := range []struct {
+		method, path, token string
+		want                int
+	}{
+		{http.MethodPost, "/maintenance", "", http.StatusUnauthorized},
+		{http.MethodPost, "/maintenance", "wrong", http.StatusUnauthorized},
+		{http.MethodGet, "/suppression", "", http.StatusUnauthorized},
+		{http.MethodDelete, "/suppression?all=true", "wrong", http.StatusUnauthorized},
+		{http.MethodGet, "/sessions", "", http.StatusUnauthorized},
+	} {
+		r := httptest.NewRequest(tc.method, tc.path, nil)
+		if tc.token != "" {
+			r.Header.Set("Authorization", "Bearer "+tc.token)
+		}
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		if w.Code != tc.want {
+			t.Errorf("%s %s with token %q: got status %d, want %d", tc.method, tc.path, tc.token, w.Code, tc.want)
+		}
+	}
+
+	if s.Paused() {
+		t.Error("unauthenticated request paused the server")
+	}
+	if ok, _ := suppression.isSuppressed(context.Background(), "user@example.com"); !ok {
+		t.Error("unauthenticated request changed the suppression list")
+	}
+
+	r := httptest.NewRequest(http.MethodPost, "/maintenance", nil)
+	r.Header.Set("Authorization", "Bearer secret")
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	if w.Code != http.StatusOK || !s.Paused() {
+		t.Errorf("authenticated POST /maintenance: got status %d, paused %v", w.Code, s.Paused())
+	}
+}
+
+func TestMetricsHandlerHasNoAdminEndpoints(t *testing.T) {
+	h := newMetricsHandler(nil, nil)
+	for _, path := range []string{"/maintenance", "/suppression", "/sessions", "/reload"} {
+		for _, method := range []string{http.MethodGet, http.MethodPost, http.MethodDelete} {
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, httptest.NewRequest(method, path, nil))
+			if w.Code != http.StatusNotFound {
+				t.Errorf("%s %s on metrics server: got status %d, want %d", method, path, w.Code, http.StatusNotFound)
+			}
+		}
+	}
+}
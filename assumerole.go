@@ -0,0 +1,43 @@
+package main
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/credentials/stscreds"
+	"github.com/aws/aws-sdk-go-v2/service/sts"
+)
+
+// defaultRoleSessionName identifies the proxy in CloudTrail when
+// assuming a role without a configured session name.
+const defaultRoleSessionName = "ses-smtpd-proxy"
+
+// assumeRole is an IAM role to send with, for example to use SES
+// identities in another account. The zero value assumes no role.
+type assumeRole struct {
+	ARN         string `json:"arn" yaml:"arn"`
+	ExternalID  string `json:"external_id" yaml:"external_id"`
+	SessionName string `json:"session_name" yaml:"session_name"`
+}
+
+// withAssumedRole replaces the credentials in cfg with credentials for
+// role, obtained with the original credentials and refreshed by the SDK
+// before they expire. It returns an error if the role can not be
+// assumed.
+func withAssumedRole(ctx context.Context, cfg aws.Config, role assumeRole) (aws.Config, error) {
+	provider := stscreds.NewAssumeRoleProvider(sts.NewFromConfig(cfg), role.ARN, func(o *stscreds.AssumeRoleOptions) {
+		o.RoleSessionName = defaultRoleSessionName
+		if role.SessionName != "" {
+			o.RoleSessionName = role.SessionName
+		}
+		if role.ExternalID != "" {
+			o.ExternalID = aws.String(role.ExternalID)
+		}
+	})
+	cfg.Credentials = aws.NewCredentialsCache(provider)
+	if _, err := cfg.Credentials.Retrieve(ctx); err != nil {
+		return cfg, fmt.Errorf("unable to assume role %s: %w", role.ARN, err)
+	}
+	return cfg, nil
+}
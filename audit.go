@@ -0,0 +1,130 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"io"
+	"log/slog"
+	"net"
+	"os"
+	"time"
+
+	"code.crute.us/mcrute/ses-smtpd-proxy/smtpd"
+)
+
+// auditRecord describes a completed mail transaction.
+type auditRecord struct {
+	Time      time.Time
+	SessionID string
+	ClientIP  string
+	User      string // authenticated user, empty if not authenticated
+	AuthAs    string // identity asserted with the MAIL FROM AUTH parameter
+	TLS       string // TLS version and cipher suite, empty if not encrypted
+	From      string
+	Rcpts     []string
+	Size      int
+	Outcome   string // "accepted", "queued", "failed", "rejected" or "discarded"
+	Reply     string // SMTP reply for rejected messages, or that would have been sent for failed ones
+	MessageID string // backend message ID for accepted messages
+}
+
+// auditSink records an audit trail of mail transactions.
+// Implementations must be safe for concurrent use.
+type auditSink interface {
+	record(r *auditRecord)
+}
+
+// slogAuditSink writes each audit record as a JSON log line, separately
+// from the proxy's other logging.
+type slogAuditSink struct {
+	handler slog.Handler
+}
+
+// newSlogAuditSink creates an auditSink appending to the file at path,
+// or writing to stdout if path is "-".
+func newSlogAuditSink(path string) (*slogAuditSink, error) {
+	var w io.Writer = os.Stdout
+	if path != "-" {
+		f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0640)
+		if err != nil {
+			return nil, err
+		}
+		w = f
+	}
+	return &slogAuditSink{handler: slog.NewJSONHandler(w, nil)}, nil
+}
+
+func (s *slogAuditSink) record(r *auditRecord) {
+	attrs := []slog.Attr{
+		slog.String("session_id", r.SessionID),
+		slog.String("client_ip", r.ClientIP),
+		slog.String("user", r.User),
+		slog.String("tls", r.TLS),
+		slog.String("from", r.From),
+		slog.Any("rcpts", r.Rcpts),
+		slog.Int("size", r.Size),
+		slog.String("outcome", r.Outcome),
+	}
+	if r.AuthAs != "" {
+		attrs = append(attrs, slog.String("auth_as", r.AuthAs))
+	}
+	if r.Reply != "" {
+		attrs = append(attrs, slog.String("reply", r.Reply))
+	}
+	if r.MessageID != "" {
+		attrs = append(attrs, slog.String("message_id", r.MessageID))
+	}
+	rec := slog.NewRecord(r.Time, slog.LevelInfo, "transaction", 0)
+	rec.AddAttrs(attrs...)
+	s.handler.Handle(context.Background(), rec)
+}
+
+// clientIP returns the IP address of the client connected to c, or the
+// full address if it has no IP.
+func clientIP(c smtpd.Connection) string {
+	addr := c.Addr().String()
+	if host, _, err := net.SplitHostPort(addr); err == nil {
+		return host
+	}
+	return addr
+}
+
+// tlsDescription describes the TLS version and cipher suite negotiated
+// by c, or returns "" if c is not encrypted.
+func tlsDescription(c smtpd.Connection) string {
+	state, ok := c.TLSState()
+	if !ok {
+		return ""
+	}
+	return tls.VersionName(state.Version) + " " + tls.CipherSuiteName(state.CipherSuite)
+}
+
+// audit records the outcome of the envelope's transaction if auditing
+// is enabled. A message sent in the background is recorded as "queued"
+// when the transaction completes and again as "accepted" or "failed"
+// once it is sent.
+func (e *Envelope) audit(outcome, messageID string, err error) {
+	if e.auditor == nil {
+		return
+	}
+	r := &auditRecord{
+		Time:      time.Now(),
+		SessionID: e.sessionID,
+		ClientIP:  e.clientIP,
+		User:      e.authUser,
+		AuthAs:    e.authSender,
+		TLS:       e.tls,
+		From:      e.from,
+		Rcpts:     e.rcpts,
+		Size:      e.b.Len(),
+		Outcome:   outcome,
+		MessageID: messageID,
+	}
+	if err != nil {
+		if outcome != "failed" {
+			r.Outcome = "rejected"
+		}
+		r.Reply = err.Error()
+	}
+	e.auditor.record(r)
+}
@@ -0,0 +1,258 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var (
+	queuedSendFailure = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: "smtpd",
+		Name:      "queued_send_failure_total",
+		Help:      "Total number of messages accepted from clients which failed to send in the background",
+	})
+	queuedAbandoned = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: "smtpd",
+		Name:      "queued_abandoned_total",
+		Help:      "Total number of messages accepted from clients which were not sent because the process shut down",
+	})
+	batchFlushSize = promauto.NewHistogram(prometheus.HistogramOpts{
+		Namespace: "smtpd",
+		Name:      "batch_flush_size",
+		Help:      "Number of messages sent by each batch flush",
+		Buckets:   prometheus.ExponentialBuckets(1, 2, 8),
+	})
+)
+
+var (
+	// errSenderClosed is returned when a message is sent after shutdown
+	// has begun.
+	errSenderClosed = errors.New("sender is shut down")
+
+	// errAbandoned is reported for queued messages which were not sent
+	// before the time allowed for draining the queue at shutdown ended.
+	errAbandoned = errors.New("message abandoned at shutdown")
+)
+
+// asyncSender is a mailSender which sends messages in the background.
+// queueMessage returns once m is queued and done, if non-nil, is called
+// with the result of sending it.
+type asyncSender interface {
+	mailSender
+	queueMessage(ctx context.Context, m *outboundMessage, done func(id string, err error)) error
+}
+
+// queuedMessage is a message waiting to be sent with sender.
+type queuedMessage struct {
+	sender mailSender
+	msg    *outboundMessage
+	done   func(id string, err error)
+}
+
+// abandonQueued logs and counts q, which will not be sent, so that no
+// message accepted from a client is dropped without a trace.
+func abandonQueued(q queuedMessage) {
+	queuedAbandoned.Inc()
+	slog.Error("abandoning queued message at shutdown", "from", q.msg.from, "rcpts", q.msg.rcpts, "rcpt_count", len(q.msg.rcpts))
+	if q.done != nil {
+		q.done("", errAbandoned)
+	}
+}
+
+// logInFlight logs the number of messages still being sent when the
+// queue drain ends early, their outcome will not be known.
+func logInFlight(n int64) {
+	if n > 0 {
+		slog.Error("messages still being sent at shutdown", "count", n)
+	}
+}
+
+// sendQueued sends q, counting failures as the client can no longer be
+// told about them, and reports the result to q.done.
+func sendQueued(ctx context.Context, q queuedMessage) {
+	id, err := q.sender.sendMessage(ctx, q.msg)
+	if err != nil {
+		queuedSendFailure.Inc()
+	}
+	if q.done != nil {
+		q.done(id, err)
+	} else if err != nil {
+		slog.Error("queued send failed", "from", q.msg.from, "rcpt_count", len(q.msg.rcpts), "error", err)
+	}
+}
+
+// batchSender collects messages sharing a configuration set and sends
+// each batch in parallel, at most concurrency messages at a time, once
+// it reaches size messages or every interval, whichever is first.
+// Messages are accepted as soon as they are queued so send failures can
+// not be reported to the client.
+type batchSender struct {
+	size     int
+	interval time.Duration
+	sem      chan struct{} // held while sending a message
+
+	mu      sync.Mutex
+	batches map[string][]queuedMessage // by configuration set
+	closed  bool
+
+	done     chan struct{}
+	abort    chan struct{}  // closed when the drain at shutdown ends
+	flushing sync.WaitGroup // flushes starting sends
+	sending  sync.WaitGroup // messages being sent
+	inFlight atomic.Int64
+}
+
+func newBatchSender(size int, interval time.Duration, concurrency int) *batchSender {
+	b := &batchSender{
+		size:     size,
+		interval: interval,
+		sem:      make(chan struct{}, concurrency),
+		batches:  map[string][]queuedMessage{},
+		done:     make(chan struct{}),
+		abort:    make(chan struct{}),
+	}
+	go b.run()
+	return b
+}
+
+// queue returns a mailSender which adds messages to a batch to be sent
+// with s.
+func (b *batchSender) queue(s mailSender) mailSender {
+	return &batchQueue{batch: b, sender: s}
+}
+
+func (b *batchSender) run() {
+	t := time.NewTicker(b.interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-b.done:
+			return
+		case <-t.C:
+			b.mu.Lock()
+			for configSet := range b.batches {
+				b.flush(configSet)
+			}
+			b.mu.Unlock()
+		}
+	}
+}
+
+func (b *batchSender) add(q queuedMessage) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.closed {
+		return errSenderClosed
+	}
+	configSet := aws.ToString(q.msg.configSet)
+	b.batches[configSet] = append(b.batches[configSet], q)
+	if len(b.batches[configSet]) >= b.size {
+		b.flush(configSet)
+	}
+	return nil
+}
+
+// flush starts sending the batch for configSet, the caller must hold
+// b.mu.
+func (b *batchSender) flush(configSet string) {
+	batch := b.batches[configSet]
+	delete(b.batches, configSet)
+	batchFlushSize.Observe(float64(len(batch)))
+	b.sending.Add(len(batch))
+	b.flushing.Add(1)
+	go func() {
+		defer b.flushing.Done()
+		for _, q := range batch {
+			if !b.acquire() {
+				abandonQueued(q)
+				b.sending.Done()
+				continue
+			}
+			b.inFlight.Add(1)
+			go func(q queuedMessage) {
+				defer func() {
+					b.inFlight.Add(-1)
+					<-b.sem
+					b.sending.Done()
+				}()
+				sendQueued(context.Background(), q)
+			}(q)
+		}
+	}()
+}
+
+// acquire waits for a free send slot, returning false if the drain at
+// shutdown has ended.
+func (b *batchSender) acquire() bool {
+	select {
+	case b.sem <- struct{}{}:
+	case <-b.abort:
+		return false
+	}
+	select {
+	case <-b.abort:
+		<-b.sem
+		return false
+	default:
+		return true
+	}
+}
+
+// close stops accepting messages, sends those that are queued and
+// waits for them to be sent or ctx to end. Messages which have not
+// started sending when ctx ends are abandoned.
+func (b *batchSender) close(ctx context.Context) error {
+	b.mu.Lock()
+	if !b.closed {
+		b.closed = true
+		close(b.done)
+		for configSet := range b.batches {
+			b.flush(configSet)
+		}
+	}
+	b.mu.Unlock()
+	if err := waitGroupContext(ctx, &b.sending); err != nil {
+		close(b.abort)
+		b.flushing.Wait()
+		logInFlight(b.inFlight.Load())
+		return err
+	}
+	return nil
+}
+
+// batchQueue is the mailSender returned by batchSender.queue.
+type batchQueue struct {
+	batch  *batchSender
+	sender mailSender
+}
+
+func (q *batchQueue) sendMessage(ctx context.Context, m *outboundMessage) (string, error) {
+	return "", q.queueMessage(ctx, m, nil)
+}
+
+func (q *batchQueue) queueMessage(ctx context.Context, m *outboundMessage, done func(string, error)) error {
+	return q.batch.add(queuedMessage{sender: q.sender, msg: m, done: done})
+}
+
+// waitGroupContext waits for wg or for ctx to end, whichever is first.
+func waitGroupContext(ctx context.Context, wg *sync.WaitGroup) error {
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
@@ -0,0 +1,170 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+// counterValue returns the current value of c.
+func counterValue(t *testing.T, c prometheus.Collector) float64 {
+	t.Helper()
+	return testutil.ToFloat64(c)
+}
+
+// fakeSender is a mailSender recording the messages it sends.
+type fakeSender struct {
+	err   error
+	delay time.Duration
+
+	mu          sync.Mutex
+	sent        []*outboundMessage
+	inFlight    int
+	maxInFlight int
+}
+
+func (s *fakeSender) sendMessage(ctx context.Context, m *outboundMessage) (string, error) {
+	s.mu.Lock()
+	s.inFlight++
+	s.maxInFlight = max(s.maxInFlight, s.inFlight)
+	s.mu.Unlock()
+
+	time.Sleep(s.delay)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.inFlight--
+	if s.err != nil {
+		return "", s.err
+	}
+	s.sent = append(s.sent, m)
+	return "id", nil
+}
+
+// fakeAuditSink is an auditSink keeping the records it is given.
+type fakeAuditSink struct {
+	mu sync.Mutex
+	rs []auditRecord
+}
+
+func (s *fakeAuditSink) record(r *auditRecord) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.rs = append(s.rs, *r)
+}
+
+func (s *fakeAuditSink) records() []auditRecord {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]auditRecord(nil), s.rs...)
+}
+
+func TestBatchSenderLimitsConcurrency(t *testing.T) {
+	fs := &fakeSender{delay: 10 * time.Millisecond}
+	b := newBatchSender(20, time.Hour, 3)
+	var done atomic.Int32
+	for i := 0; i < 20; i++ {
+		err := b.queue(fs).(asyncSender).queueMessage(context.Background(), &outboundMessage{}, func(id string, err error) {
+			done.Add(1)
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := b.close(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if len(fs.sent) != 20 || done.Load() != 20 {
+		t.Errorf("sent %d messages with %d results, want 20", len(fs.sent), done.Load())
+	}
+	if fs.maxInFlight > 3 {
+		t.Errorf("sent %d messages at once, want at most 3", fs.maxInFlight)
+	}
+}
+
+func TestBatchSenderClosedRejectsMessages(t *testing.T) {
+	b := newBatchSender(10, time.Hour, 1)
+	b.close(context.Background())
+	if _, err := b.queue(&fakeSender{}).sendMessage(context.Background(), &outboundMessage{}); err != errSenderClosed {
+		t.Errorf("got error %v, want %v", err, errSenderClosed)
+	}
+}
+
+// TestQueuedSendAccounting checks that a message sent in the background
+// is charged to quota and remembered for dedup while it is queued, so a
+// retry is caught, and that both are undone if sending it fails. The
+// transaction is audited when queued and again once it is sent.
+func TestQueuedSendAccounting(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		err      error
+		wantSent bool
+	}{
+		{"success", nil, true},
+		{"failure", errors.New("send failed"), false},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			fs := &fakeSender{err: tc.err}
+			b := newBatchSender(10, time.Hour, 1)
+			quota := newMemoryQuotaManager(map[string]int{"user": 10})
+			dedup := newMemoryDedupCache(time.Hour)
+			auditor := &fakeAuditSink{}
+			e := &Envelope{
+				auditor:  auditor,
+				authUser: "user",
+				quota:    quota,
+				from:     "sender@example.com",
+				rcpts:    []string{"rcpt@example.com"},
+				sender:   b.queue(fs),
+				dedup:    dedup,
+				maxSize:  1 << 20,
+			}
+			e.b.WriteString("Message-Id: <1@example.com>\r\n\r\nbody\r\n")
+			key := dedupKey("<1@example.com>", e.from, e.rcpts)
+
+			if err := e.Close(context.Background()); err != nil {
+				t.Fatalf("Close: %v", err)
+			}
+			if n := quota.usage("user"); n != 1 {
+				t.Errorf("quota charged %d while queued, want 1", n)
+			}
+			if _, ok := dedup.seen(context.Background(), key); !ok {
+				t.Error("queued message not remembered for dedup")
+			}
+
+			b.close(context.Background())
+			wantUsage := 0
+			if tc.wantSent {
+				wantUsage = 1
+			}
+			if n := quota.usage("user"); n != wantUsage {
+				t.Errorf("quota charged %d, want %d", n, wantUsage)
+			}
+			id, ok := dedup.seen(context.Background(), key)
+			if ok != tc.wantSent {
+				t.Errorf("remembered for dedup %v, want %v", ok, tc.wantSent)
+			} else if ok && id != "id" {
+				t.Errorf("remembered as sent as %q, want the SES ID", id)
+			}
+
+			records := auditor.records()
+			wantOutcome, wantID := "failed", ""
+			if tc.wantSent {
+				wantOutcome, wantID = "accepted", "id"
+			}
+			if len(records) != 2 || records[0].Outcome != "queued" || records[1].Outcome != wantOutcome || records[1].MessageID != wantID {
+				t.Fatalf("got audit records %+v, want queued then %s", records, wantOutcome)
+			}
+			if !tc.wantSent && !strings.HasPrefix(records[1].Reply, "451 ") {
+				t.Errorf("got audit reply %q for failed send", records[1].Reply)
+			}
+		})
+	}
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"errors"
+	"net"
+	"strings"
+
+	"code.crute.us/mcrute/ses-smtpd-proxy/smtpd"
+)
+
+// bindList is a repeatable flag of addresses to listen on.
+type bindList []string
+
+func (b *bindList) String() string {
+	if b == nil {
+		return ""
+	}
+	return strings.Join(*b, ",")
+}
+
+func (b *bindList) Set(v string) error {
+	for _, v := range strings.Split(v, ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			*b = append(*b, v)
+		}
+	}
+	return nil
+}
+
+// listenAll listens on every address in addrs. If any address can not
+// be listened on the listeners that were opened are closed and an
+// error is returned for each address that failed.
+func listenAll(s *smtpd.Server, addrs []string) ([]net.Listener, error) {
+	var listeners []net.Listener
+	var errs []error
+	for _, addr := range addrs {
+		ln, err := s.Listen(addr)
+		if err != nil {
+			errs = append(errs, err) // net and os errors name the address
+			continue
+		}
+		listeners = append(listeners, ln)
+	}
+	if len(errs) > 0 {
+		for _, ln := range listeners {
+			ln.Close()
+		}
+		return nil, errors.Join(errs...)
+	}
+	return listeners, nil
+}
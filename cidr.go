@@ -0,0 +1,42 @@
+package main
+
+import (
+	"net"
+	"strings"
+)
+
+// cidrList is a repeatable flag of networks in CIDR notation. Bare IP
+// addresses are accepted as a network of that single address.
+type cidrList []*net.IPNet
+
+func (c *cidrList) String() string {
+	if c == nil {
+		return ""
+	}
+	s := make([]string, len(*c))
+	for i, n := range *c {
+		s[i] = n.String()
+	}
+	return strings.Join(s, ",")
+}
+
+func (c *cidrList) Set(v string) error {
+	for _, v := range strings.Split(v, ",") {
+		if v = strings.TrimSpace(v); v == "" {
+			continue
+		}
+		if !strings.Contains(v, "/") {
+			if ip := net.ParseIP(v); ip != nil && ip.To4() != nil {
+				v += "/32"
+			} else {
+				v += "/128"
+			}
+		}
+		_, n, err := net.ParseCIDR(v)
+		if err != nil {
+			return err
+		}
+		*c = append(*c, n)
+	}
+	return nil
+}
@@ -0,0 +1,236 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Config is the format of the YAML configuration file. Every setting
+// except the routing table can also be set with a command line flag,
+// flags take precedence over values in the file.
+type Config struct {
+	Listen     string   `yaml:"listen"`
+	Bind       []string `yaml:"bind"`
+	SocketMode string   `yaml:"socket_mode"`
+
+	TLS struct {
+		Cert             string   `yaml:"cert"`
+		Key              string   `yaml:"key"`
+		ClientCA         string   `yaml:"client_ca"`
+		ClientIdentities []string `yaml:"client_identities"`
+	} `yaml:"tls"`
+
+	Vault struct {
+		Enabled   bool   `yaml:"enabled"`
+		Path      string `yaml:"path"`
+		Engine    string `yaml:"engine"`
+		KVVersion int    `yaml:"kv_version"`
+		Namespace string `yaml:"namespace"`
+	} `yaml:"vault"`
+
+	SES struct {
+		Region           string        `yaml:"region"`
+		Endpoint         string        `yaml:"endpoint"`
+		Profile          string        `yaml:"profile"`
+		ConfigurationSet string        `yaml:"configuration_set"`
+		MaxAttempts      int           `yaml:"max_attempts"`
+		RetryDelay       time.Duration `yaml:"retry_delay"`
+		AssumeRole       assumeRole    `yaml:"assume_role"`
+		MaxMessageSize   int           `yaml:"max_message_size"`
+	} `yaml:"ses"`
+
+	Prometheus struct {
+		Disabled bool   `yaml:"disabled"`
+		Bind     string `yaml:"bind"`
+	} `yaml:"prometheus"`
+
+	Admin struct {
+		Bind  string `yaml:"bind"`
+		Token string `yaml:"token"`
+	} `yaml:"admin"`
+
+	RateLimit struct {
+		ConnectionRate      float64       `yaml:"connection_rate"`
+		ConnectionBurst     int           `yaml:"connection_burst"`
+		MaxSessions         int           `yaml:"max_sessions"`
+		SessionQueueTimeout time.Duration `yaml:"session_queue_timeout"`
+	} `yaml:"rate_limit"`
+
+	Suppression struct {
+		Store        string        `yaml:"store"`
+		TransientTTL time.Duration `yaml:"transient_ttl"`
+	} `yaml:"suppression"`
+
+	Routes map[string]sesRoute `yaml:"routes"`
+
+	// Quotas limits the number of messages each authenticated user may
+	// send in 24 hours. Users without a quota are unlimited.
+	Quotas map[string]int `yaml:"quotas"`
+}
+
+// loadConfig reads and validates the configuration file at path.
+func loadConfig(path string) (*Config, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	c := &Config{}
+	if err := yaml.Unmarshal(data, c); err != nil {
+		return nil, fmt.Errorf("unable to parse config file %s: %w", path, err)
+	}
+	if err := c.Validate(); err != nil {
+		return nil, fmt.Errorf("invalid config file %s: %w", path, err)
+	}
+	return c, nil
+}
+
+// Validate checks the configuration for errors, the returned error
+// names the offending field.
+func (c *Config) Validate() error {
+	if c.Listen != "" && !strings.HasPrefix(c.Listen, "unix:") {
+		if _, _, err := net.SplitHostPort(c.Listen); err != nil {
+			return fmt.Errorf("listen: %w", err)
+		}
+	}
+	for _, addr := range c.Bind {
+		if strings.HasPrefix(addr, "unix:") {
+			continue
+		}
+		if _, _, err := net.SplitHostPort(addr); err != nil {
+			return fmt.Errorf("bind: %w", err)
+		}
+	}
+	if c.TLS.Cert != "" && c.TLS.Key == "" {
+		return fmt.Errorf("tls.key: required when tls.cert is set")
+	}
+	if c.TLS.Key != "" && c.TLS.Cert == "" {
+		return fmt.Errorf("tls.cert: required when tls.key is set")
+	}
+	if c.Vault.Enabled && c.Vault.Path == "" {
+		return fmt.Errorf("vault.path: required when vault is enabled")
+	}
+	if c.SES.Endpoint != "" {
+		if u, err := url.Parse(c.SES.Endpoint); err != nil || u.Scheme == "" || u.Host == "" {
+			return fmt.Errorf("ses.endpoint: must be an absolute URL")
+		}
+	}
+	if c.SES.MaxAttempts < 0 {
+		return fmt.Errorf("ses.max_attempts: must not be negative")
+	}
+	if c.SES.RetryDelay < 0 {
+		return fmt.Errorf("ses.retry_delay: must not be negative")
+	}
+	if c.SES.MaxMessageSize < 0 {
+		return fmt.Errorf("ses.max_message_size: must not be negative")
+	}
+	if c.Prometheus.Bind != "" {
+		if _, _, err := net.SplitHostPort(c.Prometheus.Bind); err != nil {
+			return fmt.Errorf("prometheus.bind: %w", err)
+		}
+	}
+	if c.Admin.Bind != "" {
+		if _, _, err := net.SplitHostPort(c.Admin.Bind); err != nil {
+			return fmt.Errorf("admin.bind: %w", err)
+		}
+	}
+	if c.RateLimit.ConnectionRate < 0 {
+		return fmt.Errorf("rate_limit.connection_rate: must not be negative")
+	}
+	if c.RateLimit.ConnectionBurst < 0 {
+		return fmt.Errorf("rate_limit.connection_burst: must not be negative")
+	}
+	if c.RateLimit.MaxSessions < 0 {
+		return fmt.Errorf("rate_limit.max_sessions: must not be negative")
+	}
+	if c.RateLimit.SessionQueueTimeout < 0 {
+		return fmt.Errorf("rate_limit.session_queue_timeout: must not be negative")
+	}
+	if c.Suppression.TransientTTL < 0 {
+		return fmt.Errorf("suppression.transient_ttl: must not be negative")
+	}
+	for user, limit := range c.Quotas {
+		if limit < 0 {
+			return fmt.Errorf("quotas.%s: must not be negative", user)
+		}
+	}
+	for domain, route := range c.Routes {
+		if domain == "" {
+			return fmt.Errorf("routes: domain must not be empty")
+		}
+		if route.Profile != "" && route.VaultPath != "" {
+			return fmt.Errorf("routes.%s: only one of profile and vault_path may be set", domain)
+		}
+	}
+	return nil
+}
+
+// flagValues returns the settings in the file keyed by the name of the
+// equivalent command line flag. Unset values are omitted.
+func (c *Config) flagValues() map[string]string {
+	v := map[string]string{}
+	set := func(name, value string) {
+		if value != "" {
+			v[name] = value
+		}
+	}
+	set("bind", strings.Join(c.Bind, ","))
+	set("socket-mode", c.SocketMode)
+	set("tls-cert", c.TLS.Cert)
+	set("tls-key", c.TLS.Key)
+	set("tls-client-ca", c.TLS.ClientCA)
+	set("tls-client-identities", strings.Join(c.TLS.ClientIdentities, ","))
+	set("vault-path", c.Vault.Path)
+	set("vault-secret-engine", c.Vault.Engine)
+	set("vault-namespace", c.Vault.Namespace)
+	set("aws-region", c.SES.Region)
+	set("aws-endpoint", c.SES.Endpoint)
+	set("aws-profile", c.SES.Profile)
+	set("configuration-set-name", c.SES.ConfigurationSet)
+	set("assume-role-arn", c.SES.AssumeRole.ARN)
+	set("assume-role-external-id", c.SES.AssumeRole.ExternalID)
+	set("assume-role-session-name", c.SES.AssumeRole.SessionName)
+	set("prometheus-bind", c.Prometheus.Bind)
+	set("admin-bind", c.Admin.Bind)
+	set("suppression-store", c.Suppression.Store)
+	if c.Vault.Enabled {
+		v["enable-vault"] = "true"
+	}
+	if c.Prometheus.Disabled {
+		v["disable-prometheus"] = "true"
+	}
+	if c.Vault.KVVersion != 0 {
+		v["vault-kv-version"] = strconv.Itoa(c.Vault.KVVersion)
+	}
+	if c.SES.MaxAttempts != 0 {
+		v["ses-max-attempts"] = strconv.Itoa(c.SES.MaxAttempts)
+	}
+	if c.SES.RetryDelay != 0 {
+		v["ses-retry-delay"] = c.SES.RetryDelay.String()
+	}
+	if c.SES.MaxMessageSize != 0 {
+		v["max-message-size"] = strconv.Itoa(c.SES.MaxMessageSize)
+	}
+	if c.RateLimit.ConnectionRate != 0 {
+		v["connection-rate"] = strconv.FormatFloat(c.RateLimit.ConnectionRate, 'g', -1, 64)
+	}
+	if c.RateLimit.ConnectionBurst != 0 {
+		v["connection-burst"] = strconv.Itoa(c.RateLimit.ConnectionBurst)
+	}
+	if c.RateLimit.MaxSessions != 0 {
+		v["max-sessions"] = strconv.Itoa(c.RateLimit.MaxSessions)
+	}
+	if c.RateLimit.SessionQueueTimeout != 0 {
+		v["session-queue-timeout"] = c.RateLimit.SessionQueueTimeout.String()
+	}
+	if c.Suppression.TransientTTL != 0 {
+		v["suppression-transient-ttl"] = c.Suppression.TransientTTL.String()
+	}
+	return v
+}
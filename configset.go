@@ -0,0 +1,39 @@
+package main
+
+import (
+	"log/slog"
+	"net/mail"
+	"strings"
+)
+
+// configSetHeader selects the SES configuration set for a message. It is
+// removed from the message before it is sent.
+const configSetHeader = "X-SES-Configuration-Set"
+
+// configSetAllowlist is the set of configuration sets that messages may
+// select with configSetHeader.
+type configSetAllowlist map[string]bool
+
+func newConfigSetAllowlist(sets string) configSetAllowlist {
+	a := configSetAllowlist{}
+	for _, s := range strings.Split(sets, ",") {
+		if s = strings.TrimSpace(s); s != "" {
+			a[s] = true
+		}
+	}
+	return a
+}
+
+// choose returns the configuration set selected by the message header if
+// it is allowed, otherwise def.
+func (a configSetAllowlist) choose(h mail.Header, def *string) *string {
+	name := strings.TrimSpace(h.Get(configSetHeader))
+	if name == "" {
+		return def
+	}
+	if !a[name] {
+		slog.Warn("ignoring configuration set not in allowlist", "configuration_set", name)
+		return def
+	}
+	return &name
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var dedupSuppressed = promauto.NewCounter(prometheus.CounterOpts{
+	Namespace: "smtpd",
+	Name:      "dedup_suppressed_total",
+	Help:      "Total number of messages not sent because an identical message was recently sent",
+})
+
+// dedupCache remembers recently sent messages so that a message which
+// a client retries, for example because it timed out waiting for the
+// reply to DATA, is not sent twice.
+type dedupCache interface {
+	// seen returns the backend message ID the message with key was
+	// sent as, if it was sent recently.
+	seen(ctx context.Context, key string) (string, bool)
+	// record notes that the message with key was sent as messageID.
+	record(ctx context.Context, key, messageID string)
+	// forget removes the message with key, which could not be sent
+	// after it was recorded.
+	forget(ctx context.Context, key string)
+}
+
+// dedupKey returns the key identifying a message with the given
+// Message-ID sent from the sender to rcpts, or "" if the message has no
+// Message-ID. The envelope is part of the key so that a client which
+// splits the recipients of a message across transactions is not
+// suppressed.
+func dedupKey(messageID, from string, rcpts []string) string {
+	messageID = strings.TrimSpace(messageID)
+	if messageID == "" {
+		return ""
+	}
+	return messageID + "\x00" + from + "\x00" + strings.Join(rcpts, "\x00")
+}
+
+type dedupEntry struct {
+	messageID string
+	expires   time.Time
+}
+
+// memoryDedupCache is a dedupCache held in memory which remembers
+// messages for ttl.
+type memoryDedupCache struct {
+	ttl time.Duration
+
+	mu      sync.Mutex
+	entries map[string]dedupEntry
+}
+
+func newMemoryDedupCache(ttl time.Duration) *memoryDedupCache {
+	return &memoryDedupCache{ttl: ttl, entries: map[string]dedupEntry{}}
+}
+
+func (c *memoryDedupCache) seen(ctx context.Context, key string) (string, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e, ok := c.entries[key]
+	if !ok || !time.Now().Before(e.expires) {
+		return "", false
+	}
+	return e.messageID, true
+}
+
+func (c *memoryDedupCache) record(ctx context.Context, key, messageID string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	now := time.Now()
+	c.prune(now)
+	c.entries[key] = dedupEntry{messageID: messageID, expires: now.Add(c.ttl)}
+}
+
+func (c *memoryDedupCache) forget(ctx context.Context, key string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.entries, key)
+}
+
+// prune discards expired entries, the caller must hold c.mu.
+func (c *memoryDedupCache) prune(now time.Time) {
+	for key, e := range c.entries {
+		if !now.Before(e.expires) {
+			delete(c.entries, key)
+		}
+	}
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+const (
+	DefaultTrackedDomains = "gmail.com,googlemail.com,outlook.com,hotmail.com,live.com,yahoo.com,icloud.com,aol.com"
+	otherDomainLabel      = "other"
+)
+
+var domainOutcome = promauto.NewCounterVec(prometheus.CounterOpts{
+	Namespace: "smtpd",
+	Name:      "recipient_domain_outcome_total",
+	Help:      "Total number of recipients by domain and send outcome",
+}, []string{"domain", "outcome"})
+
+// domainTracker attributes send outcomes to recipient domains. Only
+// explicitly tracked domains get their own label value, all others are
+// counted as "other" to keep metric cardinality bounded.
+type domainTracker map[string]bool
+
+func newDomainTracker(domains string) domainTracker {
+	t := domainTracker{}
+	for _, d := range strings.Split(domains, ",") {
+		if d = strings.ToLower(strings.TrimSpace(d)); d != "" {
+			t[d] = true
+		}
+	}
+	return t
+}
+
+func (t domainTracker) label(email string) string {
+	idx := strings.LastIndex(email, "@")
+	if idx == -1 {
+		return otherDomainLabel
+	}
+	if d := strings.ToLower(email[idx+1:]); t[d] {
+		return d
+	}
+	return otherDomainLabel
+}
+
+// record attributes outcome to the domain of every recipient. SES sends
+// are per message so every recipient shares the same outcome.
+func (t domainTracker) record(rcpts []string, outcome string) {
+	for _, r := range rcpts {
+		domainOutcome.With(prometheus.Labels{
+			"domain":  t.label(r),
+			"outcome": outcome,
+		}).Inc()
+	}
+}
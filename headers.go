@@ -0,0 +1,101 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"net"
+	"net/mail"
+	"net/textproto"
+	"time"
+
+	"code.crute.us/mcrute/ses-smtpd-proxy/smtpd"
+)
+
+// messageHeader parses the header block of a raw RFC 5322 message.
+func messageHeader(data []byte) (mail.Header, error) {
+	h, err := textproto.NewReader(bufio.NewReader(bytes.NewReader(data))).ReadMIMEHeader()
+	if err != nil && len(h) == 0 {
+		return nil, err
+	}
+	return mail.Header(h), nil
+}
+
+// prependHeaders returns a copy of the raw message data with the given
+// header lines (without line endings) added to the top of the header
+// block.
+func prependHeaders(data []byte, lines ...string) []byte {
+	var b bytes.Buffer
+	for _, l := range lines {
+		b.WriteString(l)
+		b.WriteString("\r\n")
+	}
+	b.Write(data)
+	return b.Bytes()
+}
+
+// receivedHeaderHeadroom is the room left in the message size limit for
+// the Received header added by the proxy.
+const receivedHeaderHeadroom = 1024
+
+// receivedHeader returns an RFC 5321 trace header line (without line
+// ending) recording receipt of a message from c by the host named by.
+func receivedHeader(c smtpd.Connection, by string, now time.Time) string {
+	ip := c.Addr().String()
+	if host, _, err := net.SplitHostPort(ip); err == nil {
+		ip = host
+	}
+	if c.Addr().Network() == "unix" {
+		ip = "local"
+	} else {
+		ip = "[" + ip + "]"
+	}
+	helo := c.HelloHost()
+	if helo == "" {
+		helo = "unknown"
+	}
+	return fmt.Sprintf("Received: from %s (%s)\r\n\tby %s with %s id %s;\r\n\t%s",
+		helo, ip, by, c.Protocol(), c.SessionID(), now.Format(time.RFC1123Z))
+}
+
+// removeHeaders returns a copy of the raw message data with all header
+// fields with any of the given names, including their continuation
+// lines, removed. The message body is not modified.
+func removeHeaders(data []byte, names ...string) []byte {
+	var b bytes.Buffer
+	b.Grow(len(data))
+
+	removing := false
+	rest := data
+	for len(rest) > 0 {
+		line := rest
+		if idx := bytes.IndexByte(rest, '\n'); idx != -1 {
+			line = rest[:idx+1]
+		}
+		rest = rest[len(line):]
+
+		if len(bytes.TrimRight(line, "\r\n")) == 0 {
+			// End of the header block
+			b.Write(line)
+			b.Write(rest)
+			break
+		}
+
+		if line[0] != ' ' && line[0] != '\t' {
+			removing = false
+			if idx := bytes.IndexByte(line, ':'); idx != -1 {
+				name := textproto.CanonicalMIMEHeaderKey(string(bytes.TrimSpace(line[:idx])))
+				for _, n := range names {
+					if name == textproto.CanonicalMIMEHeaderKey(n) {
+						removing = true
+						break
+					}
+				}
+			}
+		}
+		if !removing {
+			b.Write(line)
+		}
+	}
+	return b.Bytes()
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+// fakeConn is an smtpd.Connection for a client at 192.0.2.1.
+type fakeConn struct {
+	helo string
+}
+
+func (c *fakeConn) IsAuthenticated() bool      { return false }
+func (c *fakeConn) AuthenticatedUser() string  { return "" }
+func (c *fakeConn) SessionID() string          { return "0123456789ab" }
+func (c *fakeConn) Close() error               { return nil }
+func (c *fakeConn) HelloHost() string          { return c.helo }
+func (c *fakeConn) Protocol() string           { return "ESMTPS" }
+func (c *fakeConn) ClientCertIdentity() string { return "" }
+func (c *fakeConn) Context() context.Context   { return context.Background() }
+
+func (c *fakeConn) Addr() net.Addr {
+	return &net.TCPAddr{IP: net.ParseIP("192.0.2.1"), Port: 56324}
+}
+
+func (c *fakeConn) TLSState() (tls.ConnectionState, bool) {
+	return tls.ConnectionState{}, false
+}
+
+func TestReceivedHeaderFitsHeadroom(t *testing.T) {
+	h := receivedHeader(&fakeConn{helo: "client.example.com"}, "mx.example.com", time.Now())
+	if !strings.HasPrefix(h, "Received: from client.example.com ([192.0.2.1])") {
+		t.Errorf("unexpected header %q", h)
+	}
+	if len(h)+2 > receivedHeaderHeadroom {
+		t.Errorf("header is %d bytes, more than the %d bytes of headroom", len(h)+2, receivedHeaderHeadroom)
+	}
+}
+
+// TestReceivedHeaderCountsTowardSizeLimit checks that the size limit is
+// applied to the message as sent, including the Received header.
+func TestReceivedHeaderCountsTowardSizeLimit(t *testing.T) {
+	received := receivedHeader(&fakeConn{helo: "client.example.com"}, "mx.example.com", time.Now())
+	const maxSize = 1000
+	headerSize := len(received) + 2
+
+	for _, tc := range []struct {
+		name    string
+		body    int
+		wantErr bool
+	}{
+		{"at limit", maxSize - headerSize, false},
+		{"over limit", maxSize - headerSize + 1, true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			e := &Envelope{rcpts: []string{"rcpt@example.com"}, received: received, maxSize: maxSize}
+			if err := e.BeginData(context.Background()); err != nil {
+				t.Fatal(err)
+			}
+			err := e.Write(context.Background(), []byte(strings.Repeat("x", tc.body)))
+			if (err != nil) != tc.wantErr {
+				t.Errorf("Write of %d bytes with a %d byte header: got error %v, want error %v", tc.body, headerSize, err, tc.wantErr)
+			}
+		})
+	}
+}
+
+// TestAdvertisedSizeIsAccepted checks that a message of the size
+// announced with SIZE is accepted, so clients respecting it are not
+// rejected once the message has been sent.
+func TestAdvertisedSizeIsAccepted(t *testing.T) {
+	for _, addReceived := range []bool{false, true} {
+		size := advertisedMessageSize(SesSizeLimit, addReceived)
+		e := &Envelope{rcpts: []string{"rcpt@example.com"}, maxSize: SesSizeLimit}
+		if addReceived {
+			e.received = receivedHeader(&fakeConn{helo: strings.Repeat("h", 255)}, "mx.example.com", time.Now())
+		} else if size != SesSizeLimit {
+			t.Errorf("advertised %d bytes without a Received header, want the %d byte limit", size, SesSizeLimit)
+		}
+		if err := e.BeginData(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+		if err := e.Write(context.Background(), make([]byte, size)); err != nil {
+			t.Errorf("message of the advertised %d bytes rejected with add Received %v: %v", size, addReceived, err)
+		}
+	}
+}
+
+func TestMailLoopDetection(t *testing.T) {
+	for _, tc := range []struct {
+		name        string
+		maxReceived int
+		received    int
+		wantErr     bool
+	}{
+		{"over threshold", DefaultMaxReceived, DefaultMaxReceived + 1, true},
+		{"at threshold", DefaultMaxReceived, DefaultMaxReceived, false},
+		{"disabled", 0, 100, false},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			fs := &fakeSender{}
+			e := &Envelope{
+				from:        "sender@example.com",
+				rcpts:       []string{"rcpt@example.com"},
+				sender:      fs,
+				maxSize:     1 << 20,
+				maxReceived: tc.maxReceived,
+			}
+			for i := 0; i < tc.received; i++ {
+				e.b.WriteString("Received: from relay.example.com by mx.example.com; Thu, 1 Jan 2026 00:00:00 +0000\r\n")
+			}
+			e.b.WriteString("Subject: test\r\n\r\nbody\r\n")
+
+			err := e.Close(context.Background())
+			if tc.wantErr {
+				if err == nil || !strings.HasPrefix(err.Error(), "554 5.4.6 ") {
+					t.Errorf("got error %v, want 554 5.4.6", err)
+				}
+				if len(fs.sent) != 0 {
+					t.Error("looping message was sent")
+				}
+				return
+			}
+			if err != nil || len(fs.sent) != 1 {
+				t.Errorf("got error %v and %d messages sent, want the message sent", err, len(fs.sent))
+			}
+		})
+	}
+}
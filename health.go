@@ -0,0 +1,107 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"maps"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/service/sesv2"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+const (
+	readyCheckTimeout = 2 * time.Second
+	readyCacheTTL     = 5 * time.Second
+)
+
+// newMetricsHandler creates the handler for the Prometheus server, which
+// also serves the health probes. It has no authentication so anything
+// that changes the proxy or exposes recipient addresses belongs on the
+// admin API instead.
+func newMetricsHandler(router func() *sesRouter, paused func() bool) http.Handler {
+	sm := http.NewServeMux()
+	sm.Handle("/metrics", promhttp.Handler())
+	sm.HandleFunc("/health", healthHandler)
+	sm.Handle("/ready", &readyHandler{router: router, paused: paused})
+	return sm
+}
+
+// healthHandler is a liveness probe, it succeeds as long as the process
+// is able to serve HTTP.
+func healthHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain")
+	w.Write([]byte("ok\n"))
+}
+
+// readiness is the response body of the readiness probe. Checks maps
+// each dependency to "ok" or the error that caused its check to fail.
+type readiness struct {
+	Ready  bool              `json:"ready"`
+	Checks map[string]string `json:"checks"`
+}
+
+// readyHandler is a readiness probe which verifies that SES and Vault
+// are reachable with the configured credentials and that the proxy is
+// not paused for maintenance. Results are cached for readyCacheTTL so
+// frequent probes do not consume SES API quota.
+type readyHandler struct {
+	router func() *sesRouter
+	paused func() bool
+
+	mu      sync.Mutex
+	checked time.Time
+	result  readiness
+}
+
+func (h *readyHandler) check(ctx context.Context) readiness {
+	ctx, cancel := context.WithTimeout(ctx, readyCheckTimeout)
+	defer cancel()
+
+	res := readiness{Ready: true, Checks: map[string]string{}}
+	record := func(name string, err error) {
+		if err != nil {
+			res.Ready = false
+			res.Checks[name] = err.Error()
+		} else {
+			res.Checks[name] = "ok"
+		}
+	}
+
+	for name, s := range h.router().senders() {
+		_, err := s.client.GetAccount(ctx, &sesv2.GetAccountInput{})
+		record(name, err)
+	}
+
+	vaultCredentialsMu.Lock()
+	defer vaultCredentialsMu.Unlock()
+	for _, v := range vaultCredentialsSet {
+		record("vault:"+v.path, v.check(ctx))
+	}
+
+	return res
+}
+
+func (h *readyHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	h.mu.Lock()
+	if time.Since(h.checked) > readyCacheTTL {
+		h.result = h.check(r.Context())
+		h.checked = time.Now()
+	}
+	res := h.result
+	h.mu.Unlock()
+
+	// Not cached so pausing takes effect immediately
+	if h.paused() {
+		res = readiness{Ready: false, Checks: maps.Clone(res.Checks)}
+		res.Checks["smtpd"] = "paused for maintenance"
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if !res.Ready {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	json.NewEncoder(w).Encode(res)
+}
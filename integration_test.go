@@ -0,0 +1,101 @@
+//go:build integration
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/smtp"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"code.crute.us/mcrute/ses-smtpd-proxy/smtpd"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/sesv2"
+	"github.com/aws/aws-sdk-go-v2/service/sesv2/types"
+)
+
+// TestLocalStackSend sends a message through the SMTP front end to the SES
+// emulator in LocalStack and checks that the emulator received it. The
+// endpoint is read from LOCALSTACK_ENDPOINT, defaulting to the standard
+// LocalStack port. Run with:
+//
+//	go test -tags integration -run LocalStack .
+func TestLocalStackSend(t *testing.T) {
+	endpoint := os.Getenv("LOCALSTACK_ENDPOINT")
+	if endpoint == "" {
+		endpoint = "http://localhost:4566"
+	}
+	t.Setenv("AWS_ACCESS_KEY_ID", "test")
+	t.Setenv("AWS_SECRET_ACCESS_KEY", "test")
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+
+	client, _, err := makeSesClient(ctx, "us-east-1", endpoint, "", "", assumeRole{}, vaultOptions{}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	from := "sender@example.com"
+	_, err = client.CreateEmailIdentity(ctx, &sesv2.CreateEmailIdentityInput{EmailIdentity: aws.String(from)})
+	var exists *types.AlreadyExistsException
+	if err != nil && !errors.As(err, &exists) {
+		t.Fatalf("verifying %s: %v", from, err)
+	}
+
+	sender := &sesSender{client: client, MaxAttempts: 1}
+	srv := &smtpd.Server{
+		Hostname: "localhost",
+		OnNewMailContext: func(c smtpd.Connection, from smtpd.MailAddress) (smtpd.EnvelopeContext, error) {
+			return &Envelope{
+				sessionID: c.SessionID(),
+				from:      from.Email(),
+				sender:    sender,
+				maxSize:   SesSizeLimit,
+			}, nil
+		},
+	}
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go srv.Serve(ln)
+	t.Cleanup(func() { srv.Shutdown(context.Background()) })
+
+	subject := fmt.Sprintf("integration test %d", time.Now().UnixNano())
+	msg := "From: " + from + "\r\nTo: rcpt@example.com\r\nSubject: " + subject + "\r\n\r\nHello\r\n"
+	if err := smtp.SendMail(ln.Addr().String(), nil, from, []string{"rcpt@example.com"}, []byte(msg)); err != nil {
+		t.Fatalf("sending through the proxy: %v", err)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, endpoint+"/_aws/ses?email="+from, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("reading sent messages from LocalStack: %v", err)
+	}
+	defer resp.Body.Close()
+	var sent struct {
+		Messages []struct {
+			Source  string `json:"Source"`
+			RawData string `json:"RawData"`
+		} `json:"messages"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&sent); err != nil {
+		t.Fatalf("decoding sent messages: %v", err)
+	}
+	for _, m := range sent.Messages {
+		if strings.Contains(m.RawData, subject) {
+			return
+		}
+	}
+	t.Errorf("LocalStack did not receive the message, got %d others", len(sent.Messages))
+}
@@ -3,50 +3,108 @@ package main
 import (
 	"bytes"
 	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
 	"flag"
 	"fmt"
 	"log"
+	"log/slog"
+	"net"
 	"net/http"
+	"net/textproto"
 	"os"
 	"os/signal"
+	"strconv"
+	"strings"
 	"syscall"
 	"time"
 
 	"code.crute.us/mcrute/ses-smtpd-proxy/smtpd"
-	"github.com/aws/aws-sdk-go/aws"
-	"github.com/aws/aws-sdk-go/aws/credentials"
-	"github.com/aws/aws-sdk-go/aws/session"
-	"github.com/aws/aws-sdk-go/service/ses"
-	"github.com/hashicorp/vault/api"
-	"github.com/hashicorp/vault/api/auth/approle"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/service/sesv2"
+	"github.com/aws/aws-sdk-go-v2/service/sesv2/types"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promauto"
-	"github.com/prometheus/client_golang/prometheus/promhttp"
 )
 
 var version string
 
 const (
-	SesSizeLimit = 10000000
-	DefaultAddr  = ":2500"
+	SesSizeLimit       = 10000000
+	DefaultAddr        = ":2500"
+	DefaultSMTPSAddr   = ":2465"
+	DefaultMaxReceived = 30
+	SesRecipientLimit  = 50
+
+	DefaultShutdownTimeout = 30 * time.Second
+	DefaultConnectionBurst = 10
 )
 
 var (
-	emailSent = promauto.NewCounter(prometheus.CounterOpts{
+	emailSent = promauto.NewCounterVec(prometheus.CounterOpts{
 		Namespace: "smtpd",
 		Name:      "email_send_success_total",
 		Help:      "Total number of successfuly sent emails",
-	})
+	}, []string{"user"})
 	emailError = promauto.NewCounterVec(prometheus.CounterOpts{
 		Namespace: "smtpd",
 		Name:      "email_send_fail_total",
 		Help:      "Total number emails that failed to send",
-	}, []string{"type"})
+	}, []string{"type", "user"})
 	sesError = promauto.NewCounter(prometheus.CounterOpts{
 		Namespace: "smtpd",
 		Name:      "ses_error_total",
 		Help:      "Total number errors with SES",
 	})
+	messageSize = promauto.NewHistogram(prometheus.HistogramOpts{
+		Namespace: "smtpd",
+		Name:      "message_size_bytes",
+		Help:      "Size of accepted messages",
+		Buckets:   prometheus.ExponentialBuckets(1024, 4, 8),
+	})
+	recipientsPerMessage = promauto.NewHistogram(prometheus.HistogramOpts{
+		Namespace: "smtpd",
+		Name:      "recipients_per_message",
+		Help:      "Number of recipients of accepted messages",
+		Buckets:   []float64{1, 2, 5, 10, 20, 50},
+	})
+	fastTalkerRejected = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: "smtpd",
+		Name:      "fast_talker_rejected_total",
+		Help:      "Total number of connections rejected for sending before the banner",
+	})
+	clientAbort = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: "smtpd",
+		Name:      "client_abort_total",
+		Help:      "Total number of clients that disconnected while sending a message",
+	})
+	connectionsAccepted = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: "smtpd",
+		Name:      "connections_accepted_total",
+		Help:      "Total number of connections accepted by the listeners",
+	})
+	acceptErrors = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "smtpd",
+		Name:      "accept_errors_total",
+		Help:      "Total number of errors accepting connections by kind",
+	}, []string{"kind"})
+	transactionReset = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: "smtpd",
+		Name:      "transaction_reset_total",
+		Help:      "Total number of mail transactions abandoned with RSET after recipients were added",
+	})
+	startTLSTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "smtpd",
+		Name:      "starttls_total",
+		Help:      "Total number of STARTTLS handshakes by result",
+	}, []string{"result"})
+	tlsConnections = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: "smtpd",
+		Name:      "tls_connections_total",
+		Help:      "Total number of sessions encrypted with STARTTLS or implicit TLS",
+	})
 	credentialRenewalSuccess = promauto.NewCounter(prometheus.CounterOpts{
 		Namespace: "smtpd",
 		Name:      "credential_renewal_success_total",
@@ -57,180 +115,307 @@ var (
 		Name:      "credential_renewal_error_total",
 		Help:      "Total number errors during credential renewal",
 	})
+	credentialRefreshError = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: "smtpd",
+		Name:      "credential_refresh_error_total",
+		Help:      "Total number of failed attempts to fetch a new credential from Vault",
+	})
 )
 
 type Envelope struct {
-	from          string
-	client        *ses.SES
-	configSetName *string
-	rcpts         []*string
-	b             bytes.Buffer
+	sessionID   string
+	user        string // user metric label
+	authUser    string // authenticated user, for quotas and auditing
+	authSender  string // RFC 4954 AUTH identity asserted on MAIL FROM, for auditing
+	clientIP    string
+	tls         string // negotiated TLS parameters, for auditing
+	quota       quotaManager
+	auditor     auditSink
+	messageID   string // backend message ID, set once sent
+	from        string
+	sender      mailSender
+	domains     domainTracker
+	unsubscribe *listUnsubscribe
+	maxReceived int
+	maxSize     int    // limit on the size of the message sent by the client
+	received    string // Received header line to add, if any
+	configSets  configSetAllowlist
+	dedup       dedupCache // recently sent messages, nil to disable
+	rcpts       []string
+	b           bytes.Buffer
 }
 
-func (e *Envelope) AddRecipient(rcpt smtpd.MailAddress) error {
-	email := rcpt.Email()
-	e.rcpts = append(e.rcpts, &email)
+func (e *Envelope) AddRecipient(ctx context.Context, rcpt smtpd.MailAddress) error {
+	e.rcpts = append(e.rcpts, rcpt.Email())
 	return nil
 }
 
-func (e *Envelope) BeginData() error {
+func (e *Envelope) BeginData(ctx context.Context) error {
 	if len(e.rcpts) == 0 {
-		emailError.With(prometheus.Labels{"type": "no valid recipients"}).Inc()
+		stats.messageError(e.user, "no valid recipients")
 		return smtpd.SMTPError("554 5.5.1 Error: no valid recipients")
 	}
+	if e.received != "" {
+		e.b.WriteString(e.received)
+		e.b.WriteString("\r\n")
+	}
 	return nil
 }
 
-func (e *Envelope) Write(line []byte) error {
+func (e *Envelope) Write(ctx context.Context, line []byte) error {
 	e.b.Write(line)
-	if e.b.Len() > SesSizeLimit { // SES limitation
-		emailError.With(prometheus.Labels{"type": "minimum message size exceed"}).Inc()
-		log.Printf("message size %d exceeds SES limit of %d", e.b.Len(), SesSizeLimit)
-		return smtpd.SMTPError("554 5.5.1 Error: maximum message size exceeded")
+	// The Received header counts as it is sent on to SES too
+	if e.b.Len() > e.maxSize {
+		stats.messageError(e.user, "minimum message size exceed")
+		slog.Warn("message size exceeds configured limit", "session_id", e.sessionID, "from", e.from, "size", e.b.Len(), "limit", e.maxSize)
+		return smtpd.SMTPError("552 5.3.4 Message size exceeds fixed maximum message size")
 	}
 	return nil
 }
 
-func (e *Envelope) logMessageSend() {
-	dr := make([]string, len(e.rcpts))
-	for i := range e.rcpts {
-		dr[i] = *e.rcpts[i]
-	}
-	log.Printf("sending message from %+v to %+v", e.from, dr)
-	emailSent.Inc()
+func (e *Envelope) logMessageSend(messageID string) {
+	slog.Info("sending message", "session_id", e.sessionID, "from", e.from, "rcpts", e.rcpts, "rcpt_count", len(e.rcpts), "message_id", messageID)
+	stats.messageSent(e.user, e.b.Len())
+	messageSize.Observe(float64(e.b.Len()))
+	recipientsPerMessage.Observe(float64(len(e.rcpts)))
 }
 
-func (e *Envelope) Close() error {
-	r := &ses.SendRawEmailInput{
-		ConfigurationSetName: e.configSetName,
-		Source:               &e.from,
-		Destinations:         e.rcpts,
-		RawMessage:           &ses.RawMessage{Data: e.b.Bytes()},
+// checkLoop rejects messages which have passed through more than
+// maxReceived hops, which is a sign of a mail loop.
+func (e *Envelope) checkLoop() error {
+	if e.maxReceived <= 0 {
+		return nil
 	}
-	_, err := e.client.SendRawEmail(r)
+	h, err := messageHeader(e.b.Bytes())
 	if err != nil {
-		log.Printf("ERROR: ses: %v", err)
-		emailError.With(prometheus.Labels{"type": "ses error"}).Inc()
-		sesError.Inc()
-		return smtpd.SMTPError("451 4.5.1 Temporary server error. Please try again later")
+		return nil
+	}
+	if n := len(h["Received"]); n > e.maxReceived {
+		stats.messageError(e.user, "routing loop")
+		slog.Warn("rejecting message as mail loop", "session_id", e.sessionID, "from", e.from, "received_count", n)
+		return smtpd.SMTPError("554 5.4.6 Routing loop detected")
+	}
+	return nil
+}
+
+func (e *Envelope) Close(ctx context.Context) error {
+	id, queued, err := e.send(ctx)
+	e.messageID = id
+	if queued {
+		e.audit("queued", "", nil)
+	} else {
+		e.audit("accepted", id, err)
 	}
-	e.logMessageSend()
 	return err
 }
 
-func logRenewal(renewal *api.RenewOutput) {
-	canRenew := "renewable"
-	if !renewal.Secret.Renewable {
-		canRenew = "not renewable"
-	}
-	leaseID := renewal.Secret.LeaseID
-	if leaseID == "" && renewal.Secret.MountType == "token" {
-		leaseID = "vault_token"
-	}
-	log.Printf("Successfully renewed lease '%s' at %s for %s, %s",
-		leaseID,
-		renewal.RenewedAt.Format(time.RFC3339),
-		time.Duration(renewal.Secret.LeaseDuration)*time.Second,
-		canRenew,
-	)
+// MessageID returns the ID assigned to the message by the sending
+// backend, such as the SES message ID, once it has been sent.
+func (e *Envelope) MessageID() string {
+	return e.messageID
 }
 
-func renewSecret(vc *api.Client, s *api.Secret, credentialError chan<- error) error {
-	w, err := vc.NewLifetimeWatcher(&api.LifetimeWatcherInput{Secret: s})
-	if err != nil {
-		return err
+// send sends the message with the envelope's sender, returning the
+// backend message ID. If the sender sends in the background queued is
+// true and the outcome is recorded and audited once it is known.
+func (e *Envelope) send(ctx context.Context) (id string, queued bool, err error) {
+	if err := e.checkLoop(); err != nil {
+		return "", false, err
 	}
-	go w.Start()
 
-	go func() {
-		for {
-			select {
-			case err := <-w.DoneCh():
-				if err != nil {
-					credentialRenewalError.Inc()
-					credentialError <- err
-				}
-			case renewal := <-w.RenewCh():
-				credentialRenewalSuccess.Inc()
-				logRenewal(renewal)
+	data := e.b.Bytes()
+	var configSetName *string
+	var tags []types.MessageTag
+	var dedup string
+	if h, err := messageHeader(data); err == nil {
+		if e.dedup != nil {
+			dedup = dedupKey(h.Get("Message-Id"), e.from, e.rcpts)
+		}
+		if dedup != "" {
+			if id, ok := e.dedup.seen(ctx, dedup); ok {
+				slog.Info("not sending duplicate message", "session_id", e.sessionID, "from", e.from, "rcpt_count", len(e.rcpts), "message_id", id)
+				dedupSuppressed.Inc()
+				return id, false, nil
 			}
 		}
-	}()
-
-	return nil
-}
-
-func getVaultSecret(ctx context.Context, path string, credentialError chan<- error) (credentials.Value, error) {
-	var r credentials.Value
-
-	vc, err := api.NewClient(api.DefaultConfig())
-	if err != nil {
-		return r, err
+		if h.Get(configSetHeader) != "" {
+			configSetName = e.configSets.choose(h, nil)
+		}
+		if tv := h[textproto.CanonicalMIMEHeaderKey(messageTagsHeader)]; len(tv) > 0 {
+			if tags, err = parseMessageTags(tv); err != nil {
+				stats.messageError(e.user, "invalid message tags")
+				slog.Warn("rejecting message with invalid tags", "session_id", e.sessionID, "from", e.from, "error", err)
+				return "", false, smtpd.SMTPError("554 5.6.0 Error: invalid " + messageTagsHeader + " header")
+			}
+		}
+		if h.Get(configSetHeader) != "" || h.Get(messageTagsHeader) != "" {
+			data = removeHeaders(data, configSetHeader, messageTagsHeader)
+		}
+	}
+	if e.unsubscribe != nil {
+		data = e.unsubscribe.apply(data, e.rcpts)
 	}
 
-	// Use AppRole if it's in the environment, otherwise assume VAULT_TOKEN
-	// was provided in the environment.
-	if roleID := os.Getenv("VAULT_APPROLE_ROLE_ID"); roleID != "" {
-		appRoleAuth, err := approle.NewAppRoleAuth(roleID, &approle.SecretID{
-			FromEnv: "VAULT_APPROLE_SECRET_ID",
+	msg := &outboundMessage{
+		from:      e.from,
+		rcpts:     e.rcpts,
+		data:      data,
+		configSet: configSetName,
+		tags:      tags,
+	}
+	if as, ok := e.sender.(asyncSender); ok {
+		// Sent in the background so the outcome is only known later.
+		// The message is charged to the quota and remembered for
+		// dedup while it is queued so that a retry of it is caught,
+		// both are undone if sending it fails.
+		e.recordSent(ctx, dedup, "")
+		err := as.queueMessage(ctx, msg, func(id string, err error) {
+			if err := e.recordOutcome(id, err); err != nil {
+				e.unrecordSent(context.Background(), dedup)
+				e.audit("failed", id, sesErrorReply(err))
+				return
+			}
+			if dedup != "" {
+				e.dedup.record(context.Background(), dedup, id)
+			}
+			e.audit("accepted", id, nil)
 		})
 		if err != nil {
-			return r, fmt.Errorf("unable to initialize AppRole auth method: %w", err)
-		}
-		if loginSecret, err := vc.Auth().Login(ctx, appRoleAuth); err != nil {
-			return r, fmt.Errorf("unable to login to AppRole auth method: %w", err)
-		} else {
-			if err := renewSecret(vc, loginSecret, credentialError); err != nil {
-				return r, err
-			}
+			e.unrecordSent(ctx, dedup)
+			slog.Error("unable to queue message", "session_id", e.sessionID, "from", e.from, "rcpt_count", len(e.rcpts), "error", err)
+			stats.messageError(e.user, "queue error")
+			return "", false, sesErrorReply(err)
 		}
+		slog.Info("queued message", "session_id", e.sessionID, "from", e.from, "rcpt_count", len(e.rcpts))
+		return "", true, nil
 	}
 
-	secret, err := vc.Logical().Read(path)
-	if err != nil {
-		return r, err
-	}
-	if secret == nil {
-		return r, fmt.Errorf("Vault returned no AWS secret")
+	id, err = e.sender.sendMessage(ctx, msg)
+	if err := e.recordOutcome(id, err); err != nil {
+		return "", false, sesErrorReply(err)
 	}
+	e.recordSent(ctx, dedup, id)
+	return id, false, nil
+}
 
-	keyId, ok := secret.Data["access_key"]
-	if !ok {
-		return r, fmt.Errorf("Vault secret had no access_key")
+// recordOutcome records the outcome of sending the message in the logs
+// and metrics, returning err.
+func (e *Envelope) recordOutcome(id string, err error) error {
+	if err != nil {
+		slog.Error("send failed", "session_id", e.sessionID, "from", e.from, "rcpt_count", len(e.rcpts), "error", err)
+		stats.messageError(e.user, "ses error")
+		e.domains.record(e.rcpts, "failure")
+		return err
 	}
+	e.logMessageSend(id)
+	e.domains.record(e.rcpts, "success")
+	return nil
+}
 
-	secretKey, ok := secret.Data["secret_key"]
-	if !ok {
-		return r, fmt.Errorf("Vault secret had no secret_key")
+// recordSent charges the message to the user's quota and remembers it
+// as sent as id for dedup.
+func (e *Envelope) recordSent(ctx context.Context, dedup, id string) {
+	if dedup != "" {
+		e.dedup.record(ctx, dedup, id)
+	}
+	if e.quota != nil {
+		e.quota.record(e.authUser)
 	}
+}
 
-	r.AccessKeyID = keyId.(string)
-	r.SecretAccessKey = secretKey.(string)
+// unrecordSent undoes recordSent for a message which could not be sent.
+func (e *Envelope) unrecordSent(ctx context.Context, dedup string) {
+	if dedup != "" {
+		e.dedup.forget(ctx, dedup)
+	}
+	if e.quota != nil {
+		e.quota.refund(e.authUser)
+	}
+}
 
-	return r, renewSecret(vc, secret, credentialError)
+// advertisedMessageSize returns the SIZE announced to clients for a limit
+// of maxSize bytes. Clients are told the limit less room for the Received
+// header, if one is added, so that a message of the advertised size still
+// fits once it is.
+func advertisedMessageSize(maxSize int, addReceived bool) int {
+	if addReceived {
+		return maxSize - receivedHeaderHeadroom
+	}
+	return maxSize
 }
 
-func makeSesClient(ctx context.Context, enableVault bool, vaultPath string, credentialError chan<- error) (*ses.SES, error) {
-	var err error
-	var s *session.Session
+// makeSesClient creates an SES client for region (or the SDK default if
+// empty) using endpoint in place of the standard SES endpoint if set.
+// Credentials are fetched from Vault if vaultPath is set, otherwise the
+// named AWS profile or default credential chain is used. If role has an
+// ARN those credentials are used to assume it. The Vault credential, if
+// any, is returned so that it can be closed once the client is no longer
+// used.
+func makeSesClient(ctx context.Context, region, endpoint, profile, vaultPath string, role assumeRole, vault vaultOptions, credentialError chan<- error) (client *sesv2.Client, cred *vaultCredentials, err error) {
+	var opts []func(*config.LoadOptions) error
+
+	if region != "" {
+		opts = append(opts, config.WithRegion(region))
+	}
 
-	if enableVault {
-		cred, err := getVaultSecret(ctx, vaultPath, credentialError)
-		if err != nil {
-			return nil, err
+	if vaultPath != "" {
+		if cred, err = newVaultCredentials(ctx, vaultPath, vault, credentialError); err != nil {
+			return nil, nil, err
 		}
+		defer func() {
+			if err != nil {
+				cred.close()
+			}
+		}()
 
-		s, err = session.NewSession(&aws.Config{
-			Credentials: credentials.NewStaticCredentialsFromCreds(cred),
-		})
-	} else {
-		s, err = session.NewSession()
+		opts = append(opts, config.WithCredentialsProvider(cred.cache))
+	} else if profile != "" {
+		opts = append(opts, config.WithSharedConfigProfile(profile))
 	}
+
+	cfg, err := config.LoadDefaultConfig(ctx, opts...)
 	if err != nil {
-		return nil, err
+		return nil, nil, err
+	}
+	if cfg.Region == "" {
+		return nil, nil, errors.New("no AWS region configured, set --aws-region or the AWS_REGION environment variable")
+	}
+	if role.ARN != "" {
+		if cfg, err = withAssumedRole(ctx, cfg, role); err != nil {
+			return nil, nil, err
+		}
 	}
 
-	return ses.New(s), nil
+	return sesv2.NewFromConfig(cfg, func(o *sesv2.Options) {
+		if endpoint != "" {
+			o.BaseEndpoint = aws.String(endpoint)
+		}
+	}), cred, nil
+}
+
+// disableExtensions stops s announcing the comma separated ESMTP
+// extensions in names.
+func disableExtensions(s *smtpd.Server, names string) error {
+	for _, name := range strings.Split(names, ",") {
+		switch strings.ToUpper(strings.TrimSpace(name)) {
+		case "":
+		case "PIPELINING":
+			s.DisablePipelining = true
+		case "SIZE":
+			s.DisableSize = true
+		case "8BITMIME":
+			s.Disable8BitMIME = true
+		case "CHUNKING":
+			s.DisableChunking = true
+		case "SMTPUTF8":
+			s.DisableSMTPUTF8 = true
+		case "DSN":
+			s.DisableDSN = true
+		default:
+			return fmt.Errorf("unknown extension %q", name)
+		}
+	}
+	return nil
 }
 
 func main() {
@@ -239,13 +424,94 @@ func main() {
 	ctx, cancel := signal.NotifyContext(context.Background(), syscall.SIGTERM, syscall.SIGINT)
 	defer cancel()
 
+	logLevel := flag.String("log-level", "info", "Minimum level of log messages: debug, info, warn or error")
+	logFormat := flag.String("log-format", "text", "Format of log messages: text or json")
+	configFile := flag.String("config", "", "Path to a YAML configuration file; flags override values in the file")
 	disablePrometheus := flag.Bool("disable-prometheus", false, "Disables prometheus metrics server")
 	prometheusBind := flag.String("prometheus-bind", ":2501", "Address/port on which to bind Prometheus server")
+	adminBind := flag.String("admin-bind", "", "Address/port on which to serve the admin API, requires a token in ADMIN_TOKEN or admin.token; disabled if empty")
+	prometheusTLSCert := flag.String("prometheus-tls-cert", "", "Path to a TLS certificate; serves Prometheus metrics over HTTPS if set")
+	prometheusTLSKey := flag.String("prometheus-tls-key", "", "Path to the private key for --prometheus-tls-cert")
+	prometheusTLSClientCA := flag.String("prometheus-tls-client-ca", "", "Path to CA bundle; requires scrapers to present a client certificate if set")
 	enableVault := flag.Bool("enable-vault", false, "Enable fetching AWS IAM credentials from a Vault server")
 	vaultPath := flag.String("vault-path", "", "Full path to Vault credential (ex: \"aws/creds/my-mail-user\")")
+	vaultSecretEngine := flag.String("vault-secret-engine", "", "Type of the Vault secrets engine at --vault-path: \"aws\" or \"kv-v2\"; detected if empty")
+	vaultKVVersion := flag.Int("vault-kv-version", 0, "Version of the KV v2 secret to read; latest if 0")
+	vaultNamespace := flag.String("vault-namespace", "", "Vault Enterprise namespace to log in and read credentials within; defaults to VAULT_NAMESPACE")
+	vaultRefreshAttempts := flag.Int("vault-refresh-attempts", 5, "Number of attempts to fetch a new Vault credential when the lease ends before exiting")
+	vaultRefreshDelay := flag.Duration("vault-refresh-delay", 5*time.Second, "Delay before retrying a failed Vault credential fetch, doubling for each further retry")
+	vaultFatalOnExpiry := flag.Bool("vault-fatal-on-expiry", false, "Exit when the Vault credential lease ends instead of fetching a new credential")
 	showVersion := flag.Bool("version", false, "Show program version")
-	configurationSetName := flag.String("configuration-set-name", "", "Configuration set name with which SendRawEmail will be invoked")
-
+	tlsCert := flag.String("tls-cert", "", "Path to a TLS certificate; enables STARTTLS if set")
+	tlsKey := flag.String("tls-key", "", "Path to the private key for --tls-cert")
+	tlsClientCA := flag.String("tls-client-ca", "", "Path to CA bundle; clients presenting a certificate signed by one of the CAs are authenticated by it")
+	tlsClientIdentities := flag.String("tls-client-identities", "", "Comma separated client certificate identities (common name or first SAN) allowed to authenticate; all are allowed if empty")
+	awsRegion := flag.String("aws-region", "", "AWS region to send mail in; defaults to the AWS SDK configuration (ex: AWS_REGION)")
+	awsEndpoint := flag.String("aws-endpoint", "", "URL of the SES endpoint to use instead of the standard regional endpoint (ex: a FIPS or VPC endpoint or LocalStack)")
+	awsProfile := flag.String("aws-profile", "", "Name of an AWS shared config profile to send with; ignored if Vault is enabled")
+	assumeRoleARN := flag.String("assume-role-arn", "", "ARN of an IAM role to assume for sending, for example to use SES identities in another account")
+	assumeRoleExternalID := flag.String("assume-role-external-id", "", "External ID to pass when assuming --assume-role-arn")
+	assumeRoleSessionName := flag.String("assume-role-session-name", defaultRoleSessionName, "Session name to use when assuming --assume-role-arn")
+	configSetName := flag.String("configuration-set-name", "", "Configuration set name with which SendEmail will be invoked")
+	trackedDomains := flag.String("tracked-domains", DefaultTrackedDomains, "Comma separated recipient domains to report delivery outcomes for; others are reported as \"other\"")
+	requireValidHelo := flag.Bool("require-valid-helo", false, "Reject clients whose HELO/EHLO argument is not a fully qualified domain name or address literal")
+	pausedReply := flag.String("paused-reply", smtpd.DefaultPausedReply, "SMTP reply to MAIL FROM while paused for maintenance")
+	fastTalkerDelay := flag.Duration("fast-talker-delay", 0, "Delay the greeting and reject clients that send data before it (ex: \"2s\"); disabled if 0")
+	statsFile := flag.String("stats-file", "", "Path to a file used to persist metric totals across restarts; disabled if empty")
+	statsFlushInterval := flag.Duration("stats-flush-interval", time.Minute, "Interval at which totals are written to --stats-file")
+	listUnsubscribeURL := flag.String("list-unsubscribe-url", "", "URL template for injected one-click List-Unsubscribe headers, may contain {recipient} and {message_id}; disabled if empty")
+	maxRecipients := flag.Int("max-recipients", SesRecipientLimit, "Maximum number of recipients accepted per message")
+	disabledExtensions := flag.String("disable-extensions", "", "Comma separated ESMTP extensions not to announce: PIPELINING, SIZE, 8BITMIME, CHUNKING, SMTPUTF8 or DSN")
+	maxMessageSize := flag.Int("max-message-size", SesSizeLimit, "Maximum message size in bytes, advertised with SIZE and enforced while the message is received")
+	dedupTTL := flag.Duration("dedup-ttl", 0, "Accept without sending a message with the same Message-ID, sender and recipients as one sent within this time; disabled if 0")
+	maxReceived := flag.Int("max-received-headers", DefaultMaxReceived, "Reject messages with more Received headers than this as mail loops; disabled if 0")
+	sesMaxAttempts := flag.Int("ses-max-attempts", DefaultSesMaxAttempts, "Maximum number of attempts to send a message when SES is throttling or failing")
+	sesRetryDelay := flag.Duration("ses-retry-delay", DefaultSesRetryDelay, "Base delay between SES send attempts, doubled on each retry")
+	shutdownTimeout := flag.Duration("shutdown-timeout", DefaultShutdownTimeout, "Time to wait for in-flight sessions to finish on shutdown")
+	routingFile := flag.String("routing-file", "", "Path to a JSON file mapping sender domains to SES regions, configuration sets and credentials")
+	connectionRate := flag.Float64("connection-rate", 0, "Maximum new connections per second from a single IP; unlimited if 0")
+	connectionBurst := flag.Int("connection-burst", DefaultConnectionBurst, "Number of connections from a single IP allowed in a burst above --connection-rate")
+	maxSessions := flag.Int("max-sessions", 0, "Maximum number of concurrent SMTP sessions; unlimited if 0")
+	sessionQueueTimeout := flag.Duration("session-queue-timeout", 5*time.Second, "Time a new connection waits for a free session when --max-sessions is reached")
+	proxyProtocol := flag.Bool("proxy-protocol", false, "Require a PROXY protocol header on every connection, as sent by load balancers")
+	enableSMTPS := flag.Bool("enable-smtps", false, "Enable an implicit TLS (SMTPS) listener, requires --tls-cert")
+	smtpsBind := flag.String("smtps-bind", DefaultSMTPSAddr, "Address/port on which to bind the SMTPS listener")
+	snsBind := flag.String("sns-bind", "", "Address/port on which to receive SES bounce and complaint notifications from SNS; disabled if empty")
+	snsTopicArns := flag.String("sns-topic-arns", "", "Comma separated SNS topic ARNs notifications are accepted from")
+	suppressionStore := flag.String("suppression-store", "", "Where to store suppressed recipients: memory, file:<path> or a redis:// URL; defaults to memory when --sns-bind is set")
+	suppressionTransientTTL := flag.Duration("suppression-transient-ttl", 0, "How long to suppress recipients after a transient bounce; transient bounces are ignored if zero")
+	batchSize := flag.Int("batch-size", 0, "Queue messages and send them in parallel batches of up to this many per configuration set; messages are sent as they are received if 0")
+	batchInterval := flag.Duration("batch-interval", time.Second, "Maximum time a message waits in a batch before it is sent")
+	batchConcurrency := flag.Int("batch-concurrency", 10, "Maximum number of batched messages sent at once")
+	sendWorkers := flag.Int("send-workers", 0, "Accept messages once queued and send them in the background with this many workers; messages are sent before replying if 0")
+	queueDrainTimeout := flag.Duration("queue-drain-timeout", 30*time.Second, "Time to wait for messages queued by --batch-size or --send-workers to send on shutdown, after sessions have finished")
+	sendQueueSize := flag.Int("send-queue-size", 100, "Number of messages queued for --send-workers before clients must wait")
+	relayHost := flag.String("relay-host", "", "Relay messages to this SMTP server (host:port) instead of SES; password is read from RELAY_PASSWORD")
+	relayUsername := flag.String("relay-username", "", "Username to authenticate to --relay-host with; authentication is disabled if empty")
+	relayStartTLS := flag.Bool("relay-starttls", true, "Require STARTTLS when connecting to --relay-host")
+	relayFailover := flag.Bool("relay-failover", false, "Send with SES and only use --relay-host if sending with SES fails")
+	allowedConfigSets := flag.String("allowed-configuration-sets", "", "Comma separated configuration sets messages may select with the "+configSetHeader+" header")
+	addReceived := flag.Bool("add-received-header", true, "Add a Received header recording the client to each message")
+	lmtp := flag.Bool("lmtp", false, "Speak LMTP rather than SMTP, for use as a delivery agent behind another MTA")
+	banner := flag.String("banner", "", "Text following the hostname in the SMTP greeting (default \""+smtpd.DefaultBanner+"\")")
+	socketMode := flag.String("socket-mode", "", "Octal permissions for the Unix socket when listening on unix:/path (ex: \"0660\")")
+	auditLog := flag.String("audit-log", "", "Path to a file to which a JSON audit record of each transaction is appended, or \"-\" for stdout; disabled if empty")
+	writeTimeout := flag.Duration("write-timeout", time.Minute, "Maximum time to wait for a client to accept a reply before disconnecting it; unlimited if 0")
+	idleTimeout := flag.Duration("idle-timeout", 5*time.Minute, "Maximum time a client may wait between commands; unlimited if 0")
+	tcpKeepAlive := flag.Duration("tcp-keepalive", 0, "Period of TCP keepalive probes on client connections; system default if 0, disabled if negative")
+	dataTimeout := flag.Duration("data-timeout", 10*time.Minute, "Maximum time allowed for a client to send a message body; unlimited if 0")
+	sink := flag.Bool("sink", false, "Accept messages but discard them instead of sending them with SES, for load testing")
+	perUserMetrics := flag.Bool("per-user-metrics", false, "Label send metrics with the authenticated user, for users listed in --metrics-users")
+	metricsUsers := flag.String("metrics-users", "", "Comma separated authenticated users to report metrics for when --per-user-metrics is set; others are reported as \"other\"")
+	sesQuotaInterval := flag.Duration("ses-quota-interval", DefaultSesQuotaInterval, "Interval at which the SES sending quota is published to Prometheus; disabled if 0")
+	clamdAddr := flag.String("clamd-addr", "", "Scan messages for malware with the ClamAV daemon at host:port or unix:/path before sending")
+	scanTimeout := flag.Duration("scan-timeout", 30*time.Second, "Maximum time to wait for the content scanner")
+	policyFailMode := flag.String("policy-fail-mode", "closed", "Behavior when a policy check errors: \"open\" accepts, \"closed\" rejects with 451")
+
+	var allowCIDRs cidrList
+	var binds bindList
+	flag.Var(&binds, "bind", "Address to listen on, host:port or unix:/path; may be repeated and replaces the default listen address")
+	flag.Var(&allowCIDRs, "allow-cidr", "Only accept connections from this network (ex: \"10.0.0.0/8\"); may be repeated, all networks are allowed if unset")
 	flag.Parse()
 
 	if *showVersion {
@@ -253,54 +519,500 @@ func main() {
 		return
 	}
 
+	setFlags := map[string]bool{}
+	flag.Visit(func(f *flag.Flag) { setFlags[f.Name] = true })
+
+	var cfg Config
+	if *configFile != "" {
+		c, err := loadConfig(*configFile)
+		if err != nil {
+			log.Fatalf("Error loading config: %s", err)
+		}
+		cfg = *c
+
+		for name, value := range cfg.flagValues() {
+			if !setFlags[name] {
+				if err := flag.Set(name, value); err != nil {
+					log.Fatalf("Error applying config value for %s: %s", name, err)
+				}
+			}
+		}
+	}
+
+	logger, err := newLogger(*logLevel, *logFormat)
+	if err != nil {
+		log.Fatalf("Error configuring logging: %s", err)
+	}
+	slog.SetDefault(logger)
+
+	failMode, err := smtpd.ParsePolicyFailMode(*policyFailMode)
+	if err != nil {
+		log.Fatalf("Error parsing policy fail mode: %s", err)
+	}
+
+	stopStats := make(chan struct{})
+	if *statsFile != "" {
+		if *statsFlushInterval <= 0 {
+			log.Fatalf("--stats-flush-interval must be positive")
+		}
+		if err := stats.load(*statsFile); err != nil {
+			log.Fatalf("Error loading stats file: %s", err)
+		}
+		go stats.persist(*statsFile, *statsFlushInterval, stopStats)
+	}
+
+	if *maxMessageSize <= 0 {
+		log.Fatalf("--max-message-size must be greater than zero")
+	}
+	advertisedSize := advertisedMessageSize(*maxMessageSize, *addReceived)
+	if advertisedSize <= 0 {
+		log.Fatalf("--max-message-size must be greater than %d to leave room for the Received header", receivedHeaderHeadroom)
+	}
+
 	credentialError := make(chan error, 2)
-	sesClient, err := makeSesClient(ctx, *enableVault, *vaultPath, credentialError)
+	if !*enableVault {
+		*vaultPath = ""
+	} else if *vaultPath == "" {
+		log.Fatalf("--vault-path is required when Vault is enabled")
+	}
+
+	switch *vaultSecretEngine {
+	case "", "aws", "kv-v2":
+	default:
+		log.Fatalf("--vault-secret-engine must be \"aws\" or \"kv-v2\"")
+	}
+	if *vaultKVVersion < 0 {
+		log.Fatalf("--vault-kv-version must not be negative")
+	}
+	if *vaultRefreshAttempts < 1 {
+		log.Fatalf("--vault-refresh-attempts must be at least 1")
+	}
+
+	vault := vaultOptions{
+		fatalOnExpiry:   *vaultFatalOnExpiry,
+		engine:          *vaultSecretEngine,
+		kvVersion:       *vaultKVVersion,
+		namespace:       *vaultNamespace,
+		refreshAttempts: *vaultRefreshAttempts,
+		refreshDelay:    *vaultRefreshDelay,
+	}
+	role := assumeRole{ARN: *assumeRoleARN, ExternalID: *assumeRoleExternalID, SessionName: *assumeRoleSessionName}
+	sesClient, _, err := makeSesClient(ctx, *awsRegion, *awsEndpoint, *awsProfile, *vaultPath, role, vault, credentialError)
 	if err != nil {
 		log.Fatalf("Error creating AWS session: %s", err)
 	}
 
 	addr := DefaultAddr
+	if cfg.Listen != "" {
+		addr = cfg.Listen
+	}
 	if flag.Arg(0) != "" {
 		addr = flag.Arg(0)
 	} else if flag.NArg() > 1 {
 		log.Fatalf("usage: %s [listen_host:port]", os.Args[0])
 	}
+	addrs := []string{addr}
+	if len(binds) > 0 {
+		addrs = binds
+		if flag.Arg(0) != "" {
+			addrs = append(addrs, flag.Arg(0))
+		}
+	}
 
-	if !*disablePrometheus {
+	var sockMode uint64
+	if *socketMode != "" {
+		if sockMode, err = strconv.ParseUint(*socketMode, 8, 32); err != nil {
+			log.Fatalf("Error parsing --socket-mode: %s", err)
+		}
+	}
+
+	domains := newDomainTracker(*trackedDomains)
+	configSets := newConfigSetAllowlist(*allowedConfigSets)
+
+	var dedup dedupCache
+	if *dedupTTL > 0 {
+		dedup = newMemoryDedupCache(*dedupTTL)
+	}
+
+	hostname, err := os.Hostname()
+	if err != nil {
+		hostname = "localhost"
+	}
+
+	var users userTracker
+	if *perUserMetrics {
+		users = newUserTracker(*metricsUsers)
+	}
+
+	quota := newMemoryQuotaManager(nil)
+	prometheus.MustRegister(quota)
+	prometheus.MustRegister(vaultCredentialAge{})
+
+	var suppression suppressionList
+	var onRcpt func(c smtpd.Connection, from, rcpt smtpd.MailAddress) error
+	if *snsBind != "" || *suppressionStore != "" {
+		if suppression, err = newSuppressionList(*suppressionStore); err != nil {
+			log.Fatalf("Error creating suppression list: %s", err)
+		}
+		onRcpt = checkSuppressed(suppression)
+	}
+
+	var sns *snsHandler
+	if *snsBind != "" {
+		if *snsTopicArns == "" {
+			log.Fatalf("--sns-topic-arns is required to receive SNS notifications")
+		}
+		sns = newSnsHandler(*snsTopicArns, suppression, *suppressionTransientTTL)
+	}
+
+	limiter := smtpd.NewIPRateLimiter(*connectionRate, *connectionBurst)
+	reloader := &configReloader{
+		ctx:             ctx,
+		path:            *configFile,
+		routingFile:     *routingFile,
+		cmdline:         setFlags,
+		client:          sesClient,
+		quota:           quota,
+		limiter:         limiter,
+		sns:             sns,
+		vault:           vault,
+		credentialError: credentialError,
+		flags: reloadFlags{
+			configSet:       configSetName,
+			sesMaxAttempts:  sesMaxAttempts,
+			sesRetryDelay:   sesRetryDelay,
+			connectionRate:  connectionRate,
+			connectionBurst: connectionBurst,
+			transientTTL:    suppressionTransientTTL,
+		},
+	}
+	if err := reloader.load(&cfg); err != nil {
+		log.Fatalf("Error applying config: %s", err)
+	}
+
+	var onData func(c smtpd.Connection, from smtpd.MailAddress, rcpts []smtpd.MailAddress, data []byte) ([]byte, error)
+	if *clamdAddr != "" {
+		onData = scanMessage(newClamdScanner(*clamdAddr), *scanTimeout)
+	}
+
+	if sns != nil {
 		sm := http.NewServeMux()
-		ps := &http.Server{Addr: *prometheusBind, Handler: sm}
-		sm.Handle("/metrics", promhttp.Handler())
-		go ps.ListenAndServe()
+		sm.Handle("/sns", sns)
+		go func() {
+			slog.Info("serving SNS notification endpoint", "addr", *snsBind)
+			if err := http.ListenAndServe(*snsBind, sm); err != nil {
+				slog.Error("error serving SNS notification endpoint", "error", err)
+			}
+		}()
+	}
+
+	senderFor := func(from string) mailSender { return reloader.currentRouter().senderFor(from) }
+	if *relayHost != "" {
+		relay := &relaySender{
+			addr:     *relayHost,
+			hostname: hostname,
+			startTLS: *relayStartTLS,
+			username: *relayUsername,
+			password: os.Getenv("RELAY_PASSWORD"),
+		}
+		if *relayFailover {
+			senderFor = func(from string) mailSender {
+				return &failoverSender{primary: reloader.currentRouter().senderFor(from), fallback: relay}
+			}
+		} else {
+			senderFor = func(string) mailSender { return relay }
+		}
+	}
+
+	var batch *batchSender
+	if *batchSize > 0 {
+		if *batchInterval <= 0 {
+			log.Fatalf("--batch-interval must be positive")
+		}
+		if *batchConcurrency < 1 {
+			log.Fatalf("--batch-concurrency must be at least 1")
+		}
+		batch = newBatchSender(*batchSize, *batchInterval, *batchConcurrency)
+		unbatched := senderFor
+		senderFor = func(from string) mailSender { return batch.queue(unbatched(from)) }
+	}
+
+	var pool *sendPool
+	if *sendWorkers > 0 {
+		if batch != nil {
+			log.Fatalf("--send-workers can not be used with --batch-size")
+		}
+		if *sendQueueSize < 0 {
+			log.Fatalf("--send-queue-size must not be negative")
+		}
+		pool = newSendPool(*sendWorkers, *sendQueueSize)
+		unpooled := senderFor
+		senderFor = func(from string) mailSender { return pool.queue(unpooled(from)) }
+	}
+
+	var auditor auditSink
+	if *auditLog != "" {
+		if auditor, err = newSlogAuditSink(*auditLog); err != nil {
+			log.Fatalf("Error opening audit log: %s", err)
+		}
+	}
+
+	var unsubscribe *listUnsubscribe
+	if *listUnsubscribeURL != "" {
+		if unsubscribe, err = newListUnsubscribe(*listUnsubscribeURL); err != nil {
+			log.Fatalf("Error configuring List-Unsubscribe: %s", err)
+		}
+	}
+
+	var startTLS *tls.Config
+	if *tlsCert != "" {
+		cert, err := newCertReloader(*tlsCert, *tlsKey)
+		if err != nil {
+			log.Fatalf("Error loading TLS certificate: %s", err)
+		}
+		startTLS = &tls.Config{
+			MinVersion:     tls.VersionTLS12,
+			GetCertificate: cert.GetCertificate,
+		}
 	}
 
-	if *configurationSetName == "" {
-		configurationSetName = nil
+	var onClientCert func(c smtpd.Connection, certs []*x509.Certificate) error
+	if *tlsClientCA != "" {
+		if startTLS == nil {
+			log.Fatalf("--tls-client-ca requires --tls-cert")
+		}
+		if startTLS.ClientCAs, err = loadCertPool(*tlsClientCA); err != nil {
+			log.Fatalf("Error loading TLS client CA: %s", err)
+		}
+		startTLS.ClientAuth = tls.VerifyClientCertIfGiven
+		onClientCert = clientCertAuthorizer(*tlsClientIdentities)
 	}
 
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	go func() {
+		for range hup {
+			slog.Info("SIGHUP received, reloading config and certificates")
+			reloadCertificates()
+			reloader.reload()
+		}
+	}()
+
 	s := &smtpd.Server{
-		Addr: addr,
-		OnNewMail: func(c smtpd.Connection, from smtpd.MailAddress) (smtpd.Envelope, error) {
-			return &Envelope{
-				from:          from.Email(),
-				client:        sesClient,
-				configSetName: configurationSetName,
-			}, nil
+		Addr:                  addr,
+		SocketMode:            os.FileMode(sockMode),
+		Banner:                *banner,
+		LMTP:                  *lmtp,
+		StartTLS:              startTLS,
+		MaxMessageSize:        int64(advertisedSize),
+		MaxRecipients:         *maxRecipients,
+		IdleTimeout:           *idleTimeout,
+		KeepAlivePeriod:       *tcpKeepAlive,
+		WriteTimeout:          *writeTimeout,
+		DataTimeout:           *dataTimeout,
+		ProxyProtocol:         *proxyProtocol,
+		AllowedNets:           allowCIDRs,
+		RateLimiter:           limiter,
+		MaxConcurrentSessions: *maxSessions,
+		SessionQueueTimeout:   *sessionQueueTimeout,
+		PolicyFailMode:        failMode,
+		FastTalkerDelay:       *fastTalkerDelay,
+		PausedReply:           *pausedReply,
+		RequireValidHelo:      *requireValidHelo,
+		OnFastTalker: func(c smtpd.Connection) {
+			fastTalkerRejected.Inc()
+		},
+		OnClientAbort: func(c smtpd.Connection) {
+			clientAbort.Inc()
+		},
+		OnTransactionReset: func(c smtpd.Connection) {
+			transactionReset.Inc()
+		},
+		OnAccept: func(err error, temporary bool) {
+			if err == nil {
+				connectionsAccepted.Inc()
+				return
+			}
+			kind := "permanent"
+			if temporary {
+				kind = "temporary"
+			}
+			acceptErrors.WithLabelValues(kind).Inc()
+		},
+		OnTLSHandshake: func(c smtpd.Connection, startTLS bool, err error) {
+			result := "success"
+			if err != nil {
+				result = "failure"
+			} else {
+				tlsConnections.Inc()
+			}
+			if startTLS {
+				startTLSTotal.WithLabelValues(result).Inc()
+			}
+		},
+		OnRcpt:       onRcpt,
+		OnClientCert: onClientCert,
+		OnData:       onData,
+		OnNewMailContext: func(c smtpd.Connection, from smtpd.MailAddress) (smtpd.EnvelopeContext, error) {
+			if err := checkQuota(quota, c.AuthenticatedUser()); err != nil {
+				slog.Info("rejecting message from user over quota", "session_id", c.SessionID(), "user", c.AuthenticatedUser())
+				return nil, err
+			}
+			e := &Envelope{
+				sessionID:   c.SessionID(),
+				user:        users.label(c.AuthenticatedUser()),
+				authUser:    c.AuthenticatedUser(),
+				clientIP:    clientIP(c),
+				tls:         tlsDescription(c),
+				quota:       quota,
+				auditor:     auditor,
+				from:        from.Email(),
+				sender:      senderFor(from.Email()),
+				domains:     domains,
+				unsubscribe: unsubscribe,
+				maxReceived: *maxReceived,
+				maxSize:     *maxMessageSize,
+				configSets:  configSets,
+				dedup:       dedup,
+			}
+			if pa, ok := from.(smtpd.ParameterizedAddress); ok {
+				e.authSender, _ = pa.Param("AUTH")
+			}
+			if *addReceived {
+				e.received = receivedHeader(c, hostname, time.Now())
+			}
+			if *sink {
+				return &sinkEnvelope{e}, nil
+			}
+			return e, nil
 		},
 	}
 
+	if err := disableExtensions(s, *disabledExtensions); err != nil {
+		log.Fatalf("Error parsing --disable-extensions: %s", err)
+	}
+
+	promauto.NewGaugeFunc(prometheus.GaugeOpts{
+		Namespace: "smtpd",
+		Name:      "active_sessions",
+		Help:      "Number of currently connected SMTP sessions",
+	}, func() float64 { return float64(s.ActiveConnections()) })
+	promauto.NewGaugeFunc(prometheus.GaugeOpts{
+		Namespace: "smtpd",
+		Name:      "paused",
+		Help:      "Whether new mail is refused for maintenance (1) or accepted (0)",
+	}, func() float64 {
+		if s.Paused() {
+			return 1
+		}
+		return 0
+	})
+
+	pause := make(chan os.Signal, 1)
+	signal.Notify(pause, syscall.SIGUSR1, syscall.SIGUSR2)
 	go func() {
-		log.Printf("ListenAndServe on %s", addr)
-		if err := s.ListenAndServe(); err != nil {
-			log.Printf("Error in ListenAndServe: %v", err)
+		for sig := range pause {
+			setMaintenance(s, sig == syscall.SIGUSR1)
 		}
 	}()
 
+	if *adminBind != "" {
+		token := os.Getenv("ADMIN_TOKEN")
+		if token == "" {
+			token = cfg.Admin.Token
+		}
+		if token == "" {
+			log.Fatalf("--admin-bind requires a token in ADMIN_TOKEN or admin.token")
+		}
+		as := &http.Server{Addr: *adminBind, Handler: newAdminHandler(token, s, reloader, suppression)}
+		go func() {
+			slog.Info("serving admin API", "addr", *adminBind)
+			if err := as.ListenAndServe(); err != nil {
+				slog.Error("error serving admin API", "error", err)
+			}
+		}()
+	}
+
+	if !*disablePrometheus {
+		ps := &http.Server{Addr: *prometheusBind, Handler: newMetricsHandler(reloader.currentRouter, s.Paused)}
+
+		if *prometheusTLSCert != "" {
+			ps.TLSConfig, err = makeServerTLSConfig(*prometheusTLSCert, *prometheusTLSKey, *prometheusTLSClientCA)
+			if err != nil {
+				log.Fatalf("Error loading Prometheus TLS configuration: %s", err)
+			}
+			go ps.ListenAndServeTLS("", "")
+		} else {
+			go ps.ListenAndServe()
+		}
+
+		if *sesQuotaInterval > 0 {
+			go pollSesQuota(ctx, sesClient, *sesQuotaInterval)
+		}
+	}
+
+	listeners, err := listenAll(s, addrs)
+	if err != nil {
+		log.Fatalf("Error listening: %s", err)
+	}
+	for _, ln := range listeners {
+		go func(ln net.Listener) {
+			slog.Info("Serve", "addr", ln.Addr())
+			if err := s.Serve(ln); err != nil && err != smtpd.ErrServerClosed {
+				slog.Error("error in Serve", "addr", ln.Addr(), "error", err)
+			}
+		}(ln)
+	}
+
+	if *enableSMTPS {
+		if startTLS == nil {
+			log.Fatalf("--tls-cert is required to enable SMTPS")
+		}
+		ln, err := net.Listen("tcp", *smtpsBind)
+		if err != nil {
+			log.Fatalf("Error listening for SMTPS: %s", err)
+		}
+		go func() {
+			slog.Info("ServeImplicitTLS", "addr", *smtpsBind)
+			if err := s.ServeImplicitTLS(ln); err != nil && err != smtpd.ErrServerClosed {
+				slog.Error("error in ServeImplicitTLS", "error", err)
+			}
+		}()
+	}
+
 	select {
 	case <-ctx.Done():
-		log.Printf("SIGTERM/SIGINT received, shutting down")
-		os.Exit(0)
+		slog.Info("SIGTERM/SIGINT received, shutting down")
+
+		sctx, scancel := context.WithTimeout(context.Background(), *shutdownTimeout)
+		defer scancel()
+		if err := s.Shutdown(sctx); err != nil {
+			slog.Error("error waiting for sessions to finish", "error", err)
+		}
+		// Queued messages have been accepted so get their own time to
+		// drain rather than whatever the sessions left over.
+		qctx, qcancel := context.WithTimeout(context.Background(), *queueDrainTimeout)
+		defer qcancel()
+		if batch != nil {
+			if err := batch.close(qctx); err != nil {
+				slog.Error("error waiting for batched messages to send", "error", err)
+			}
+		}
+		if pool != nil {
+			if err := pool.close(qctx); err != nil {
+				slog.Error("error waiting for queued messages to send", "error", err)
+			}
+		}
+
+		stats.logSummary(s.PeakConnections())
+		close(stopStats)
+		if *statsFile != "" {
+			if err := stats.save(*statsFile); err != nil {
+				slog.Error("error saving stats file", "error", err)
+			}
+		}
 	case err := <-credentialError:
-		log.Fatalf("Error renewing credential: %s", err)
+		log.Fatalf("Error fetching credential: %s", err)
 		os.Exit(1)
 	}
 }
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"encoding/json"
+	"log/slog"
+	"net/http"
+
+	"code.crute.us/mcrute/ses-smtpd-proxy/smtpd"
+)
+
+// maintenanceHandler reports whether the server is paused for
+// maintenance with GET, pauses it with POST and resumes it with DELETE.
+type maintenanceHandler struct {
+	server *smtpd.Server
+}
+
+func (h *maintenanceHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPost:
+		setMaintenance(h.server, true)
+	case http.MethodDelete:
+		setMaintenance(h.server, false)
+	default:
+		w.Header().Set("Allow", "GET, POST, DELETE")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]bool{"paused": h.server.Paused()})
+}
+
+// setMaintenance pauses or resumes accepting mail, logging changes.
+func setMaintenance(s *smtpd.Server, paused bool) {
+	if s.Paused() == paused {
+		return
+	}
+	s.SetPaused(paused)
+	if paused {
+		slog.Warn("entering maintenance mode, new mail will be refused")
+	} else {
+		slog.Info("leaving maintenance mode")
+	}
+}
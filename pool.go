@@ -0,0 +1,112 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var sendPoolQueued = promauto.NewGauge(prometheus.GaugeOpts{
+	Namespace: "smtpd",
+	Name:      "send_pool_queued",
+	Help:      "Number of accepted messages waiting for a send worker",
+})
+
+// sendPool sends messages in the background with a fixed number of
+// workers. Messages are accepted as soon as they are queued so send
+// failures can not be reported to the client. When the queue is full
+// sending blocks until a worker is free, slowing clients down rather
+// than holding an unbounded number of messages in memory.
+type sendPool struct {
+	mu       sync.RWMutex // held for reading while queueing
+	messages chan queuedMessage
+	closed   bool
+
+	workers  sync.WaitGroup
+	aborted  atomic.Bool // set when the drain at shutdown ends
+	inFlight atomic.Int64
+}
+
+func newSendPool(workers, queueSize int) *sendPool {
+	p := &sendPool{messages: make(chan queuedMessage, queueSize)}
+	p.workers.Add(workers)
+	for i := 0; i < workers; i++ {
+		go p.work()
+	}
+	return p
+}
+
+// queue returns a mailSender which queues messages to be sent with s by
+// the pool.
+func (p *sendPool) queue(s mailSender) mailSender {
+	return &poolQueue{pool: p, sender: s}
+}
+
+func (p *sendPool) work() {
+	defer p.workers.Done()
+	for q := range p.messages {
+		sendPoolQueued.Dec()
+		if p.aborted.Load() {
+			abandonQueued(q)
+			continue
+		}
+		p.inFlight.Add(1)
+		sendQueued(context.Background(), q)
+		p.inFlight.Add(-1)
+	}
+}
+
+func (p *sendPool) add(ctx context.Context, q queuedMessage) error {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	if p.closed {
+		return errSenderClosed
+	}
+	sendPoolQueued.Inc()
+	select {
+	case p.messages <- q:
+		return nil
+	case <-ctx.Done():
+		sendPoolQueued.Dec()
+		return ctx.Err()
+	}
+}
+
+// close stops accepting messages and waits for those that are queued to
+// be sent or ctx to end. Messages which have not started sending when
+// ctx ends are abandoned.
+func (p *sendPool) close(ctx context.Context) error {
+	p.mu.Lock()
+	if !p.closed {
+		p.closed = true
+		close(p.messages)
+	}
+	p.mu.Unlock()
+	if err := waitGroupContext(ctx, &p.workers); err != nil {
+		p.aborted.Store(true)
+		for q := range p.messages {
+			sendPoolQueued.Dec()
+			abandonQueued(q)
+		}
+		logInFlight(p.inFlight.Load())
+		return err
+	}
+	return nil
+}
+
+// poolQueue is the mailSender returned by sendPool.queue.
+type poolQueue struct {
+	pool   *sendPool
+	sender mailSender
+}
+
+func (q *poolQueue) sendMessage(ctx context.Context, m *outboundMessage) (string, error) {
+	return "", q.queueMessage(ctx, m, nil)
+}
+
+func (q *poolQueue) queueMessage(ctx context.Context, m *outboundMessage, done func(string, error)) error {
+	return q.pool.add(ctx, queuedMessage{sender: q.sender, msg: m, done: done})
+}
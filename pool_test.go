@@ -0,0 +1,118 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestSendPoolSendsQueuedMessagesOnClose(t *testing.T) {
+	fs := &fakeSender{delay: time.Millisecond}
+	p := newSendPool(2, 10)
+	for i := 0; i < 10; i++ {
+		if _, err := p.queue(fs).sendMessage(context.Background(), &outboundMessage{}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := p.close(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if len(fs.sent) != 10 {
+		t.Errorf("sent %d messages, want 10", len(fs.sent))
+	}
+	if fs.maxInFlight > 2 {
+		t.Errorf("sent %d messages at once, want at most 2", fs.maxInFlight)
+	}
+}
+
+// queueAndAbandon queues three messages with s, which sends one message
+// at a time, and closes it before they can all be sent. It returns the
+// results reported for the messages.
+func queueAndAbandon(t *testing.T, s mailSender, close func(context.Context) error) []error {
+	t.Helper()
+	var mu sync.Mutex
+	var results []error
+	for i := 0; i < 3; i++ {
+		err := s.(asyncSender).queueMessage(context.Background(), &outboundMessage{rcpts: []string{"rcpt@example.com"}}, func(id string, err error) {
+			mu.Lock()
+			defer mu.Unlock()
+			results = append(results, err)
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if err := close(ctx); err == nil {
+		t.Fatal("close returned no error, want the drain to time out")
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	return append([]error(nil), results...)
+}
+
+func TestQueueDrainAbandonsUnsentMessages(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		make func(fs *fakeSender) (mailSender, func(context.Context) error)
+	}{
+		{"pool", func(fs *fakeSender) (mailSender, func(context.Context) error) {
+			p := newSendPool(1, 10)
+			return p.queue(fs), p.close
+		}},
+		{"batch", func(fs *fakeSender) (mailSender, func(context.Context) error) {
+			b := newBatchSender(10, time.Hour, 1)
+			return b.queue(fs), b.close
+		}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			fs := &fakeSender{delay: 200 * time.Millisecond}
+			s, close := tc.make(fs)
+			before := counterValue(t, queuedAbandoned)
+			results := queueAndAbandon(t, s, close)
+
+			// The first message is being sent when the drain ends,
+			// the others are abandoned and reported straight away.
+			if len(results) != 2 {
+				t.Fatalf("got %d results when close returned, want 2", len(results))
+			}
+			for _, err := range results {
+				if err != errAbandoned {
+					t.Errorf("got result %v, want %v", err, errAbandoned)
+				}
+			}
+			if n := counterValue(t, queuedAbandoned) - before; n != 2 {
+				t.Errorf("counted %v abandoned messages, want 2", n)
+			}
+		})
+	}
+}
+
+// TestPoolSendAccounting checks that a message sent by the pool is
+// charged to quota while it is queued.
+func TestPoolSendAccounting(t *testing.T) {
+	fs := &fakeSender{delay: 50 * time.Millisecond}
+	p := newSendPool(1, 10)
+	quota := newMemoryQuotaManager(map[string]int{"user": 10})
+	e := &Envelope{
+		authUser: "user",
+		quota:    quota,
+		from:     "sender@example.com",
+		rcpts:    []string{"rcpt@example.com"},
+		sender:   p.queue(fs),
+		maxSize:  1 << 20,
+	}
+	e.b.WriteString("Subject: test\r\n\r\nbody\r\n")
+	if err := e.Close(context.Background()); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+	if n := quota.usage("user"); n != 1 {
+		t.Errorf("quota charged %d while queued, want 1", n)
+	}
+	p.close(context.Background())
+	if n := quota.usage("user"); n != 1 {
+		t.Errorf("quota charged %d after sending, want 1", n)
+	}
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/service/sesv2"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+const DefaultSesQuotaInterval = time.Minute
+
+var (
+	sesMax24HourSend = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: "smtpd",
+		Name:      "ses_max_24_hour_send",
+		Help:      "Maximum number of emails SES allows to be sent in a 24 hour period",
+	})
+	sesSentLast24Hours = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: "smtpd",
+		Name:      "ses_sent_last_24_hours",
+		Help:      "Number of emails sent by SES in the last 24 hours",
+	})
+	sesMaxSendRate = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: "smtpd",
+		Name:      "ses_max_send_rate",
+		Help:      "Maximum number of emails per second SES allows to be sent",
+	})
+)
+
+// pollSesQuota periodically publishes the SES sending quota of client
+// until ctx is done. On error the last known values are kept.
+func pollSesQuota(ctx context.Context, client *sesv2.Client, interval time.Duration) {
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		if err := updateSesQuota(ctx, client); err != nil {
+			slog.Warn("unable to fetch SES sending quota", "error", err)
+			sesError.Inc()
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+		}
+	}
+}
+
+func updateSesQuota(ctx context.Context, client *sesv2.Client) error {
+	ctx, cancel := context.WithTimeout(ctx, readyCheckTimeout)
+	defer cancel()
+
+	out, err := client.GetAccount(ctx, &sesv2.GetAccountInput{})
+	if err != nil {
+		return err
+	}
+	if q := out.SendQuota; q != nil {
+		sesMax24HourSend.Set(q.Max24HourSend)
+		sesSentLast24Hours.Set(q.SentLast24Hours)
+		sesMaxSendRate.Set(q.MaxSendRate)
+	}
+	return nil
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/smtp"
+	"time"
+)
+
+// relayTimeout bounds a relay delivery when the context has no deadline.
+const relayTimeout = 5 * time.Minute
+
+// relaySender relays messages to an upstream SMTP server, such as a
+// smarthost, as an alternative to SES.
+type relaySender struct {
+	addr     string // host:port of the upstream server
+	hostname string // name to greet the upstream server with
+	startTLS bool   // require STARTTLS before sending
+	username string // authenticate with AUTH PLAIN if set
+	password string
+}
+
+func (r *relaySender) sendMessage(ctx context.Context, m *outboundMessage) (string, error) {
+	err := r.relay(ctx, m)
+	recordBackendSend("relay", err)
+	return "", err
+}
+
+func (r *relaySender) relay(ctx context.Context, m *outboundMessage) error {
+	host, _, err := net.SplitHostPort(r.addr)
+	if err != nil {
+		return err
+	}
+
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "tcp", r.addr)
+	if err != nil {
+		return err
+	}
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		deadline = time.Now().Add(relayTimeout)
+	}
+	conn.SetDeadline(deadline)
+	// net/smtp does not support contexts so abort by closing the
+	// connection instead.
+	stop := context.AfterFunc(ctx, func() { conn.Close() })
+	defer stop()
+
+	c, err := smtp.NewClient(conn, host)
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	defer c.Close()
+
+	if err := c.Hello(r.hostname); err != nil {
+		return err
+	}
+	if r.startTLS {
+		if ok, _ := c.Extension("STARTTLS"); !ok {
+			return fmt.Errorf("relay %s does not support STARTTLS", r.addr)
+		}
+		if err := c.StartTLS(&tls.Config{ServerName: host, MinVersion: tls.VersionTLS12}); err != nil {
+			return err
+		}
+	}
+	if r.username != "" {
+		if err := c.Auth(smtp.PlainAuth("", r.username, r.password, host)); err != nil {
+			return err
+		}
+	}
+
+	if err := c.Mail(m.from); err != nil {
+		return err
+	}
+	for _, rcpt := range m.rcpts {
+		if err := c.Rcpt(rcpt); err != nil {
+			return err
+		}
+	}
+	w, err := c.Data()
+	if err != nil {
+		return err
+	}
+	if _, err := w.Write(m.data); err != nil {
+		return err
+	}
+	if err := w.Close(); err != nil {
+		return err
+	}
+	return c.Quit()
+}
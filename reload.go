@@ -0,0 +1,184 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"maps"
+	"reflect"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"code.crute.us/mcrute/ses-smtpd-proxy/smtpd"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/sesv2"
+)
+
+// configReloader holds the settings that can be changed without a
+// restart and applies changes to the configuration and routing files when
+// the process receives SIGHUP. Flags given on the command line continue
+// to override values in the file.
+type configReloader struct {
+	ctx             context.Context
+	path            string // configuration file, may be empty
+	routingFile     string
+	cmdline         map[string]bool // flags set on the command line
+	client          *sesv2.Client   // default SES client
+	quota           *memoryQuotaManager
+	limiter         *smtpd.IPRateLimiter
+	sns             *snsHandler // nil unless receiving SNS notifications
+	vault           vaultOptions
+	credentialError chan<- error
+	flags           reloadFlags
+
+	mu     sync.Mutex // serializes reloads
+	cfg    Config
+	router atomic.Pointer[sesRouter]
+}
+
+// load builds the router for cfg and makes cfg the current
+// configuration. Nothing is changed if the router can not be built.
+func (r *configReloader) load(cfg *Config) error {
+	connRate := flagOrFile(r, "connection-rate", r.flags.connectionRate, cfg.RateLimit.ConnectionRate, 0)
+	connBurst := flagOrFile(r, "connection-burst", r.flags.connectionBurst, cfg.RateLimit.ConnectionBurst, DefaultConnectionBurst)
+	transientTTL := flagOrFile(r, "suppression-transient-ttl", r.flags.transientTTL, cfg.Suppression.TransientTTL, 0)
+	prev := r.router.Load()
+	router, err := r.buildRouter(cfg, prev)
+	if err != nil {
+		return err
+	}
+	r.cfg = *cfg
+	r.router.Store(router)
+	if prev != nil {
+		prev.release(router)
+	}
+	r.quota.setLimits(cfg.Quotas)
+	r.limiter.SetLimit(connRate, connBurst)
+	if r.sns != nil {
+		r.sns.setTransientTTL(transientTTL)
+	}
+	return nil
+}
+
+// currentRouter returns the router for the current configuration.
+func (r *configReloader) currentRouter() *sesRouter {
+	return r.router.Load()
+}
+
+// reloadFlags are the command line flags for reloadable settings.
+type reloadFlags struct {
+	configSet       *string
+	sesMaxAttempts  *int
+	sesRetryDelay   *time.Duration
+	connectionRate  *float64
+	connectionBurst *int
+	transientTTL    *time.Duration
+}
+
+// flagOrFile returns the effective value of the named flag: the command
+// line value if given, otherwise the value from the file or def if the
+// file leaves it unset. The flag itself can not be used in place of def
+// as it holds the value from the file the process was started with.
+func flagOrFile[T comparable](r *configReloader, name string, cmdline *T, file, def T) T {
+	var unset T
+	switch {
+	case r.cmdline[name]:
+		return *cmdline
+	case file != unset:
+		return file
+	default:
+		return def
+	}
+}
+
+func (r *configReloader) buildRouter(cfg *Config, prev *sesRouter) (*sesRouter, error) {
+	def := &sesSender{
+		client:      r.client,
+		MaxAttempts: flagOrFile(r, "ses-max-attempts", r.flags.sesMaxAttempts, cfg.SES.MaxAttempts, DefaultSesMaxAttempts),
+		BaseDelay:   flagOrFile(r, "ses-retry-delay", r.flags.sesRetryDelay, cfg.SES.RetryDelay, DefaultSesRetryDelay),
+	}
+	if cs := flagOrFile(r, "configuration-set-name", r.flags.configSet, cfg.SES.ConfigurationSet, ""); cs != "" {
+		def.configSetName = &cs
+	}
+
+	var err error
+	routes := cfg.Routes
+	if r.routingFile != "" {
+		if routes, err = loadRoutes(r.routingFile); err != nil {
+			return nil, err
+		}
+	}
+	return newSesRouter(r.ctx, def, routes, prev, r.vault, r.credentialError)
+}
+
+// reload re-reads the configuration and routing files. The new
+// configuration is fully validated before any of it is applied so an
+// invalid file leaves the running configuration intact and is returned
+// as an error.
+func (r *configReloader) reload() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	cfg := &Config{}
+	if r.path != "" {
+		var err error
+		if cfg, err = loadConfig(r.path); err != nil {
+			slog.Error("error reloading config, keeping current config", "error", err)
+			return err
+		}
+	}
+
+	old := r.cfg
+	oldRouter := r.router.Load()
+	if err := r.load(cfg); err != nil {
+		slog.Error("error reloading config, keeping current config", "error", err)
+		return err
+	}
+
+	var ignored []string
+	check := func(name string, changed bool) {
+		if changed {
+			ignored = append(ignored, name)
+		}
+	}
+	check("listen", old.Listen != cfg.Listen)
+	check("bind", !slices.Equal(old.Bind, cfg.Bind))
+	check("socket_mode", old.SocketMode != cfg.SocketMode)
+	check("tls", !reflect.DeepEqual(old.TLS, cfg.TLS))
+	check("vault", old.Vault != cfg.Vault)
+	check("prometheus", old.Prometheus != cfg.Prometheus)
+	check("admin", old.Admin != cfg.Admin)
+	check("ses.region", old.SES.Region != cfg.SES.Region)
+	check("ses.endpoint", old.SES.Endpoint != cfg.SES.Endpoint)
+	check("ses.profile", old.SES.Profile != cfg.SES.Profile)
+	check("ses.assume_role", old.SES.AssumeRole != cfg.SES.AssumeRole)
+	check("ses.max_message_size", old.SES.MaxMessageSize != cfg.SES.MaxMessageSize)
+	check("rate_limit.max_sessions", old.RateLimit.MaxSessions != cfg.RateLimit.MaxSessions)
+	check("rate_limit.session_queue_timeout", old.RateLimit.SessionQueueTimeout != cfg.RateLimit.SessionQueueTimeout)
+	check("suppression.store", old.Suppression.Store != cfg.Suppression.Store)
+	if len(ignored) > 0 {
+		slog.Warn("config changes require a restart and were ignored", "settings", ignored)
+	}
+
+	var changed []string
+	newRouter := r.router.Load()
+	if !maps.Equal(oldRouter.config, newRouter.config) {
+		changed = append(changed, "routes")
+	}
+	od, nd := oldRouter.defaultSender, newRouter.defaultSender
+	if aws.ToString(od.configSetName) != aws.ToString(nd.configSetName) || od.MaxAttempts != nd.MaxAttempts || od.BaseDelay != nd.BaseDelay {
+		changed = append(changed, "ses")
+	}
+	if !maps.Equal(old.Quotas, cfg.Quotas) {
+		changed = append(changed, "quotas")
+	}
+	if old.RateLimit.ConnectionRate != cfg.RateLimit.ConnectionRate || old.RateLimit.ConnectionBurst != cfg.RateLimit.ConnectionBurst {
+		changed = append(changed, "rate_limit")
+	}
+	if old.Suppression.TransientTTL != cfg.Suppression.TransientTTL {
+		changed = append(changed, "suppression")
+	}
+	slog.Info("reloaded config", "changed", changed)
+	return nil
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"code.crute.us/mcrute/ses-smtpd-proxy/smtpd"
+	"github.com/aws/aws-sdk-go-v2/service/sesv2"
+)
+
+func TestReloadFlagPrecedence(t *testing.T) {
+	// The flags hold the values from the file the process was started
+	// with, which must not be used once the file no longer sets them.
+	maxAttempts, retryDelay, configSet := 7, time.Second, "startup"
+	rate, burst, ttl := 5.0, 3, time.Hour
+	r := &configReloader{
+		ctx:     context.Background(),
+		cmdline: map[string]bool{"ses-retry-delay": true},
+		client:  sesv2.New(sesv2.Options{Region: "us-east-1"}),
+		quota:   newMemoryQuotaManager(nil),
+		limiter: smtpd.NewIPRateLimiter(0, 0),
+		flags: reloadFlags{
+			configSet:       &configSet,
+			sesMaxAttempts:  &maxAttempts,
+			sesRetryDelay:   &retryDelay,
+			connectionRate:  &rate,
+			connectionBurst: &burst,
+			transientTTL:    &ttl,
+		},
+	}
+
+	cfg := &Config{}
+	cfg.SES.MaxAttempts = 5
+	cfg.SES.RetryDelay = time.Minute
+	if err := r.load(cfg); err != nil {
+		t.Fatal(err)
+	}
+	def := r.currentRouter().defaultSender
+	if def.MaxAttempts != 5 {
+		t.Errorf("got max attempts %d from the file, want 5", def.MaxAttempts)
+	}
+	if def.BaseDelay != time.Second {
+		t.Errorf("got retry delay %s, want the command line value 1s", def.BaseDelay)
+	}
+	if def.configSetName != nil {
+		t.Errorf("got configuration set %q, want none", *def.configSetName)
+	}
+
+	if err := r.load(&Config{}); err != nil {
+		t.Fatal(err)
+	}
+	if got := r.currentRouter().defaultSender.MaxAttempts; got != DefaultSesMaxAttempts {
+		t.Errorf("got max attempts %d once unset in the file, want the default %d", got, DefaultSesMaxAttempts)
+	}
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// sesRoute describes the SES account and region used for mail from a
+// sender domain. Routes without a region use the default sender's region
+// and endpoint. Credentials are fetched from Vault if VaultPath is set,
+// otherwise from the named AWS profile or the default AWS SDK
+// credential chain.
+type sesRoute struct {
+	Region           string     `json:"region" yaml:"region"`
+	Endpoint         string     `json:"endpoint" yaml:"endpoint"`
+	ConfigurationSet string     `json:"configuration_set" yaml:"configuration_set"`
+	Profile          string     `json:"profile" yaml:"profile"`
+	VaultPath        string     `json:"vault_path" yaml:"vault_path"`
+	AssumeRole       assumeRole `json:"assume_role" yaml:"assume_role"`
+}
+
+// loadRoutes reads a JSON file mapping sender domains to SES routes.
+func loadRoutes(path string) (map[string]sesRoute, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	routes := map[string]sesRoute{}
+	if err := json.Unmarshal(data, &routes); err != nil {
+		return nil, fmt.Errorf("unable to parse routing file %s: %w", path, err)
+	}
+	return routes, nil
+}
+
+// sesRouter selects the sender for a message based on the domain of the
+// envelope sender, falling back to a default sender for domains that
+// have no route.
+type sesRouter struct {
+	defaultSender *sesSender
+	routes        map[string]*sesSender
+	config        map[string]sesRoute // routes the senders were built from
+
+	// credentials are the Vault credentials of routes' clients, by
+	// domain.
+	credentials map[string]*vaultCredentials
+}
+
+// newSesRouter builds a sender for each route. Retry settings are copied
+// from the default sender. The SES clients of routes that are unchanged
+// from prev, if non-nil, are reused rather than creating new clients and
+// credentials. Once the new router replaces prev, prev.release must be
+// called to close the credentials it no longer shares.
+func newSesRouter(ctx context.Context, def *sesSender, routes map[string]sesRoute, prev *sesRouter, vault vaultOptions, credentialError chan<- error) (_ *sesRouter, err error) {
+	r := &sesRouter{
+		defaultSender: def,
+		routes:        map[string]*sesSender{},
+		config:        map[string]sesRoute{},
+		credentials:   map[string]*vaultCredentials{},
+	}
+	defer func() {
+		if err != nil {
+			r.release(prev)
+		}
+	}()
+	defOpts := def.client.Options()
+	for domain, route := range routes {
+		domain = strings.ToLower(domain)
+		r.config[domain] = route
+
+		var configSetName *string
+		if route.ConfigurationSet != "" {
+			configSetName = &route.ConfigurationSet
+		}
+
+		if prev != nil {
+			if old, ok := prev.config[domain]; ok && old == route {
+				r.routes[domain] = &sesSender{
+					client:        prev.routes[domain].client,
+					configSetName: configSetName,
+					MaxAttempts:   def.MaxAttempts,
+					BaseDelay:     def.BaseDelay,
+				}
+				if cred := prev.credentials[domain]; cred != nil {
+					r.credentials[domain] = cred
+				}
+				continue
+			}
+		}
+
+		if route.Region == "" {
+			route.Region = defOpts.Region
+			if route.Endpoint == "" && defOpts.BaseEndpoint != nil {
+				route.Endpoint = *defOpts.BaseEndpoint
+			}
+		}
+		client, cred, err := makeSesClient(ctx, route.Region, route.Endpoint, route.Profile, route.VaultPath, route.AssumeRole, vault, credentialError)
+		if err != nil {
+			return nil, fmt.Errorf("unable to create SES client for %s: %w", domain, err)
+		}
+		if cred != nil {
+			r.credentials[domain] = cred
+		}
+
+		r.routes[domain] = &sesSender{
+			client:        client,
+			configSetName: configSetName,
+			MaxAttempts:   def.MaxAttempts,
+			BaseDelay:     def.BaseDelay,
+		}
+	}
+	return r, nil
+}
+
+// release closes the Vault credentials of r that next, which may be nil,
+// does not share.
+func (r *sesRouter) release(next *sesRouter) {
+	for domain, cred := range r.credentials {
+		if next == nil || next.credentials[domain] != cred {
+			cred.close()
+		}
+	}
+}
+
+func (r *sesRouter) senderFor(from string) *sesSender {
+	if idx := strings.LastIndex(from, "@"); idx != -1 {
+		if s, ok := r.routes[strings.ToLower(from[idx+1:])]; ok {
+			return s
+		}
+	}
+	return r.defaultSender
+}
+
+// senders returns every sender keyed by the name used to identify it in
+// readiness checks.
+func (r *sesRouter) senders() map[string]*sesSender {
+	s := map[string]*sesSender{"ses": r.defaultSender}
+	for domain, sender := range r.routes {
+		s["ses:"+domain] = sender
+	}
+	return s
+}
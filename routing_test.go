@@ -0,0 +1,72 @@
+package main
+
+import (
+	"errors"
+	"slices"
+	"testing"
+)
+
+// registerTestCredentials returns a credential for path which is
+// registered for readiness checks and metrics like one read from Vault.
+func registerTestCredentials(t *testing.T, path string, credentialError chan<- error) *vaultCredentials {
+	t.Helper()
+	v := &vaultCredentials{path: path, credentialError: credentialError, done: make(chan struct{})}
+	vaultCredentialsMu.Lock()
+	defer vaultCredentialsMu.Unlock()
+	vaultCredentialsSet = append(vaultCredentialsSet, v)
+	t.Cleanup(v.close)
+	return v
+}
+
+func registeredCredentials(v *vaultCredentials) bool {
+	vaultCredentialsMu.Lock()
+	defer vaultCredentialsMu.Unlock()
+	return slices.Contains(vaultCredentialsSet, v)
+}
+
+func TestRouterReleasesReplacedCredentials(t *testing.T) {
+	credentialError := make(chan error, 1)
+	kept := registerTestCredentials(t, "aws/creds/kept", credentialError)
+	replaced := registerTestCredentials(t, "aws/creds/replaced", credentialError)
+	removed := registerTestCredentials(t, "aws/creds/removed", credentialError)
+	added := registerTestCredentials(t, "aws/creds/added", credentialError)
+
+	prev := &sesRouter{credentials: map[string]*vaultCredentials{
+		"kept.example.com":     kept,
+		"replaced.example.com": replaced,
+		"removed.example.com":  removed,
+	}}
+	next := &sesRouter{credentials: map[string]*vaultCredentials{
+		"kept.example.com":     kept,
+		"replaced.example.com": added,
+	}}
+	prev.release(next)
+
+	for _, tc := range []struct {
+		name   string
+		cred   *vaultCredentials
+		closed bool
+	}{
+		{"kept", kept, false},
+		{"replaced", replaced, true},
+		{"removed", removed, true},
+		{"added", added, false},
+	} {
+		if tc.cred.closed() != tc.closed {
+			t.Errorf("%s credential closed %v, want %v", tc.name, tc.cred.closed(), tc.closed)
+		}
+		if registeredCredentials(tc.cred) == tc.closed {
+			t.Errorf("%s credential registered %v, want %v", tc.name, !tc.closed, !tc.closed)
+		}
+	}
+
+	// A closed credential's watchers may still finish, which must not be
+	// reported as fatal.
+	replaced.reportError(errors.New("lease expired"))
+	replaced.onSecretDone(nil)
+	select {
+	case err := <-credentialError:
+		t.Errorf("closed credential reported %v", err)
+	default:
+	}
+}
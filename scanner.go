@@ -0,0 +1,103 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+
+	"code.crute.us/mcrute/ses-smtpd-proxy/smtpd"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var scanRejected = promauto.NewCounter(prometheus.CounterOpts{
+	Namespace: "smtpd",
+	Name:      "scan_rejected_total",
+	Help:      "Total number of messages rejected by the content scanner",
+})
+
+// contentScanner inspects a complete message before it is sent, for
+// example for malware. It returns an SMTPError to reject the message or
+// another error if the message could not be scanned. Implementations
+// must be safe for concurrent use.
+type contentScanner interface {
+	scan(ctx context.Context, data []byte) error
+}
+
+// clamdChunkSize is the size of the chunks a message is streamed to
+// clamd in, which must be below clamd's StreamMaxLength.
+const clamdChunkSize = 64 * 1024
+
+// clamdScanner scans messages with a ClamAV daemon using the INSTREAM
+// command.
+type clamdScanner struct {
+	network string
+	addr    string
+}
+
+// newClamdScanner creates a clamdScanner connecting to addr, which is a
+// host:port or "unix:" followed by the path of clamd's socket.
+func newClamdScanner(addr string) *clamdScanner {
+	if path, ok := strings.CutPrefix(addr, "unix:"); ok {
+		return &clamdScanner{network: "unix", addr: path}
+	}
+	return &clamdScanner{network: "tcp", addr: addr}
+}
+
+func (s *clamdScanner) scan(ctx context.Context, data []byte) error {
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, s.network, s.addr)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+
+	w := bufio.NewWriter(conn)
+	w.WriteString("zINSTREAM\x00")
+	for len(data) > 0 {
+		n := min(len(data), clamdChunkSize)
+		binary.Write(w, binary.BigEndian, uint32(n))
+		w.Write(data[:n])
+		data = data[n:]
+	}
+	binary.Write(w, binary.BigEndian, uint32(0))
+	if err := w.Flush(); err != nil {
+		return err
+	}
+
+	reply, err := bufio.NewReader(conn).ReadBytes(0)
+	if err != nil {
+		return err
+	}
+	result := string(bytes.TrimSuffix(reply, []byte{0}))
+	result = strings.TrimPrefix(result, "stream: ")
+	switch {
+	case result == "OK":
+		return nil
+	case strings.HasSuffix(result, " FOUND"):
+		scanRejected.Inc()
+		return smtpd.SMTPError(fmt.Sprintf("554 5.7.1 Message rejected: contains %s", strings.TrimSuffix(result, " FOUND")))
+	}
+	return fmt.Errorf("clamd: %s", result)
+}
+
+// scanMessage returns an OnData hook passing each message to scanner,
+// giving up after timeout.
+func scanMessage(scanner contentScanner, timeout time.Duration) func(c smtpd.Connection, from smtpd.MailAddress, rcpts []smtpd.MailAddress, data []byte) ([]byte, error) {
+	return func(c smtpd.Connection, from smtpd.MailAddress, rcpts []smtpd.MailAddress, data []byte) ([]byte, error) {
+		ctx, cancel := context.WithTimeout(c.Context(), timeout)
+		defer cancel()
+		if err := scanner.scan(ctx, data); err != nil {
+			return nil, err
+		}
+		return nil, nil
+	}
+}
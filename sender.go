@@ -0,0 +1,230 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"math/rand"
+	"time"
+
+	"code.crute.us/mcrute/ses-smtpd-proxy/smtpd"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	awshttp "github.com/aws/aws-sdk-go-v2/aws/transport/http"
+	"github.com/aws/aws-sdk-go-v2/service/sesv2"
+	"github.com/aws/aws-sdk-go-v2/service/sesv2/types"
+	"github.com/aws/smithy-go"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const (
+	DefaultSesMaxAttempts = 3
+	DefaultSesRetryDelay  = 200 * time.Millisecond
+
+	tracerName = "code.crute.us/mcrute/ses-smtpd-proxy"
+)
+
+var (
+	sesRetry = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: "smtpd",
+		Name:      "ses_retry_total",
+		Help:      "Total number of SES send retries due to throttling or service errors",
+	})
+	backendSend = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "smtpd",
+		Name:      "backend_send_total",
+		Help:      "Total number of messages handed to each sending backend by outcome",
+	}, []string{"backend", "outcome"})
+	backendFailover = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: "smtpd",
+		Name:      "backend_failover_total",
+		Help:      "Total number of messages sent with the fallback backend after the primary failed",
+	})
+	sesSendDuration = promauto.NewHistogram(prometheus.HistogramOpts{
+		Namespace: "smtpd",
+		Name:      "ses_send_duration_seconds",
+		Help:      "Duration of SES SendEmail calls",
+		Buckets:   []float64{.025, .05, .1, .25, .5, 1, 2.5, 5, 10, 30},
+	})
+)
+
+// outboundMessage is a received message ready to be sent by a
+// mailSender.
+type outboundMessage struct {
+	from  string
+	rcpts []string
+	data  []byte
+
+	// configSet, if non-nil, overrides the sender's default SES
+	// configuration set. Ignored by other backends.
+	configSet *string
+	// tags are SES message tags. Ignored by other backends.
+	tags []types.MessageTag
+}
+
+// mailSender is a backend that delivers messages. sendMessage returns
+// the ID assigned to the message by the backend, if it has one.
+type mailSender interface {
+	sendMessage(ctx context.Context, m *outboundMessage) (string, error)
+}
+
+// recordBackendSend counts the outcome of a send by backend.
+func recordBackendSend(backend string, err error) {
+	outcome := "success"
+	if err != nil {
+		outcome = "failure"
+	}
+	backendSend.With(prometheus.Labels{"backend": backend, "outcome": outcome}).Inc()
+}
+
+// failoverSender sends messages with primary, falling back to fallback
+// if primary fails for a reason other than rejecting the message.
+type failoverSender struct {
+	primary  mailSender
+	fallback mailSender
+}
+
+func (f *failoverSender) sendMessage(ctx context.Context, m *outboundMessage) (string, error) {
+	id, err := f.primary.sendMessage(ctx, m)
+	if err == nil || isSesRejection(err) || ctx.Err() != nil {
+		return id, err
+	}
+	slog.Warn("primary backend failed, sending with fallback", "from", m.from, "error", err)
+	backendFailover.Inc()
+	return f.fallback.sendMessage(ctx, m)
+}
+
+// sesSender sends messages through SES, retrying transient failures
+// with jittered exponential backoff.
+type sesSender struct {
+	client        *sesv2.Client
+	configSetName *string
+
+	// MaxAttempts is the total number of send attempts for a message,
+	// including the first. Values less than one are treated as one.
+	MaxAttempts int
+
+	// BaseDelay is the delay before the first retry, doubling for each
+	// subsequent retry.
+	BaseDelay time.Duration
+}
+
+func (s *sesSender) sendMessage(ctx context.Context, m *outboundMessage) (string, error) {
+	configSet := m.configSet
+	if configSet == nil {
+		configSet = s.configSetName
+	}
+	r := &sesv2.SendEmailInput{
+		ConfigurationSetName: configSet,
+		FromEmailAddress:     &m.from,
+		Destination:          &types.Destination{ToAddresses: m.rcpts},
+		Content:              &types.EmailContent{Raw: &types.RawMessage{Data: m.data}},
+		EmailTags:            m.tags,
+	}
+	out, err := s.send(ctx, r)
+	if err != nil {
+		sesError.Inc()
+	}
+	recordBackendSend("ses", err)
+	if err != nil {
+		return "", err
+	}
+	return aws.ToString(out.MessageId), nil
+}
+
+func (s *sesSender) send(ctx context.Context, r *sesv2.SendEmailInput) (*sesv2.SendEmailOutput, error) {
+	// Retries are handled here so disable the SDK retryer to avoid
+	// multiplying the number of attempts.
+	noRetry := func(o *sesv2.Options) { o.Retryer = aws.NopRetryer{} }
+
+	// The span is created by the tracer of the enclosing mail
+	// transaction, which is a no-op if tracing is not configured.
+	ctx, span := trace.SpanFromContext(ctx).TracerProvider().Tracer(tracerName).Start(ctx, "ses.SendEmail",
+		trace.WithSpanKind(trace.SpanKindClient))
+	defer span.End()
+
+	for attempt := 1; ; attempt++ {
+		start := time.Now()
+		out, err := s.client.SendEmail(ctx, r, noRetry)
+		sesSendDuration.Observe(time.Since(start).Seconds())
+		if err == nil || attempt >= s.MaxAttempts || !isRetryableSesError(err) {
+			span.SetAttributes(attribute.Int("ses.attempts", attempt))
+			if err != nil {
+				span.RecordError(err)
+				span.SetStatus(codes.Error, "send failed")
+			}
+			return out, err
+		}
+
+		delay := s.BaseDelay << (attempt - 1)
+		delay = delay/2 + time.Duration(rand.Int63n(int64(delay/2)+1))
+		slog.Warn("retrying ses send", "delay", delay, "attempt", attempt, "max_attempts", s.MaxAttempts, "error", err)
+		sesRetry.Inc()
+
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(delay):
+		}
+	}
+}
+
+// sesErrorReplies maps SES error codes to the reply sent to the client.
+// Permanent failures get a 5xx reply so the client does not retry a
+// message that can never be sent.
+var sesErrorReplies = map[string]smtpd.SMTPError{
+	"MessageRejected":                    "550 5.7.1 Message rejected by SES",
+	"MailFromDomainNotVerifiedException": "550 5.7.1 Sender domain is not verified with SES",
+	"AccountSuspendedException":          "550 5.7.1 SES account is suspended",
+	"BadRequestException":                "550 5.6.0 Message rejected by SES as invalid",
+	"NotFoundException":                  "550 5.3.5 SES configuration set does not exist",
+	"SendingPausedException":             "451 4.7.0 Sending is paused. Please try again later",
+	"LimitExceededException":             "451 4.7.0 SES sending limit exceeded. Please try again later",
+	"Throttling":                         "451 4.7.0 SES rate limit exceeded. Please try again later",
+	"ThrottlingException":                "451 4.7.0 SES rate limit exceeded. Please try again later",
+	"TooManyRequestsException":           "451 4.7.0 SES rate limit exceeded. Please try again later",
+}
+
+// sesErrorReply returns the reply for a failed send. Errors not listed
+// in sesErrorReplies, including server side and network errors, are
+// reported as temporary failures.
+func sesErrorReply(err error) smtpd.SMTPError {
+	var ae smithy.APIError
+	if errors.As(err, &ae) {
+		if r, ok := sesErrorReplies[ae.ErrorCode()]; ok {
+			return r
+		}
+	}
+	return smtpd.SMTPError("451 4.5.1 Temporary server error. Please try again later")
+}
+
+// isSesRejection reports whether err is SES refusing the message itself,
+// such as MessageRejected, which sending it again elsewhere would not
+// help.
+func isSesRejection(err error) bool {
+	var ae smithy.APIError
+	return errors.As(err, &ae) && ae.ErrorFault() == smithy.FaultClient && !isRetryableSesError(err)
+}
+
+// isRetryableSesError reports whether err is a throttling or server
+// side error that may succeed if retried. Permanent errors, such as
+// MessageRejected, are not retryable.
+func isRetryableSesError(err error) bool {
+	var ae smithy.APIError
+	if errors.As(err, &ae) {
+		switch ae.ErrorCode() {
+		case "Throttling", "ThrottlingException", "TooManyRequestsException":
+			return true
+		}
+	}
+
+	var re *awshttp.ResponseError
+	if errors.As(err, &re) && re.HTTPStatusCode() >= 500 {
+		return true
+	}
+
+	return false
+}
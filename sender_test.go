@@ -0,0 +1,32 @@
+package main
+
+import (
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/service/sesv2/types"
+	"github.com/aws/smithy-go"
+)
+
+func TestSesErrorReply(t *testing.T) {
+	for _, tc := range []struct {
+		name           string
+		err            error
+		code, enhanced string
+	}{
+		{"message rejected", &types.MessageRejected{}, "550", "5.7.1"},
+		{"domain not verified", &types.MailFromDomainNotVerifiedException{}, "550", "5.7.1"},
+		{"too many requests", &types.TooManyRequestsException{}, "451", "4.7.0"},
+		{"wrapped by the SDK", &smithy.OperationError{ServiceID: "SESv2", OperationName: "SendEmail", Err: &types.MessageRejected{}}, "550", "5.7.1"},
+		{"service error", &smithy.GenericAPIError{Code: "InternalFailure", Fault: smithy.FaultServer}, "451", "4.5.1"},
+		{"not an API error", errors.New("connection reset by peer"), "451", "4.5.1"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			f := strings.Fields(string(sesErrorReply(tc.err)))
+			if len(f) < 2 || f[0] != tc.code || f[1] != tc.enhanced {
+				t.Errorf("got reply %q, want %s %s", sesErrorReply(tc.err), tc.code, tc.enhanced)
+			}
+		})
+	}
+}
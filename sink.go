@@ -0,0 +1,32 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var emailSink = promauto.NewCounter(prometheus.CounterOpts{
+	Namespace: "smtpd",
+	Name:      "email_sink_total",
+	Help:      "Total number of emails accepted and discarded in sink mode",
+})
+
+// sinkEnvelope accepts messages like Envelope, including its size and
+// loop checks, but discards them rather than sending them with SES.
+type sinkEnvelope struct {
+	*Envelope
+}
+
+func (e *sinkEnvelope) Close(ctx context.Context) error {
+	if err := e.checkLoop(); err != nil {
+		e.audit("discarded", "", err)
+		return err
+	}
+	slog.Info("discarding message in sink mode", "session_id", e.sessionID, "from", e.from, "rcpt_count", len(e.rcpts), "size", e.b.Len())
+	emailSink.Inc()
+	e.audit("discarded", "", nil)
+	return nil
+}
@@ -0,0 +1,144 @@
+package smtpd
+
+import (
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// handleBDAT implements the RFC 3030 CHUNKING extension. The chunk is
+// always read from the connection, even if it is rejected, so that it
+// is not interpreted as commands. DataTimeout limits the time spent
+// reading all of a message's chunks.
+func (s *session) handleBDAT(arg string) {
+	f := strings.Fields(arg)
+	if len(f) < 1 || len(f) > 2 || (len(f) == 2 && strings.ToUpper(f[1]) != "LAST") {
+		s.sendlinef("501 5.5.4 Syntax: BDAT <size> [LAST]")
+		return
+	}
+	size, err := strconv.ParseInt(f[0], 10, 64)
+	if err != nil || size < 0 {
+		s.sendlinef("501 5.5.4 Invalid BDAT chunk size")
+		return
+	}
+	last := len(f) == 2
+
+	if s.env == nil {
+		if s.discardChunk(size) {
+			s.sendlinef("503 5.5.1 Error: need MAIL command")
+		}
+		return
+	}
+	if s.srv.LMTP && len(s.rcpts) == 0 {
+		if s.discardChunk(size) {
+			s.sendlinef("503 5.5.1 Error: need RCPT command")
+		}
+		return
+	}
+
+	if !s.bdat {
+		if s.srv.DataTimeout != 0 {
+			s.bdatDeadline = time.Now().Add(s.srv.DataTimeout)
+		}
+		if err := s.env.BeginData(s.Context()); err != nil {
+			if s.discardChunk(size) {
+				s.handleError(err)
+			}
+			return
+		}
+		s.bdat = true
+	}
+
+	// Compare against the space remaining so that a huge chunk size can
+	// not overflow bdatSize.
+	if size > s.srv.maxMessageSize()-s.bdatSize {
+		if s.discardChunk(size) {
+			s.log.Info("message size exceeds maximum", "size", s.bdatSize, "chunk_size", size, "max_size", s.srv.maxMessageSize())
+			s.resetTransaction()
+			s.sendlinef("%s", s.srv.responses().SizeExceeded)
+		}
+		return
+	}
+	s.bdatSize += size
+
+	_, span := s.srv.tracer().Start(s.Context(), "smtp.bdat",
+		trace.WithAttributes(attribute.Int64("smtp.chunk_size", size)))
+	chunk := make([]byte, size)
+	s.setDataReadDeadline(s.bdatDeadline)
+	_, err = io.ReadFull(s.br, chunk)
+	span.End()
+	if err != nil {
+		s.abortChunk(err)
+		return
+	}
+	if !s.bdatDeadline.IsZero() {
+		// Commands between chunks are subject to the usual timeouts
+		s.rwc.SetReadDeadline(time.Time{})
+	}
+
+	if err := s.writeData(chunk); err != nil {
+		s.resetTransaction()
+		s.sendSMTPErrorOrLinef(err, "550 ??? failed")
+		return
+	}
+
+	if !last {
+		s.sendlinef("250 2.0.0 Ok: %d octets received", size)
+		return
+	}
+
+	s.closeEnvelope(s.bdatSize)
+}
+
+// discardChunk reads and discards a BDAT chunk of size bytes, returning
+// false if the connection failed while reading it.
+func (s *session) discardChunk(size int64) bool {
+	s.setDataReadDeadline(s.bdatDeadline)
+	if _, err := io.CopyN(io.Discard, s.br, size); err != nil {
+		s.abortChunk(err)
+		return false
+	}
+	return true
+}
+
+// abortChunk ends the session after reading a BDAT chunk failed, telling
+// the client if it was too slow to send the message.
+func (s *session) abortChunk(err error) {
+	if ne, ok := err.(net.Error); ok && ne.Timeout() && !s.bdatDeadline.IsZero() && time.Now().After(s.bdatDeadline) {
+		s.log.Info("timeout during BDAT", "size", s.bdatSize)
+		s.resetTransaction()
+		s.sendlinef("421 4.4.2 Timeout during BDAT")
+		s.flush()
+		s.rwc.Close()
+		return
+	}
+	s.abortData(err)
+}
+
+// resetTransaction abandons the current mail transaction.
+func (s *session) resetTransaction() {
+	if s.span != nil {
+		s.span.End()
+		s.span = nil
+	}
+	s.ctx = nil
+	s.env = nil
+	s.rcpts = nil
+	s.buf.Reset()
+	s.bdat = false
+	s.bdatSize = 0
+	s.bdatDeadline = time.Time{}
+}
+
+// beginTransaction starts the trace span for a new mail transaction.
+func (s *session) beginTransaction() {
+	s.resetTransaction()
+	s.ctx, s.span = s.srv.tracer().Start(s.baseCtx, "smtp.transaction",
+		trace.WithSpanKind(trace.SpanKindServer),
+		trace.WithAttributes(attribute.String("smtp.session_id", s.id)))
+}
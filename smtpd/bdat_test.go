@@ -0,0 +1,131 @@
+package smtpd
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+// bdatSession returns a client that has started a transaction with one
+// recipient, and the envelope the message is written to.
+func bdatSession(t *testing.T, srv *Server) (*testClient, *testEnvelope) {
+	t.Helper()
+	env := &testEnvelope{}
+	srv.OnNewMail = func(c Connection, from MailAddress) (Envelope, error) { return env, nil }
+	c := dialTestConn(t, srv)
+	c.reply()
+	c.expect("EHLO client.example.com", "250")
+	c.expect("MAIL FROM:<sender@example.com>", "250")
+	c.expect("RCPT TO:<rcpt@example.com>", "250")
+	return c, env
+}
+
+func TestBDATChunks(t *testing.T) {
+	c, env := bdatSession(t, &Server{})
+
+	// Chunks are raw bytes, a chunk may end mid-line and lines beginning
+	// with a dot are not unstuffed.
+	c.send("BDAT 14\r\nSubject: test\r")
+	if r := c.reply(); !strings.HasPrefix(r, "250 2.0.0 Ok: 14 octets") {
+		t.Fatalf("got reply %q to first chunk", r)
+	}
+	if env.closed {
+		t.Fatal("envelope closed before the last chunk")
+	}
+	c.send("BDAT 10\r\n\n\r\n.body\r\n")
+	if r := c.reply(); !strings.HasPrefix(r, "250 2.0.0 Ok: 10 octets") {
+		t.Fatalf("got reply %q to second chunk", r)
+	}
+	c.send("BDAT 0 LAST\r\n")
+	if r := c.reply(); !strings.HasPrefix(r, "250 2.0.0 Ok: queued") {
+		t.Fatalf("got reply %q to last chunk", r)
+	}
+
+	if !env.closed {
+		t.Fatal("envelope not closed after the last chunk")
+	}
+	if want := "Subject: test\r\n\r\n.body\r\n"; string(env.data) != want {
+		t.Errorf("got data %q, want %q", env.data, want)
+	}
+
+	// The transaction is complete, the next needs a new MAIL command.
+	c.send("BDAT 3 LAST\r\nabc")
+	if r := c.reply(); r != "503 5.5.1 Error: need MAIL command" {
+		t.Errorf("got reply %q to BDAT without MAIL", r)
+	}
+	c.expect("NOOP", "250")
+}
+
+func TestBDATSingleChunk(t *testing.T) {
+	c, env := bdatSession(t, &Server{})
+	c.send("BDAT 6 LAST\r\nbody\r\n")
+	c.reply()
+	if !env.closed || string(env.data) != "body\r\n" {
+		t.Errorf("got data %q, closed %v", env.data, env.closed)
+	}
+}
+
+func TestBDATWithoutMail(t *testing.T) {
+	c := dialTestConn(t, &Server{OnNewMail: acceptMail})
+	c.reply()
+	c.expect("EHLO client.example.com", "250")
+	c.send("BDAT 4\r\nMAIL")
+	if r := c.reply(); r != "503 5.5.1 Error: need MAIL command" {
+		t.Errorf("got reply %q", r)
+	}
+	// The chunk was discarded rather than read as a command.
+	c.expect("NOOP", "250")
+}
+
+func TestBDATMixedWithDATA(t *testing.T) {
+	c, env := bdatSession(t, &Server{})
+	c.send("BDAT 6\r\nbody\r\n")
+	c.reply()
+	c.expect("DATA", "503")
+	c.send("BDAT 0 LAST\r\n")
+	c.reply()
+	if !env.closed || string(env.data) != "body\r\n" {
+		t.Errorf("got data %q, closed %v", env.data, env.closed)
+	}
+}
+
+func TestBDATMessageSize(t *testing.T) {
+	c, env := bdatSession(t, &Server{MaxMessageSize: 10})
+	c.send("BDAT 6\r\nbody\r\n")
+	c.reply()
+	c.send("BDAT 6 LAST\r\nbody\r\n")
+	if r := c.reply(); !strings.HasPrefix(r, "552 ") {
+		t.Errorf("got reply %q to oversize message", r)
+	}
+	if env.closed {
+		t.Error("oversize message passed to the envelope")
+	}
+	c.expect("NOOP", "250")
+}
+
+func TestBDATHugeChunk(t *testing.T) {
+	c, env := bdatSession(t, &Server{DataTimeout: 100 * time.Millisecond})
+	c.send("BDAT 10\r\n0123456789")
+	c.reply()
+	// Together with the first chunk the size overflows an int64. The
+	// chunk can not be accepted and is discarded until the client
+	// gives up sending it.
+	c.send("BDAT 9223372036854775800\r\n")
+	if r := c.reply(); r != "421 4.4.2 Timeout during BDAT" {
+		t.Errorf("got reply %q to huge chunk", r)
+	}
+	if env.closed {
+		t.Error("oversize message passed to the envelope")
+	}
+}
+
+func TestBDATDataTimeout(t *testing.T) {
+	c, env := bdatSession(t, &Server{DataTimeout: 100 * time.Millisecond})
+	c.send("BDAT 10\r\nbody")
+	if r := c.reply(); r != "421 4.4.2 Timeout during BDAT" {
+		t.Errorf("got reply %q to slow chunk", r)
+	}
+	if env.closed {
+		t.Error("incomplete message passed to the envelope")
+	}
+}
@@ -0,0 +1,60 @@
+package smtpd
+
+import (
+	"fmt"
+	"strings"
+)
+
+// extensions returns the ESMTP extensions announced in reply to EHLO
+// and LHLO.
+func (s *session) extensions() []string {
+	var ext []string
+	if s.srv.authEnabled() && (s.tls || !s.srv.RequireTLSForAuth) {
+		ext = append(ext, "AUTH "+strings.Join(s.srv.authMechanisms(), " "))
+	}
+	if s.srv.StartTLS != nil && !s.tls {
+		ext = append(ext, "STARTTLS")
+	}
+	if !s.srv.DisablePipelining {
+		ext = append(ext, "PIPELINING")
+	}
+	if !s.srv.DisableSize {
+		ext = append(ext, fmt.Sprintf("SIZE %d", s.srv.maxMessageSize()))
+	}
+	ext = append(ext, "ENHANCEDSTATUSCODES")
+	if !s.srv.Disable8BitMIME {
+		ext = append(ext, "8BITMIME")
+	}
+	if !s.srv.DisableChunking {
+		ext = append(ext, "CHUNKING")
+	}
+	if !s.srv.DisableSMTPUTF8 {
+		ext = append(ext, "SMTPUTF8")
+	}
+	if !s.srv.DisableDSN {
+		ext = append(ext, "DSN")
+	}
+	return ext
+}
+
+// checkParams rejects MAIL FROM and RCPT TO parameters belonging to
+// extensions that are not announced.
+func (srv *Server) checkParams(params map[string]string) error {
+	for name, value := range params {
+		var disabled bool
+		switch name {
+		case "SIZE":
+			disabled = srv.DisableSize
+		case "BODY":
+			disabled = srv.Disable8BitMIME && strings.ToUpper(value) == "8BITMIME"
+		case "SMTPUTF8":
+			disabled = srv.DisableSMTPUTF8
+		case "RET", "ENVID", "NOTIFY", "ORCPT":
+			disabled = srv.DisableDSN
+		}
+		if disabled {
+			return SMTPError(fmt.Sprintf("555 5.5.4 Unsupported parameter %s", name))
+		}
+	}
+	return nil
+}
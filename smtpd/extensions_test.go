@@ -0,0 +1,82 @@
+package smtpd
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestEHLOExtensions(t *testing.T) {
+	auth := func(c Connection, user, password string) error { return nil }
+	for _, tc := range []struct {
+		name string
+		srv  *Server
+		want []string
+	}{
+		{
+			name: "default",
+			srv:  &Server{},
+			want: []string{"PIPELINING", "SIZE 10240000", "ENHANCEDSTATUSCODES", "8BITMIME", "CHUNKING", "SMTPUTF8", "DSN"},
+		},
+		{
+			name: "auth and size",
+			srv:  &Server{OnAuthentication: auth, MaxMessageSize: 1000},
+			want: []string{"AUTH PLAIN LOGIN", "PIPELINING", "SIZE 1000", "ENHANCEDSTATUSCODES", "8BITMIME", "CHUNKING", "SMTPUTF8", "DSN"},
+		},
+		{
+			name: "auth requires TLS",
+			srv:  &Server{OnAuthentication: auth, RequireTLSForAuth: true, DisableSize: true},
+			want: []string{"PIPELINING", "ENHANCEDSTATUSCODES", "8BITMIME", "CHUNKING", "SMTPUTF8", "DSN"},
+		},
+		{
+			name: "disabled",
+			srv: &Server{
+				DisablePipelining: true,
+				DisableSize:       true,
+				Disable8BitMIME:   true,
+				DisableChunking:   true,
+				DisableSMTPUTF8:   true,
+				DisableDSN:        true,
+			},
+			want: []string{"ENHANCEDSTATUSCODES"},
+		},
+		{
+			name: "STARTTLS",
+			srv:  &Server{StartTLS: testTLSConfig(t), DisableDSN: true},
+			want: []string{"STARTTLS", "PIPELINING", "SIZE 10240000", "ENHANCEDSTATUSCODES", "8BITMIME", "CHUNKING", "SMTPUTF8"},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			tc.srv.Hostname = "mx.example.com"
+			tc.srv.OnNewMail = acceptMail
+			c := dialTestConn(t, tc.srv)
+			c.reply()
+			r := c.expect("EHLO client.example.com", "250")
+
+			var got []string
+			for _, line := range strings.Split(r, "\n")[1:] {
+				got = append(got, line[4:])
+			}
+			if strings.Join(got, ",") != strings.Join(tc.want, ",") {
+				t.Errorf("got extensions %q, want %q", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestDisabledExtensionParameters(t *testing.T) {
+	srv := &Server{
+		OnNewMail:       acceptMail,
+		DisableSize:     true,
+		Disable8BitMIME: true,
+		DisableSMTPUTF8: true,
+		DisableDSN:      true,
+	}
+	c := dialTestConn(t, srv)
+	c.reply()
+	c.expect("EHLO client.example.com", "250")
+	for _, param := range []string{"SIZE=100", "BODY=8BITMIME", "SMTPUTF8", "RET=HDRS"} {
+		c.expect("MAIL FROM:<sender@example.com> "+param, "555 5.5.4")
+	}
+	c.expect("MAIL FROM:<sender@example.com> BODY=7BIT", "250")
+	c.expect("RCPT TO:<rcpt@example.com> NOTIFY=NEVER", "555 5.5.4")
+}
@@ -0,0 +1,131 @@
+package smtpd
+
+import (
+	"bufio"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"math/big"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testEnvelope records the message it is given.
+type testEnvelope struct {
+	rcpts  []MailAddress
+	data   []byte
+	closed bool
+}
+
+func (e *testEnvelope) AddRecipient(rcpt MailAddress) error {
+	e.rcpts = append(e.rcpts, rcpt)
+	return nil
+}
+
+func (e *testEnvelope) BeginData() error { return nil }
+
+func (e *testEnvelope) Write(line []byte) error {
+	e.data = append(e.data, line...)
+	return nil
+}
+
+func (e *testEnvelope) Close() error {
+	e.closed = true
+	return nil
+}
+
+// acceptMail is an OnNewMail hook accepting every message.
+func acceptMail(c Connection, from MailAddress) (Envelope, error) {
+	return &testEnvelope{}, nil
+}
+
+// testClient is the client side of an SMTP session.
+type testClient struct {
+	t    *testing.T
+	conn net.Conn
+	br   *bufio.Reader
+}
+
+func newTestClient(t *testing.T, conn net.Conn) *testClient {
+	t.Helper()
+	conn.SetDeadline(time.Now().Add(10 * time.Second))
+	t.Cleanup(func() { conn.Close() })
+	return &testClient{t: t, conn: conn, br: bufio.NewReader(conn)}
+}
+
+// dialTestConn starts a session of srv over an in-memory connection.
+func dialTestConn(t *testing.T, srv *Server) *testClient {
+	t.Helper()
+	return newTestClient(t, NewTestConn(srv))
+}
+
+// reply reads a complete, possibly multi-line, reply and returns its
+// lines joined with "\n".
+func (c *testClient) reply() string {
+	c.t.Helper()
+	var lines []string
+	for {
+		line, err := c.br.ReadString('\n')
+		if err != nil {
+			c.t.Fatalf("reading reply after %q: %v", lines, err)
+		}
+		line = strings.TrimRight(line, "\r\n")
+		lines = append(lines, line)
+		if len(line) < 4 || line[3] != '-' {
+			return strings.Join(lines, "\n")
+		}
+	}
+}
+
+// send writes s, which must include any line endings.
+func (c *testClient) send(s string) {
+	c.t.Helper()
+	if _, err := c.conn.Write([]byte(s)); err != nil {
+		c.t.Fatalf("writing %q: %v", s, err)
+	}
+}
+
+// cmd sends line and returns the reply.
+func (c *testClient) cmd(line string) string {
+	c.t.Helper()
+	c.send(line + "\r\n")
+	return c.reply()
+}
+
+// expect sends line and fails the test unless the reply begins with
+// prefix.
+func (c *testClient) expect(line, prefix string) string {
+	c.t.Helper()
+	r := c.cmd(line)
+	if !strings.HasPrefix(r, prefix) {
+		c.t.Fatalf("%q: got reply %q, want %q", line, r, prefix)
+	}
+	return r
+}
+
+// testTLSConfig returns a server config with a self-signed certificate
+// for localhost.
+func testTLSConfig(t *testing.T) *tls.Config {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "localhost"},
+		DNSNames:     []string{"localhost"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &tls.Config{Certificates: []tls.Certificate{{Certificate: [][]byte{der}, PrivateKey: key}}}
+}
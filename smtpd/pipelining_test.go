@@ -0,0 +1,66 @@
+package smtpd
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestPipelining(t *testing.T) {
+	env := &testEnvelope{}
+	srv := &Server{OnNewMail: func(c Connection, from MailAddress) (Envelope, error) { return env, nil }}
+	c := dialTestConn(t, srv)
+	c.reply()
+	c.expect("EHLO client.example.com", "250")
+
+	// The whole transaction is sent in one write, the server must reply
+	// to each command in order without waiting for the client to read.
+	c.send("MAIL FROM:<sender@example.com>\r\n" +
+		"RCPT TO:<rcpt1@example.com>\r\n" +
+		"RCPT TO:<rcpt2@example.com>\r\n" +
+		"DATA\r\n")
+	for _, want := range []string{"250 2.1.0", "250 2.1.0", "250 2.1.0", "354 "} {
+		if r := c.reply(); !strings.HasPrefix(r, want) {
+			t.Fatalf("got reply %q, want %q", r, want)
+		}
+	}
+
+	// DATA switches to reading the message, which may itself be followed
+	// by pipelined commands.
+	c.send("Subject: test\r\n\r\nMAIL FROM:<not-a-command@example.com>\r\n.\r\nRSET\r\nNOOP\r\n")
+	for _, want := range []string{"250 2.0.0 Ok: queued", "250 ", "250 "} {
+		if r := c.reply(); !strings.HasPrefix(r, want) {
+			t.Fatalf("got reply %q, want %q", r, want)
+		}
+	}
+	if want := "Subject: test\r\n\r\nMAIL FROM:<not-a-command@example.com>\r\n"; string(env.data) != want {
+		t.Errorf("got data %q, want %q", env.data, want)
+	}
+	if len(env.rcpts) != 2 {
+		t.Errorf("got %d recipients, want 2", len(env.rcpts))
+	}
+}
+
+func TestPipeliningRejectedCommand(t *testing.T) {
+	srv := &Server{
+		OnNewMail: acceptMail,
+		OnRcpt: func(c Connection, from, rcpt MailAddress) error {
+			if rcpt.Email() == "unknown@example.com" {
+				return SMTPError("550 5.1.1 No such user")
+			}
+			return nil
+		},
+	}
+	c := dialTestConn(t, srv)
+	c.reply()
+	c.expect("EHLO client.example.com", "250")
+
+	c.send("MAIL FROM:<sender@example.com>\r\n" +
+		"RCPT TO:<unknown@example.com>\r\n" +
+		"RCPT TO:<rcpt@example.com>\r\n" +
+		"NOOP\r\n")
+	for _, want := range []string{"250 2.1.0", "550 5.1.1", "250 2.1.0", "250 "} {
+		if r := c.reply(); !strings.HasPrefix(r, want) {
+			t.Fatalf("got reply %q, want %q", r, want)
+		}
+	}
+}
@@ -0,0 +1,177 @@
+package smtpd
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// proxyHeaderTimeout bounds the time allowed for a client to send the
+// PROXY protocol header.
+const proxyHeaderTimeout = 5 * time.Second
+
+var proxyV2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+// readProxyHeader reads a PROXY protocol v1 or v2 header from br and
+// returns the source address it describes. A nil address is returned
+// for headers that carry no address (v1 UNKNOWN, v2 LOCAL or unknown
+// address families), in which case the connection address should be
+// used.
+func readProxyHeader(br *bufio.Reader) (net.Addr, error) {
+	// Both versions are distinguishable by their first six bytes, only
+	// peek that far so short non-PROXY input is rejected immediately.
+	sig, err := br.Peek(6)
+	if err != nil {
+		return nil, err
+	}
+	if bytes.Equal(sig, []byte("PROXY ")) {
+		return readProxyV1(br)
+	}
+	if bytes.Equal(sig, proxyV2Signature[:6]) {
+		if sig, err = br.Peek(len(proxyV2Signature)); err != nil {
+			return nil, err
+		}
+		if bytes.Equal(sig, proxyV2Signature) {
+			return readProxyV2(br)
+		}
+	}
+	return nil, errors.New("missing PROXY protocol header")
+}
+
+func readProxyV1(br *bufio.Reader) (net.Addr, error) {
+	// The v1 header is at most 107 bytes including the CRLF
+	var line []byte
+	for len(line) < 107 {
+		b, err := br.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+		line = append(line, b)
+		if b == '\n' {
+			break
+		}
+	}
+	if !bytes.HasSuffix(line, []byte("\r\n")) {
+		return nil, errors.New("malformed PROXY v1 header")
+	}
+
+	f := strings.Split(string(line[:len(line)-2]), " ")
+	if len(f) >= 2 && f[1] == "UNKNOWN" {
+		return nil, nil
+	}
+	if len(f) != 6 || (f[1] != "TCP4" && f[1] != "TCP6") {
+		return nil, errors.New("malformed PROXY v1 header")
+	}
+	ip := net.ParseIP(f[2])
+	if ip == nil {
+		return nil, fmt.Errorf("invalid PROXY v1 source address %q", f[2])
+	}
+	port, err := strconv.ParseUint(f[4], 10, 16)
+	if err != nil {
+		return nil, fmt.Errorf("invalid PROXY v1 source port %q", f[4])
+	}
+	return &net.TCPAddr{IP: ip, Port: int(port)}, nil
+}
+
+func readProxyV2(br *bufio.Reader) (net.Addr, error) {
+	hdr := make([]byte, 16)
+	if _, err := io.ReadFull(br, hdr); err != nil {
+		return nil, err
+	}
+	if hdr[12]>>4 != 2 {
+		return nil, errors.New("unsupported PROXY protocol version")
+	}
+	body := make([]byte, binary.BigEndian.Uint16(hdr[14:16]))
+	if _, err := io.ReadFull(br, body); err != nil {
+		return nil, err
+	}
+
+	switch hdr[12] & 0xf {
+	case 0x0: // LOCAL, health checks from the proxy itself
+		return nil, nil
+	case 0x1: // PROXY
+	default:
+		return nil, errors.New("unsupported PROXY v2 command")
+	}
+
+	switch hdr[13] {
+	case 0x11: // TCP over IPv4
+		if len(body) < 12 {
+			return nil, errors.New("short PROXY v2 IPv4 address block")
+		}
+		return &net.TCPAddr{IP: net.IP(body[0:4]), Port: int(binary.BigEndian.Uint16(body[8:10]))}, nil
+	case 0x21: // TCP over IPv6
+		if len(body) < 36 {
+			return nil, errors.New("short PROXY v2 IPv6 address block")
+		}
+		return &net.TCPAddr{IP: net.IP(body[0:16]), Port: int(binary.BigEndian.Uint16(body[32:34]))}, nil
+	}
+	return nil, nil
+}
+
+// handleProxyHeader reads the PROXY protocol header from the start of
+// the connection and records the client address it contains. Waiting for
+// the header is interrupted by Shutdown, in which case ErrServerClosed is
+// returned.
+func (s *session) handleProxyHeader() error {
+	s.rwc.SetReadDeadline(time.Now().Add(proxyHeaderTimeout))
+	defer s.rwc.SetReadDeadline(time.Time{})
+	if !s.setIdle(true) {
+		return ErrServerClosed
+	}
+	addr, err := readProxyHeader(s.br)
+	if !s.setIdle(false) && err != nil {
+		return ErrServerClosed
+	}
+	if err != nil {
+		return err
+	}
+	if addr != nil {
+		s.remoteAddr = addr
+		s.log = s.srv.logger().With("remote_addr", addr.String(), "session_id", s.id)
+	}
+	return nil
+}
+
+// wrapImplicitTLS encrypts an implicit TLS session accepted from a plain
+// listener with the StartTLS config. It is done after the PROXY header,
+// which is sent in the clear, has been read. Bytes of the TLS handshake
+// already buffered while reading the header are passed to TLS.
+func (s *session) wrapImplicitTLS() error {
+	if !s.tls {
+		return nil
+	}
+	if _, ok := s.rwc.(*tls.Conn); ok {
+		if s.srv.ProxyProtocol {
+			return errors.New("ProxyProtocol requires ServeImplicitTLS to be given a plain listener")
+		}
+		return nil
+	}
+	if s.srv.StartTLS == nil {
+		return errors.New("ServeImplicitTLS given a plain listener requires a StartTLS config")
+	}
+	tc := tls.Server(&bufferedConn{Conn: s.rwc, r: s.br}, s.srv.StartTLS)
+	s.rwc = tc
+	s.br = bufio.NewReader(tc)
+	s.bw.Reset(tc)
+	return nil
+}
+
+// bufferedConn is a net.Conn which reads from r, a reader buffering the
+// connection, so that buffered data is not lost.
+type bufferedConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (c *bufferedConn) Read(b []byte) (int, error) {
+	return c.r.Read(b)
+}
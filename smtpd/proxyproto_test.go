@@ -0,0 +1,159 @@
+package smtpd
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"net"
+	"strings"
+	"testing"
+)
+
+// proxyV2Header returns a PROXY v2 header with the given command and
+// address family followed by addrs.
+func proxyV2Header(command, family byte, addrs []byte) string {
+	hdr := append([]byte(nil), proxyV2Signature...)
+	hdr = append(hdr, 0x20|command, family)
+	hdr = binary.BigEndian.AppendUint16(hdr, uint16(len(addrs)))
+	return string(append(hdr, addrs...))
+}
+
+func TestReadProxyHeader(t *testing.T) {
+	v4 := []byte{192, 0, 2, 1, 198, 51, 100, 1, 0xdc, 0x04, 0, 25}
+	v6 := append(append(net.ParseIP("2001:db8::1"), net.ParseIP("2001:db8::2")...), 0xdc, 0x04, 0, 25)
+	for _, tc := range []struct {
+		name, header, want string
+		err                bool
+	}{
+		{name: "v1 TCP4", header: "PROXY TCP4 192.0.2.1 198.51.100.1 56324 25\r\n", want: "192.0.2.1:56324"},
+		{name: "v1 TCP6", header: "PROXY TCP6 2001:db8::1 2001:db8::2 56324 25\r\n", want: "[2001:db8::1]:56324"},
+		{name: "v1 UNKNOWN", header: "PROXY UNKNOWN\r\n"},
+		{name: "v1 short", header: "PROXY TCP4 192.0.2.1\r\n", err: true},
+		{name: "v1 bad address", header: "PROXY TCP4 example.com 198.51.100.1 56324 25\r\n", err: true},
+		{name: "v1 bad port", header: "PROXY TCP4 192.0.2.1 198.51.100.1 65536 25\r\n", err: true},
+		{name: "v1 no CRLF", header: "PROXY TCP4 192.0.2.1 198.51.100.1 56324 25\n", err: true},
+		{name: "v2 IPv4", header: proxyV2Header(0x1, 0x11, v4), want: "192.0.2.1:56324"},
+		{name: "v2 IPv6", header: proxyV2Header(0x1, 0x21, v6), want: "[2001:db8::1]:56324"},
+		{name: "v2 LOCAL", header: proxyV2Header(0x0, 0x00, nil)},
+		{name: "v2 unknown family", header: proxyV2Header(0x1, 0x31, make([]byte, 216))},
+		{name: "v2 short address", header: proxyV2Header(0x1, 0x11, v4[:8]), err: true},
+		{name: "v2 bad command", header: proxyV2Header(0x2, 0x11, v4), err: true},
+		{name: "missing", header: "EHLO client.example.com\r\n", err: true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			br := bufio.NewReader(strings.NewReader(tc.header + "EHLO client.example.com\r\n"))
+			addr, err := readProxyHeader(br)
+			if tc.err {
+				if err == nil {
+					t.Errorf("got address %v, want error", addr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			var got string
+			if addr != nil {
+				got = addr.String()
+			}
+			if got != tc.want {
+				t.Errorf("got address %q, want %q", got, tc.want)
+			}
+			// Only the header is consumed.
+			if rest, _ := br.ReadString('\n'); rest != "EHLO client.example.com\r\n" {
+				t.Errorf("header followed by %q", rest)
+			}
+		})
+	}
+}
+
+func TestProxyProtocolSession(t *testing.T) {
+	addrs := make(chan string, 1)
+	srv := &Server{
+		ProxyProtocol: true,
+		OnNewMail:     acceptMail,
+		OnNewConnection: func(c Connection) error {
+			addrs <- c.Addr().String()
+			return nil
+		},
+	}
+
+	c := dialTestConn(t, srv)
+	c.send("PROXY TCP4 192.0.2.1 198.51.100.1 56324 25\r\n")
+	if r := c.reply(); !strings.HasPrefix(r, "220 ") {
+		t.Fatalf("got greeting %q", r)
+	}
+	if got := <-addrs; got != "192.0.2.1:56324" {
+		t.Errorf("got client address %s, want the address from the PROXY header", got)
+	}
+
+	// Connections without a valid header are closed without a greeting.
+	c = dialTestConn(t, srv)
+	c.send("EHLO client.example.com\r\n")
+	if r, err := c.br.ReadString('\n'); err == nil {
+		t.Errorf("got %q, want the connection closed", r)
+	}
+}
+
+func TestImplicitTLSWithProxyProtocol(t *testing.T) {
+	addrs := make(chan string, 1)
+	srv := &Server{
+		Hostname:      "mx.example.com",
+		ProxyProtocol: true,
+		StartTLS:      testTLSConfig(t),
+		OnNewMail:     acceptMail,
+		OnNewConnection: func(c Connection) error {
+			addrs <- c.Addr().String()
+			return nil
+		},
+	}
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go srv.ServeImplicitTLS(ln)
+	t.Cleanup(func() { srv.Shutdown(context.Background()) })
+
+	raw, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Send the header and the start of the handshake together so the
+	// server buffers part of the handshake while reading the header.
+	if _, err := raw.Write([]byte("PROXY TCP4 192.0.2.1 198.51.100.1 56324 465\r\n")); err != nil {
+		t.Fatal(err)
+	}
+	c := newTestClient(t, tls.Client(raw, &tls.Config{InsecureSkipVerify: true}))
+
+	if r := c.reply(); !strings.HasPrefix(r, "220 ") {
+		t.Fatalf("got greeting %q", r)
+	}
+	if got := <-addrs; got != "192.0.2.1:56324" {
+		t.Errorf("got client address %s, want the address from the PROXY header", got)
+	}
+	if r := c.expect("EHLO client.example.com", "250"); strings.Contains(r, "STARTTLS") {
+		t.Errorf("STARTTLS advertised on implicit TLS connection: %q", r)
+	}
+	c.expect("MAIL FROM:<sender@example.com>", "250")
+}
+
+func TestImplicitTLSListenerRejectsProxyProtocol(t *testing.T) {
+	srv := &Server{ProxyProtocol: true, OnNewMail: acceptMail}
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go srv.ServeImplicitTLS(tls.NewListener(ln, testTLSConfig(t)))
+	t.Cleanup(func() { srv.Shutdown(context.Background()) })
+
+	raw, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := newTestClient(t, raw)
+	c.send("PROXY TCP4 192.0.2.1 198.51.100.1 56324 465\r\n")
+	if _, err := c.br.ReadString('\n'); err == nil {
+		t.Fatal("connection was served, want it closed")
+	}
+}
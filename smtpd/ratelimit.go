@@ -0,0 +1,205 @@
+package smtpd
+
+import (
+	"net"
+	"sync"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+// RateLimiter decides whether a new connection from a client address
+// should be accepted. Implementations must be safe for concurrent use.
+type RateLimiter interface {
+	Allow(ip string) bool
+}
+
+// limiterIdleTimeout is how long a client's bucket is kept after its
+// last connection before being discarded.
+const limiterIdleTimeout = 10 * time.Minute
+
+type ipBucket struct {
+	limiter  *rate.Limiter
+	lastSeen time.Time
+}
+
+// IPRateLimiter is an in-memory token bucket RateLimiter keyed on client
+// IP address.
+type IPRateLimiter struct {
+	mu        sync.Mutex
+	rate      rate.Limit
+	burst     int
+	buckets   map[string]*ipBucket
+	lastSweep time.Time
+}
+
+// NewIPRateLimiter returns a RateLimiter allowing each IP perSecond new
+// connections per second with bursts of up to burst connections. A
+// perSecond of zero or less allows every connection.
+func NewIPRateLimiter(perSecond float64, burst int) *IPRateLimiter {
+	l := &IPRateLimiter{
+		buckets:   map[string]*ipBucket{},
+		lastSweep: time.Now(),
+	}
+	l.rate, l.burst = ipLimit(perSecond, burst)
+	return l
+}
+
+func ipLimit(perSecond float64, burst int) (rate.Limit, int) {
+	if perSecond <= 0 {
+		return rate.Inf, max(burst, 1)
+	}
+	return rate.Limit(perSecond), max(burst, 1)
+}
+
+// SetLimit changes the rate and burst allowed for every client, including
+// clients already seen.
+func (l *IPRateLimiter) SetLimit(perSecond float64, burst int) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.rate, l.burst = ipLimit(perSecond, burst)
+	for _, b := range l.buckets {
+		b.limiter.SetLimit(l.rate)
+		b.limiter.SetBurst(l.burst)
+	}
+}
+
+func (l *IPRateLimiter) Allow(ip string) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.rate == rate.Inf {
+		return true
+	}
+
+	now := time.Now()
+	if now.Sub(l.lastSweep) > limiterIdleTimeout {
+		for k, b := range l.buckets {
+			if now.Sub(b.lastSeen) > limiterIdleTimeout {
+				delete(l.buckets, k)
+			}
+		}
+		l.lastSweep = now
+	}
+
+	b, ok := l.buckets[ip]
+	if !ok {
+		b = &ipBucket{limiter: rate.NewLimiter(l.rate, l.burst)}
+		l.buckets[ip] = b
+	}
+	b.lastSeen = now
+	return b.limiter.AllowN(now, 1)
+}
+
+func (srv *Server) rateLimiter() RateLimiter {
+	srv.limiterOnce.Do(func() {
+		srv.limiter = srv.RateLimiter
+		if srv.limiter == nil && srv.MaxConnectionRate > 0 {
+			srv.limiter = NewIPRateLimiter(srv.MaxConnectionRate, srv.ConnectionBurst)
+		}
+	})
+	return srv.limiter
+}
+
+// allowConnection reports whether the session's client passes the rate
+// limit.
+func (srv *Server) allowConnection(sess *session) bool {
+	rl := srv.rateLimiter()
+	if rl == nil {
+		return true
+	}
+	if _, ok := sess.Addr().(*net.UnixAddr); ok {
+		// Unix socket clients have no IP address to limit
+		return true
+	}
+	ip, _, err := net.SplitHostPort(sess.Addr().String())
+	if err != nil {
+		ip = sess.Addr().String()
+	}
+	return rl.Allow(ip)
+}
+
+// acquireSession reserves one of MaxConcurrentSessions slots, waiting up
+// to SessionQueueTimeout for one to become free. It returns false if no
+// slot could be reserved or the server is shutting down.
+func (srv *Server) acquireSession() bool {
+	if srv.MaxConcurrentSessions <= 0 {
+		return true
+	}
+	srv.sessionSemOnce.Do(func() {
+		srv.sessionSem = make(chan struct{}, srv.MaxConcurrentSessions)
+	})
+
+	select {
+	case srv.sessionSem <- struct{}{}:
+		return true
+	default:
+	}
+	if srv.SessionQueueTimeout <= 0 {
+		return false
+	}
+
+	t := time.NewTimer(srv.SessionQueueTimeout)
+	defer t.Stop()
+	select {
+	case srv.sessionSem <- struct{}{}:
+		return true
+	case <-t.C:
+		return false
+	case <-srv.shutdownChan():
+		return false
+	}
+}
+
+func (srv *Server) releaseSession() {
+	if srv.MaxConcurrentSessions > 0 {
+		<-srv.sessionSem
+	}
+}
+
+// serveLimited serves sess once it has passed the rate limit and a
+// session slot is available, rejecting the connection otherwise. The
+// caller must have tracked sess with trackSession.
+func (srv *Server) serveLimited(sess *session) {
+	defer srv.untrackSession(sess)
+	if srv.ProxyProtocol {
+		if err := sess.handleProxyHeader(); err == ErrServerClosed {
+			sess.rwc.Close()
+			return
+		} else if err != nil {
+			sess.log.Warn("invalid PROXY protocol header", "error", err)
+			sess.rwc.Close()
+			return
+		}
+	}
+	if err := sess.wrapImplicitTLS(); err != nil {
+		sess.log.Error("unable to serve implicit TLS", "error", err)
+		sess.rwc.Close()
+		return
+	}
+	if !srv.allowConnection(sess) {
+		sess.log.Info("rate limiting connection")
+		sess.rwc.SetWriteDeadline(time.Now().Add(time.Second))
+		sess.sendlinef("%s", srv.responses().TooManyConnections)
+		sess.rwc.Close()
+		return
+	}
+	// A connection accepted just before Shutdown is not served.
+	if srv.isShuttingDown() {
+		sess.sendShutdown()
+		sess.rwc.Close()
+		return
+	}
+	if !srv.acquireSession() {
+		if srv.isShuttingDown() {
+			sess.sendShutdown()
+			sess.rwc.Close()
+			return
+		}
+		sess.log.Info("too many concurrent sessions, rejecting connection")
+		sess.sendlinef("%s", srv.responses().TooManySessions)
+		sess.rwc.Close()
+		return
+	}
+	defer srv.releaseSession()
+	sess.serve()
+}
@@ -0,0 +1,27 @@
+package smtpd
+
+import "testing"
+
+func TestIPRateLimiterSetLimit(t *testing.T) {
+	l := NewIPRateLimiter(0, 1)
+	for i := 0; i < 5; i++ {
+		if !l.Allow("192.0.2.1") {
+			t.Fatalf("connection %d refused without a limit", i)
+		}
+	}
+
+	l.SetLimit(0.001, 2)
+	for i, want := range []bool{true, true, false} {
+		if got := l.Allow("192.0.2.1"); got != want {
+			t.Errorf("connection %d: allowed %v, want %v", i, got, want)
+		}
+	}
+	if !l.Allow("192.0.2.2") {
+		t.Error("connection from another client refused")
+	}
+
+	l.SetLimit(0, 1)
+	if !l.Allow("192.0.2.1") {
+		t.Error("connection refused once the limit was removed")
+	}
+}
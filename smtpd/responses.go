@@ -0,0 +1,114 @@
+package smtpd
+
+import "fmt"
+
+// Responses overrides the text of common rejection replies, for
+// example to add a support reference URL. Each field that is empty
+// uses the default reply shown. An override must begin with a three
+// digit reply code of the same class (4xx or 5xx) as the default so
+// that clients still treat the rejection the same way.
+type Responses struct {
+	// AccessDenied rejects a client not in AllowedNets.
+	// Default "554 5.7.1 Access denied".
+	AccessDenied string
+
+	// TooManyConnections rejects a client exceeding MaxConnectionRate.
+	// Default "421 4.7.0 Too many connections".
+	TooManyConnections string
+
+	// TooManySessions rejects a client when MaxConcurrentSessions is
+	// reached. Default "421 4.3.2 Too many concurrent sessions".
+	TooManySessions string
+
+	// AuthRequired rejects a command sent before authenticating.
+	// Default "530 5.7.0  Authentication required".
+	AuthRequired string
+
+	// AuthFailed rejects invalid credentials.
+	// Default "535 5.7.8 Authentication credentials invalid".
+	AuthFailed string
+
+	// SizeExceeded rejects a message larger than MaxMessageSize.
+	// Default "552 5.3.4 Message size exceeds fixed maximum message size".
+	SizeExceeded string
+
+	// TooManyRecipients rejects recipients beyond MaxRecipients.
+	// Default "452 4.5.3 Too many recipients".
+	TooManyRecipients string
+
+	// SenderRejected rejects MAIL FROM when OnNewMail returns an error
+	// that is not an SMTPError.
+	// Default "451 4.3.0 Error: unable to accept message".
+	SenderRejected string
+}
+
+// defaultResponses are the replies used for fields of Responses which
+// are not set.
+var defaultResponses = Responses{
+	AccessDenied:       "554 5.7.1 Access denied",
+	TooManyConnections: "421 4.7.0 Too many connections",
+	TooManySessions:    "421 4.3.2 Too many concurrent sessions",
+	AuthRequired:       "530 5.7.0  Authentication required",
+	AuthFailed:         "535 5.7.8 Authentication credentials invalid",
+	SizeExceeded:       "552 5.3.4 Message size exceeds fixed maximum message size",
+	TooManyRecipients:  "452 4.5.3 Too many recipients",
+	SenderRejected:     "451 4.3.0 Error: unable to accept message",
+}
+
+// responses returns srv.Responses with the default for each field which
+// is not set.
+func (srv *Server) responses() Responses {
+	r := srv.Responses
+	for _, f := range r.fields(&defaultResponses) {
+		if *f.reply == "" {
+			*f.reply = f.def
+		}
+	}
+	return r
+}
+
+type responseField struct {
+	name  string
+	reply *string
+	def   string
+}
+
+// fields returns each field of r alongside its default in def.
+func (r *Responses) fields(def *Responses) []responseField {
+	return []responseField{
+		{"AccessDenied", &r.AccessDenied, def.AccessDenied},
+		{"TooManyConnections", &r.TooManyConnections, def.TooManyConnections},
+		{"TooManySessions", &r.TooManySessions, def.TooManySessions},
+		{"AuthRequired", &r.AuthRequired, def.AuthRequired},
+		{"AuthFailed", &r.AuthFailed, def.AuthFailed},
+		{"SizeExceeded", &r.SizeExceeded, def.SizeExceeded},
+		{"TooManyRecipients", &r.TooManyRecipients, def.TooManyRecipients},
+		{"SenderRejected", &r.SenderRejected, def.SenderRejected},
+	}
+}
+
+// validate checks that each override in r is a reply of the same class
+// as the default it replaces.
+func (r *Responses) validate() error {
+	for _, f := range r.fields(&defaultResponses) {
+		if *f.reply == "" {
+			continue
+		}
+		if !validReplyCode(*f.reply) {
+			return fmt.Errorf("smtpd: Responses.%s must begin with a three digit reply code", f.name)
+		}
+		if (*f.reply)[0] != f.def[0] {
+			return fmt.Errorf("smtpd: Responses.%s must be a %cxx reply", f.name, f.def[0])
+		}
+	}
+	return nil
+}
+
+// validReplyCode reports whether reply begins with a three digit SMTP
+// reply code followed by a space or the end of the reply.
+func validReplyCode(reply string) bool {
+	if len(reply) < 3 || reply[0] < '2' || reply[0] > '5' || reply[1] < '0' || reply[1] > '5' || reply[2] < '0' || reply[2] > '9' {
+		return false
+	}
+	return len(reply) == 3 || reply[3] == ' '
+}
@@ -0,0 +1,52 @@
+package smtpd
+
+import (
+	"context"
+	"errors"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestServeRequiresOnNewMail(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := &Server{}
+	if err := srv.Serve(ln); !errors.Is(err, ErrNoOnNewMail) {
+		t.Errorf("Serve returned %v, want %v", err, ErrNoOnNewMail)
+	}
+	if _, err := net.DialTimeout("tcp", ln.Addr().String(), time.Second); err == nil {
+		t.Error("listener left open")
+	}
+
+	srv = &Server{Addr: "127.0.0.1:0"}
+	if err := srv.ListenAndServe(); !errors.Is(err, ErrNoOnNewMail) {
+		t.Errorf("ListenAndServe returned %v, want %v", err, ErrNoOnNewMail)
+	}
+}
+
+func TestServeWithOnNewMailContext(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := &Server{
+		OnNewMailContext: func(c Connection, from MailAddress) (EnvelopeContext, error) {
+			return nil, errors.New("not accepting mail")
+		},
+	}
+	done := make(chan error, 1)
+	go func() { done <- srv.Serve(ln) }()
+
+	conn, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	newTestClient(t, conn).reply()
+	srv.Shutdown(context.Background())
+	if err := <-done; err != ErrServerClosed {
+		t.Errorf("Serve returned %v, want %v", err, ErrServerClosed)
+	}
+}
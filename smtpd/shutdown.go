@@ -0,0 +1,136 @@
+package smtpd
+
+import (
+	"context"
+	"errors"
+	"net"
+	"time"
+)
+
+// ErrServerClosed is returned by Serve and ListenAndServe after a call
+// to Shutdown.
+var ErrServerClosed = errors.New("smtpd: Server closed")
+
+// shutdownPollInterval is how often Shutdown checks for sessions to
+// finish.
+const shutdownPollInterval = 100 * time.Millisecond
+
+// Shutdown gracefully shuts down the server. It closes all listeners,
+// then sends "421 Service shutting down" to every connected client once
+// the command it is currently processing completes and waits for all
+// sessions to close. If ctx expires first the remaining connections are
+// forcibly closed, canceling any in-flight envelope operations, and the
+// context's error is returned.
+func (srv *Server) Shutdown(ctx context.Context) error {
+	srv.mu.Lock()
+	if !srv.shuttingDown {
+		srv.shuttingDown = true
+		close(srv.shutdownChanLocked())
+	}
+	for ln := range srv.listeners {
+		ln.Close()
+	}
+	// Interrupt sessions blocked waiting for their next command or the
+	// PROXY header, busy sessions will notice the shutdown when their
+	// command completes. The session may be replacing rwc with a TLS
+	// connection so the accepted connection is used, which interrupts
+	// the TLS connection's reads too.
+	for s := range srv.sessions {
+		if s.idle {
+			s.conn.SetReadDeadline(time.Now())
+		}
+	}
+	srv.mu.Unlock()
+
+	t := time.NewTicker(shutdownPollInterval)
+	defer t.Stop()
+	for {
+		srv.mu.Lock()
+		n := len(srv.sessions)
+		srv.mu.Unlock()
+		if n == 0 {
+			return nil
+		}
+
+		select {
+		case <-ctx.Done():
+			srv.mu.Lock()
+			for s := range srv.sessions {
+				s.cancel()
+				s.conn.Close()
+			}
+			srv.mu.Unlock()
+			return ctx.Err()
+		case <-t.C:
+		}
+	}
+}
+
+// trackListener registers ln to be closed on Shutdown. It returns false
+// if the server is already shutting down.
+func (srv *Server) trackListener(ln net.Listener) bool {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	if srv.shuttingDown {
+		return false
+	}
+	if srv.listeners == nil {
+		srv.listeners = map[net.Listener]struct{}{}
+	}
+	srv.listeners[ln] = struct{}{}
+	return true
+}
+
+func (srv *Server) untrackListener(ln net.Listener) {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	delete(srv.listeners, ln)
+}
+
+func (srv *Server) isShuttingDown() bool {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	return srv.shuttingDown
+}
+
+// shutdownChan returns a channel which is closed when Shutdown is
+// called.
+func (srv *Server) shutdownChan() <-chan struct{} {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	return srv.shutdownChanLocked()
+}
+
+func (srv *Server) shutdownChanLocked() chan struct{} {
+	if srv.shutdown == nil {
+		srv.shutdown = make(chan struct{})
+	}
+	return srv.shutdown
+}
+
+// trackSession registers s to be shut down by Shutdown, from when it is
+// accepted until it ends.
+func (srv *Server) trackSession(s *session) {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	if srv.sessions == nil {
+		srv.sessions = map[*session]struct{}{}
+	}
+	srv.sessions[s] = struct{}{}
+}
+
+func (srv *Server) untrackSession(s *session) {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	delete(srv.sessions, s)
+}
+
+// setIdle marks whether the session is waiting for the next command. It
+// returns false if the server is shutting down and the session should
+// not wait for another command.
+func (s *session) setIdle(idle bool) bool {
+	s.srv.mu.Lock()
+	defer s.srv.mu.Unlock()
+	s.idle = idle
+	return !s.srv.shuttingDown
+}
@@ -0,0 +1,109 @@
+package smtpd
+
+import (
+	"context"
+	"crypto/tls"
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestShutdownDuringStartTLS checks that forcibly closing sessions does
+// not race with a session replacing its connection with TLS.
+func TestShutdownDuringStartTLS(t *testing.T) {
+	handshook := make(chan struct{})
+	release := make(chan struct{})
+	srv := &Server{
+		OnNewMail: acceptMail,
+		StartTLS:  testTLSConfig(t),
+		OnTLSHandshake: func(c Connection, startTLS bool, err error) {
+			close(handshook)
+			<-release
+		},
+	}
+	c := dialTestConn(t, srv)
+	c.reply()
+	c.expect("EHLO client.example.com", "250")
+	c.expect("STARTTLS", "220")
+	go tls.Client(c.conn, &tls.Config{InsecureSkipVerify: true}).Handshake()
+	<-handshook
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	close(release)
+	if err := srv.Shutdown(ctx); err != context.Canceled {
+		t.Errorf("Shutdown returned %v, want %v", err, context.Canceled)
+	}
+}
+
+// TestShutdownWaitingSessions checks that Shutdown does not wait for
+// connections that have not started their session.
+func TestShutdownWaitingSessions(t *testing.T) {
+	srv := &Server{
+		OnNewMail:             acceptMail,
+		MaxConcurrentSessions: 1,
+		SessionQueueTimeout:   time.Minute,
+	}
+	active := dialTestConn(t, srv)
+	active.reply()
+	queued := dialTestConn(t, srv)
+
+	proxySrv := &Server{OnNewMail: acceptMail, ProxyProtocol: true}
+	proxied := dialTestConn(t, proxySrv)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	done := make(chan error, 1)
+	go func() { done <- srv.Shutdown(ctx) }()
+
+	if r := queued.reply(); !strings.HasPrefix(r, "421 ") {
+		t.Errorf("queued connection got %q, want 421", r)
+	}
+	if r := active.reply(); !strings.HasPrefix(r, "421 ") {
+		t.Errorf("active session got %q, want 421", r)
+	}
+	if err := <-done; err != nil {
+		t.Errorf("Shutdown returned %v", err)
+	}
+
+	// Shutting down a server waiting for a PROXY header closes the
+	// connection.
+	go func() { done <- proxySrv.Shutdown(ctx) }()
+	if _, err := proxied.br.ReadString('\n'); err == nil {
+		t.Error("connection waiting for PROXY header not closed")
+	}
+	if err := <-done; err != nil {
+		t.Errorf("Shutdown returned %v", err)
+	}
+}
+
+// TestShutdownJustAccepted checks that Shutdown waits for and notifies a
+// connection accepted just before it, whether or not the session had
+// started.
+func TestShutdownJustAccepted(t *testing.T) {
+	srv := &Server{OnNewMail: acceptMail}
+	c := dialTestConn(t, srv)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	done := make(chan error, 1)
+	go func() { done <- srv.Shutdown(ctx) }()
+
+	// The session can not end until the client reads its replies.
+	select {
+	case err := <-done:
+		t.Fatalf("Shutdown returned %v before the session ended", err)
+	case <-time.After(2 * shutdownPollInterval):
+	}
+
+	r := c.reply()
+	if strings.HasPrefix(r, "220 ") {
+		r = c.reply()
+	}
+	if !strings.HasPrefix(r, "421 ") {
+		t.Errorf("new connection got %q, want 421", r)
+	}
+	if err := <-done; err != nil {
+		t.Errorf("Shutdown returned %v", err)
+	}
+}
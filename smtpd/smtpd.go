@@ -8,24 +8,37 @@
 // its behavior.
 package smtpd
 
-// TODO:
-//  -- send 421 to connected clients on graceful server shutdown (s3.8)
-//
-
 import (
 	"bufio"
 	"bytes"
+	"context"
+	"crypto/rand"
 	"crypto/tls"
+	"crypto/x509"
 	"encoding/base64"
+	"encoding/hex"
 	"errors"
 	"fmt"
-	"log"
+	"io"
+	"log/slog"
 	"net"
 	"os"
 	"regexp"
+	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
 	"unicode"
+	"unicode/utf8"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+	"go.opentelemetry.io/otel/trace/noop"
+
+	"golang.org/x/net/idna"
 )
 
 var (
@@ -33,24 +46,351 @@ var (
 	mailFromRE = regexp.MustCompile(`[Ff][Rr][Oo][Mm]:\s*<(.*)>`)
 )
 
+// DefaultMaxMessageSize is the SIZE advertised when
+// Server.MaxMessageSize is not set.
+const DefaultMaxMessageSize = 10240000
+
+// DefaultPausedReply is the reply used when Server.PausedReply is not
+// set. It asks clients to queue their mail and retry later.
+const DefaultPausedReply = "421 4.3.2 Service temporarily unavailable, try again later"
+
+// DefaultBanner is the greeting text used when Server.Banner is not set.
+const DefaultBanner = "ESMTP gosmtpd"
+
+// DefaultLMTPBanner is the greeting text used in LMTP mode when
+// Server.Banner is not set.
+const DefaultLMTPBanner = "LMTP gosmtpd"
+
+// DefaultMaxLineLength is the line length limit used when
+// Server.MaxLineLength is not set.
+const DefaultMaxLineLength = 2000
+
+// passwordAuthMechanisms are the SASL mechanisms supported by AUTH when
+// a password authentication hook is set.
+var passwordAuthMechanisms = []string{"PLAIN", "LOGIN"}
+
+// xoauth2Failure is the base64 encoded error challenge sent when XOAUTH2
+// authentication fails, the client must reply to it before the final
+// 535 response is sent.
+var xoauth2Failure = base64.StdEncoding.EncodeToString([]byte(`{"status":"401","schemes":"bearer"}`))
+
+// ErrDisconnect may be wrapped in an error returned by OnNewMail or
+// OnNewMailContext to disconnect an abusive client after rejecting it.
+var ErrDisconnect = errors.New("smtpd: disconnect client")
+
+// ErrNoOnNewMail is returned by ListenAndServe and Serve if neither
+// OnNewMail nor OnNewMailContext is set, as the server could never
+// accept a message.
+var ErrNoOnNewMail = errors.New("smtpd: Server.OnNewMail is nil")
+
+var (
+	errLineTooLong = errors.New("line too long")
+	errAuthAborted = errors.New("authentication aborted by client")
+)
+
 // Server is an SMTP server.
 type Server struct {
 	Addr         string        // TCP address to listen on, ":25" if empty
 	Hostname     string        // optional Hostname to announce; "" to use system hostname
+	Banner       string        // optional text following the hostname in the greeting; "" for DefaultBanner
 	ReadTimeout  time.Duration // optional read timeout
-	WriteTimeout time.Duration // optional write timeout
+	WriteTimeout time.Duration // optional timeout for each reply and the STARTTLS handshake
+
+	// IdleTimeout, if non-zero, limits the time a client may wait between
+	// commands. Clients that exceed it are sent 421 and disconnected.
+	IdleTimeout time.Duration
+
+	// KeepAlivePeriod, if positive, enables TCP keepalives with this
+	// period on accepted connections so that peers which silently
+	// disappear are detected. If negative keepalives are disabled. If
+	// zero the listener's setting is kept, which for listeners created
+	// with net.Listen enables keepalives with the system default period.
+	// Connections which are not TCP, such as Unix sockets, are left
+	// alone.
+	KeepAlivePeriod time.Duration
+
+	// RequireValidHelo, if true, rejects HELO, EHLO and LHLO commands
+	// whose argument is not a fully qualified domain name or address
+	// literal with 501.
+	RequireValidHelo bool
 
 	StartTLS *tls.Config // advertise STARTTLS and use the given config to upgrade the connection with
 
+	// SocketMode, if non-zero, sets the permissions of the socket when
+	// Addr is a Unix domain socket.
+	SocketMode os.FileMode
+
+	// MaxMessageSize is advertised with the SIZE extension and messages
+	// declared larger than it on MAIL FROM are rejected. Defaults to
+	// DefaultMaxMessageSize if zero.
+	MaxMessageSize int64
+
+	// DisablePipelining, DisableSize, Disable8BitMIME, DisableChunking,
+	// DisableSMTPUTF8 and DisableDSN omit the corresponding extension
+	// from the EHLO response. The extension's commands and parameters
+	// are then refused, although MaxMessageSize is still enforced
+	// without SIZE.
+	DisablePipelining bool
+	DisableSize       bool
+	Disable8BitMIME   bool
+	DisableChunking   bool
+	DisableSMTPUTF8   bool
+	DisableDSN        bool
+
+	// DataTimeout, if non-zero, limits the total time spent reading a
+	// message body after DATA or in BDAT chunks, regardless of
+	// ReadTimeout. Clients that exceed it are sent 421 and disconnected.
+	DataTimeout time.Duration
+
+	// MaxLineLength limits the length of command and message lines,
+	// including the trailing CRLF. Defaults to DefaultMaxLineLength if
+	// zero.
+	MaxLineLength int
+
+	// MaxRecipients, if non-zero, limits the number of recipients
+	// accepted for a single message.
+	MaxRecipients int
+
+	// ProxyProtocol, if true, requires every connection to begin with a
+	// PROXY protocol (v1 or v2) header, as sent by load balancers, and
+	// uses the client address from the header in place of the
+	// connection's remote address. Connections without a valid header
+	// are closed.
+	ProxyProtocol bool
+
+	// AllowedNets, if non-empty, restricts connections to clients with
+	// an address in one of the networks. Other clients are sent 554 and
+	// disconnected before OnNewConnection is called. Clients connecting
+	// over a Unix domain socket are always allowed.
+	AllowedNets []*net.IPNet
+
+	// MaxConnectionRate, if non-zero, limits the number of new
+	// connections per second accepted from a single IP address, allowing
+	// bursts of up to ConnectionBurst. Connections over the limit are
+	// rejected with 421. Unix domain socket connections are not limited.
+	MaxConnectionRate float64
+	ConnectionBurst   int
+
+	// RateLimiter, if non-nil, is used instead of the in-memory limiter
+	// configured by MaxConnectionRate, for example to share limits
+	// between multiple instances.
+	RateLimiter RateLimiter
+
+	// MaxConcurrentSessions, if non-zero, limits the number of sessions
+	// served at once. New connections wait up to SessionQueueTimeout for
+	// a session to finish and are rejected with 421 if none does.
+	MaxConcurrentSessions int
+	SessionQueueTimeout   time.Duration
+
+	// FastTalkerDelay, if non-zero, delays the greeting banner by the
+	// given duration and rejects clients that send data before the banner
+	// is sent. Legitimate clients wait for the banner, spam bots often
+	// do not. Clients using PIPELINING are not affected, RFC 2920 does
+	// not allow pipelining before the banner, but every client waits for
+	// the delay and holds a session slot while doing so.
+	FastTalkerDelay time.Duration
+
+	// OnFastTalker, if non-nil, is called when a client is rejected for
+	// sending data before the greeting banner.
+	OnFastTalker func(c Connection)
+
+	// OnClientAbort, if non-nil, is called when a client disconnects
+	// while sending a message. The partially received message is
+	// discarded without the envelope being closed.
+	OnClientAbort func(c Connection)
+
+	// OnTransactionReset, if non-nil, is called when a client abandons
+	// a mail transaction with RSET after at least one recipient has
+	// been accepted.
+	OnTransactionReset func(c Connection)
+
+	// OnTLSHandshake, if non-nil, is called after each TLS handshake,
+	// either following STARTTLS or at the start of an implicit TLS
+	// connection, with the handshake error or nil if it succeeded.
+	OnTLSHandshake func(c Connection, startTLS bool, err error)
+
+	// OnAccept, if non-nil, is called after each attempt to accept a
+	// connection with the error, if any, and whether it was temporary.
+	// After a temporary error the server waits briefly before accepting
+	// again, a permanent error stops the listener.
+	OnAccept func(err error, temporary bool)
+
 	// OnNewConnection, if non-nil, is called on new connections.
 	// If it returns non-nil, the connection is closed.
 	OnNewConnection func(c Connection) error
 
 	// OnNewMail must be defined and is called when a new message beings.
-	// (when a MAIL FROM line arrives)
+	// (when a MAIL FROM line arrives). Returning an SMTPError rejects the
+	// sender with that response, other errors with Responses.SenderRejected.
+	// Errors wrapping ErrDisconnect also disconnect the client after the
+	// reply is sent.
 	OnNewMail func(c Connection, from MailAddress) (Envelope, error)
 
+	// OnNewMailContext, if non-nil, is used in preference to OnNewMail
+	// and returns an envelope whose methods are passed the context of
+	// the mail transaction. The context is canceled if the session ends,
+	// including when Shutdown forcibly closes it. Errors are handled as
+	// for OnNewMail.
+	OnNewMailContext func(c Connection, from MailAddress) (EnvelopeContext, error)
+
+	// OnAuthentication, if non-nil, enables AUTH and is called with the
+	// authentication identity (the user whose password was supplied).
+	// If it returns non-nil authentication fails. Clients supplying an
+	// authorization identity different from the authentication identity
+	// are rejected unless OnAuthenticationAuthz is defined.
 	OnAuthentication func(c Connection, user string, password string) error
+
+	// OnMailFrom, if non-nil, is a policy hook called to validate the
+	// sender before OnNewMail builds the envelope. Returning an SMTPError
+	// rejects the sender with that response, other errors are handled
+	// according to PolicyFailMode.
+	OnMailFrom func(c Connection, from MailAddress) error
+
+	// OnRcpt, if non-nil, is a policy hook called for each recipient
+	// before it is added to the envelope. Returning an SMTPError rejects
+	// the recipient with that response, other errors are handled
+	// according to PolicyFailMode. Rejecting a recipient does not abort
+	// the transaction.
+	OnRcpt func(c Connection, from MailAddress, rcpt MailAddress) error
+
+	// LMTP, if true, serves LMTP (RFC 2033) rather than SMTP. Clients
+	// greet with LHLO and receive a reply for each recipient once a
+	// message has been received. See LMTPEnvelope.
+	LMTP bool
+
+	// OnData, if non-nil, is called with the complete message once it has
+	// been received and returns the message to pass to the envelope,
+	// allowing headers to be added or removed. The message is buffered in
+	// memory rather than written to the envelope as it is received.
+	// Returning an SMTPError rejects the message with that response, other
+	// errors are handled according to PolicyFailMode, in which case the
+	// unmodified message is used if failing open.
+	OnData func(c Connection, from MailAddress, rcpts []MailAddress, data []byte) ([]byte, error)
+
+	// OnVerify, if non-nil, is called for VRFY commands and returns the
+	// canonical address of the user. Returning an SMTPError replies with
+	// it, other errors with 550. If nil VRFY replies with 252 as permitted
+	// by RFC 5321.
+	OnVerify func(c Connection, addr string) (string, error)
+
+	// OnExpand, if non-nil, is called for EXPN commands and returns the
+	// members of the mailing list. Errors are handled as for OnVerify. If
+	// nil EXPN is not supported.
+	OnExpand func(c Connection, list string) ([]string, error)
+
+	// OnAuthenticationAuthz, if non-nil, is used in preference to
+	// OnAuthentication and is additionally passed the SASL authorization
+	// identity (authzid). The authorization identity is the identity the
+	// client wishes to act as, the authentication identity is the one
+	// whose credentials were presented. authzid is empty if the client
+	// did not request one. The hook must verify that user is permitted
+	// to act as authzid and return non-nil if not.
+	OnAuthenticationAuthz func(c Connection, authzid string, user string, password string) error
+
+	// OnOAuth, if non-nil, enables the AUTH XOAUTH2 mechanism and is
+	// called with the user and bearer token supplied by the client. If
+	// it returns non-nil authentication fails.
+	OnOAuth func(c Connection, user, token string) error
+
+	// OnClientCert, if non-nil, is called when a client presents a TLS
+	// client certificate verified against the StartTLS config's
+	// ClientCAs, which must set ClientAuth to VerifyClientCertIfGiven or
+	// RequireAndVerifyClientCert. If it returns nil the session is
+	// authenticated as the certificate's identity and clients are
+	// required to authenticate, with a certificate or AUTH, before
+	// sending mail. Rejected clients may still use AUTH.
+	OnClientCert func(c Connection, certs []*x509.Certificate) error
+
+	// RequireTLSForAuth, if true, refuses AUTH and omits it from the
+	// EHLO response until the connection has been upgraded with
+	// STARTTLS so credentials are never sent in the clear.
+	RequireTLSForAuth bool
+
+	// Logger, if non-nil, is used for all log output from the server.
+	// Defaults to slog.Default().
+	Logger *slog.Logger
+
+	// Tracer, if non-nil, is used to create a span for each mail
+	// transaction with child spans for reading the message. The span
+	// context is available to hooks and envelopes from
+	// Connection.Context. Defaults to a no-op tracer.
+	Tracer trace.Tracer
+
+	// PolicyFailMode controls how the server behaves when a policy hook
+	// fails for a reason unrelated to the message (backend down,
+	// timeout, etc). Hooks signal an explicit deny by returning an
+	// SMTPError, any other error is treated as a failure of the hook.
+	PolicyFailMode PolicyFailMode
+
+	// PausedReply is sent in reply to MAIL FROM while the server is
+	// paused with SetPaused. The connection is closed after a 421
+	// reply. Defaults to DefaultPausedReply if empty.
+	PausedReply string
+
+	// Responses, if any of its fields are set, overrides the text of
+	// common rejection replies.
+	Responses Responses
+
+	paused      atomic.Bool
+	activeConns atomic.Int64
+	peakConns   atomic.Int64
+
+	limiterOnce sync.Once
+	limiter     RateLimiter
+
+	sessionSemOnce sync.Once
+	sessionSem     chan struct{}
+
+	mu           sync.Mutex
+	shuttingDown bool
+	shutdown     chan struct{} // closed by Shutdown, see shutdownChan
+	listeners    map[net.Listener]struct{}
+	sessions     map[*session]struct{}
+}
+
+// PolicyFailMode determines whether policy hook failures accept or
+// reject the message being checked.
+type PolicyFailMode int
+
+const (
+	PolicyFailClosed PolicyFailMode = iota // reject with 451 on hook error
+	PolicyFailOpen                         // accept on hook error
+)
+
+// ParsePolicyFailMode parses "open" or "closed" into a PolicyFailMode.
+func ParsePolicyFailMode(m string) (PolicyFailMode, error) {
+	switch strings.ToLower(m) {
+	case "open":
+		return PolicyFailOpen, nil
+	case "closed":
+		return PolicyFailClosed, nil
+	}
+	return PolicyFailClosed, fmt.Errorf("invalid policy fail mode %q", m)
+}
+
+func (m PolicyFailMode) String() string {
+	if m == PolicyFailOpen {
+		return "open"
+	}
+	return "closed"
+}
+
+// checkPolicy interprets the result of a policy hook. Explicit denials
+// (SMTPError) are returned unchanged, hook failures are resolved
+// according to the server's PolicyFailMode.
+func (srv *Server) checkPolicy(hook string, err error) error {
+	if err == nil {
+		return nil
+	}
+	if errors.As(err, new(SMTPError)) {
+		return err
+	}
+	if srv.PolicyFailMode == PolicyFailOpen {
+		srv.logger().Warn("policy hook failed, failing open", "hook", hook, "error", err)
+		return nil
+	}
+	srv.logger().Warn("policy hook failed, failing closed", "hook", hook, "error", err)
+	return SMTPError("451 4.3.0 Temporary policy failure. Please try again later")
 }
 
 // MailAddress is defined by
@@ -59,12 +399,43 @@ type MailAddress interface {
 	Hostname() string // canonical hostname, lowercase
 }
 
+// ParameterizedAddress is implemented by the MailAddress values the
+// server passes to OnNewMail and Envelope.AddRecipient. It exposes the
+// ESMTP parameters given with the address, such as the RFC 3461 DSN
+// parameters RET and ENVID on MAIL FROM and NOTIFY and ORCPT on RCPT TO.
+// Parameter names are upper case. The RFC 4954 AUTH parameter on MAIL
+// FROM is decoded and only present if the client has authenticated.
+type ParameterizedAddress interface {
+	MailAddress
+	Param(name string) (value string, ok bool)
+}
+
 // Connection is implemented by the SMTP library and provided to callers
 // customizing their own Servers.
 type Connection interface {
 	IsAuthenticated() bool
+	AuthenticatedUser() string // identity the client authenticated as, or "" if not authenticated
+	SessionID() string         // short random identifier unique to the connection
 	Addr() net.Addr
 	Close() error // to force-close a connection
+
+	HelloHost() string // hostname given by the client in HELO, EHLO or LHLO
+	Protocol() string  // RFC 3848 protocol type, e.g. "ESMTPSA", for Received headers
+
+	// ClientCertIdentity returns the identity (common name or first
+	// subject alternative name) of the verified TLS client certificate,
+	// or "" if the client did not present one.
+	ClientCertIdentity() string
+
+	// TLSState returns the state of the TLS connection and true if the
+	// connection was upgraded with STARTTLS or uses implicit TLS, or
+	// false if it is not encrypted.
+	TLSState() (tls.ConnectionState, bool)
+
+	// Context returns the context of the current mail transaction, which
+	// carries its trace span, or a background context outside of a
+	// transaction.
+	Context() context.Context
 }
 
 type Envelope interface {
@@ -74,6 +445,45 @@ type Envelope interface {
 	Close() error
 }
 
+// EnvelopeContext is an Envelope whose methods are passed the context of
+// the mail transaction.
+type EnvelopeContext interface {
+	AddRecipient(ctx context.Context, rcpt MailAddress) error
+	BeginData(ctx context.Context) error
+	Write(ctx context.Context, line []byte) error
+	Close(ctx context.Context) error
+}
+
+// LMTPEnvelope may be implemented by an EnvelopeContext to report the
+// outcome of delivery to each recipient when the server is in LMTP mode.
+// CloseRecipients is called instead of Close and must return one error,
+// or nil on success, for each recipient in the order they were added.
+// The result of Close is used for every recipient of envelopes that do
+// not implement it.
+type LMTPEnvelope interface {
+	CloseRecipients(ctx context.Context) []error
+}
+
+// WrapEnvelope adapts an Envelope to the EnvelopeContext interface. The
+// context is ignored.
+func WrapEnvelope(e Envelope) EnvelopeContext {
+	return envelopeAdapter{e}
+}
+
+type envelopeAdapter struct {
+	e Envelope
+}
+
+func (a envelopeAdapter) AddRecipient(_ context.Context, rcpt MailAddress) error {
+	return a.e.AddRecipient(rcpt)
+}
+
+func (a envelopeAdapter) BeginData(_ context.Context) error { return a.e.BeginData() }
+
+func (a envelopeAdapter) Write(_ context.Context, line []byte) error { return a.e.Write(line) }
+
+func (a envelopeAdapter) Close(_ context.Context) error { return a.e.Close() }
+
 type BasicEnvelope struct {
 	rcpts []MailAddress
 }
@@ -91,7 +501,7 @@ func (e *BasicEnvelope) BeginData() error {
 }
 
 func (e *BasicEnvelope) Write(line []byte) error {
-	log.Printf("Line: %q", string(line))
+	slog.Debug("envelope write", "line", string(line))
 	return nil
 }
 
@@ -99,125 +509,558 @@ func (e *BasicEnvelope) Close() error {
 	return nil
 }
 
-func (srv *Server) hostname() string {
-	if srv.Hostname != "" {
-		return srv.Hostname
+func (srv *Server) maxMessageSize() int64 {
+	if srv.MaxMessageSize > 0 {
+		return srv.MaxMessageSize
 	}
-	out, err := os.Hostname()
-	if err != nil {
-		return ""
+	return DefaultMaxMessageSize
+}
+
+func (srv *Server) maxLineLength() int {
+	if srv.MaxLineLength > 0 {
+		return srv.MaxLineLength
+	}
+	return DefaultMaxLineLength
+}
+
+func (srv *Server) tracer() trace.Tracer {
+	if srv.Tracer != nil {
+		return srv.Tracer
 	}
-	return strings.TrimSpace(string(out))
+	return noop.NewTracerProvider().Tracer("")
+}
+
+func (srv *Server) logger() *slog.Logger {
+	if srv.Logger != nil {
+		return srv.Logger
+	}
+	return slog.Default()
+}
+
+// allowedAddr reports whether a client at addr may connect according to
+// AllowedNets.
+func (srv *Server) allowedAddr(addr net.Addr) bool {
+	if len(srv.AllowedNets) == 0 {
+		return true
+	}
+	var ip net.IP
+	switch a := addr.(type) {
+	case *net.UnixAddr:
+		// Access to Unix sockets is controlled by file permissions
+		return true
+	case *net.TCPAddr:
+		ip = a.IP
+	default:
+		host, _, err := net.SplitHostPort(addr.String())
+		if err != nil {
+			return false
+		}
+		ip = net.ParseIP(host)
+	}
+	if ip == nil {
+		return false
+	}
+	for _, n := range srv.AllowedNets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+func (srv *Server) banner() string {
+	if srv.Banner != "" {
+		return srv.Banner
+	}
+	if srv.LMTP {
+		return DefaultLMTPBanner
+	}
+	return DefaultBanner
+}
+
+// hostname returns the name the server announces itself with. If no
+// hostname is configured and the system hostname is unavailable the
+// address literal of the local end of the connection is used instead.
+func (s *session) hostname() string {
+	if s.srv.Hostname != "" {
+		return s.srv.Hostname
+	}
+	if h, err := os.Hostname(); err == nil && strings.TrimSpace(h) != "" {
+		return strings.TrimSpace(h)
+	}
+	if ta, ok := s.rwc.LocalAddr().(*net.TCPAddr); ok {
+		if ta.IP.To4() != nil {
+			return "[" + ta.IP.String() + "]"
+		}
+		return "[IPv6:" + ta.IP.String() + "]"
+	}
+	return "localhost"
 }
 
 // ListenAndServe listens on the TCP network address srv.Addr and then
 // calls Serve to handle requests on incoming connections.  If
-// srv.Addr is blank, ":25" is used.
+// srv.Addr is blank, ":25" is used. An address of the form
+// "unix:/path/to/sock" listens on a Unix domain socket instead,
+// replacing any existing socket at the path.
 func (srv *Server) ListenAndServe() error {
 	addr := srv.Addr
 	if addr == "" {
 		addr = ":25"
 	}
-	ln, e := net.Listen("tcp", addr)
+	ln, e := srv.Listen(addr)
 	if e != nil {
 		return e
 	}
 	return srv.Serve(ln)
 }
 
+// Listen listens on the TCP network address addr or, if it is of the
+// form "unix:/path", on a Unix domain socket with permissions
+// SocketMode. The listener is typically passed to Serve, allowing a
+// server to serve several addresses.
+func (srv *Server) Listen(addr string) (net.Listener, error) {
+	if path, ok := strings.CutPrefix(addr, "unix:"); ok {
+		return listenUnix(path, srv.SocketMode)
+	}
+	return net.Listen("tcp", addr)
+}
+
+// listenUnix listens on a Unix domain socket at path, setting its
+// permissions to mode if non-zero.
+func listenUnix(path string, mode os.FileMode) (net.Listener, error) {
+	// A socket left behind by a previous process prevents listening
+	if fi, err := os.Lstat(path); err == nil && fi.Mode()&os.ModeSocket != 0 {
+		if err := os.Remove(path); err != nil {
+			return nil, err
+		}
+	}
+	ln, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+	if mode != 0 {
+		if err := os.Chmod(path, mode); err != nil {
+			ln.Close()
+			return nil, err
+		}
+	}
+	return ln, nil
+}
+
+// Serve accepts connections on ln and serves an SMTP session on each.
 func (srv *Server) Serve(ln net.Listener) error {
+	return srv.serve(ln, false)
+}
+
+// ServeImplicitTLS is like Serve but connections are encrypted from the
+// first byte (SMTPS). STARTTLS is not advertised on these connections
+// and they satisfy RequireTLSForAuth. If ln is a plain listener each
+// connection is encrypted using the StartTLS config, after reading the
+// PROXY header if ProxyProtocol is set. ln may instead be a TLS
+// listener, for example one created with tls.NewListener, but not with
+// ProxyProtocol as the header is sent before the TLS handshake.
+func (srv *Server) ServeImplicitTLS(ln net.Listener) error {
+	return srv.serve(ln, true)
+}
+
+// validate checks that the hooks required to serve mail are set,
+// warning about settings which have no effect.
+func (srv *Server) validate() error {
+	if srv.OnNewMail == nil && srv.OnNewMailContext == nil {
+		return ErrNoOnNewMail
+	}
+	if err := srv.Responses.validate(); err != nil {
+		return err
+	}
+	if srv.RequireTLSForAuth && !srv.authEnabled() {
+		srv.logger().Warn("RequireTLSForAuth is set but no authentication hook is, AUTH is disabled")
+	}
+	return nil
+}
+
+func (srv *Server) serve(ln net.Listener, implicitTLS bool) error {
 	defer ln.Close()
+	if err := srv.validate(); err != nil {
+		return err
+	}
+	if !srv.trackListener(ln) {
+		return ErrServerClosed
+	}
+	defer srv.untrackListener(ln)
+	var tempDelay time.Duration // how long to sleep on accept failure
 	for {
 		rw, e := ln.Accept()
 		if e != nil {
-			if ne, ok := e.(net.Error); ok && ne.Temporary() {
-				log.Printf("smtpd: Accept error: %v", e)
+			if srv.isShuttingDown() {
+				return ErrServerClosed
+			}
+			ne, ok := e.(net.Error)
+			temporary := ok && ne.Temporary()
+			if oa := srv.OnAccept; oa != nil {
+				oa(e, temporary)
+			}
+			if temporary {
+				// Back off so that running out of file descriptors
+				// does not become a busy loop.
+				if tempDelay == 0 {
+					tempDelay = 5 * time.Millisecond
+				} else {
+					tempDelay *= 2
+				}
+				if max := time.Second; tempDelay > max {
+					tempDelay = max
+				}
+				srv.logger().Error("accept error", "error", e, "retry_in", tempDelay)
+				time.Sleep(tempDelay)
 				continue
 			}
 			return e
 		}
+		tempDelay = 0
+		if oa := srv.OnAccept; oa != nil {
+			oa(nil, false)
+		}
+		srv.setKeepAlive(rw)
 		sess, err := srv.newSession(rw)
 		if err != nil {
 			continue
 		}
-		go sess.serve()
+		sess.tls = implicitTLS
+		srv.trackSession(sess)
+		go srv.serveLimited(sess)
+	}
+}
+
+// setKeepAlive applies KeepAlivePeriod to the TCP connection underlying
+// c, if any.
+func (srv *Server) setKeepAlive(c net.Conn) {
+	if srv.KeepAlivePeriod == 0 {
+		return
+	}
+	if tc, ok := c.(*tls.Conn); ok {
+		c = tc.NetConn()
+	}
+	tcp, ok := c.(*net.TCPConn)
+	if !ok {
+		return
+	}
+	if err := tcp.SetKeepAlive(srv.KeepAlivePeriod > 0); err != nil {
+		srv.logger().Warn("unable to set TCP keepalive", "error", err)
+		return
+	}
+	if srv.KeepAlivePeriod > 0 {
+		if err := tcp.SetKeepAlivePeriod(srv.KeepAlivePeriod); err != nil {
+			srv.logger().Warn("unable to set TCP keepalive period", "error", err)
+		}
 	}
-	panic("not reached")
+}
+
+// SetPaused pauses or resumes accepting mail. While paused new mail
+// transactions are refused with PausedReply, transactions that have
+// already begun are allowed to complete.
+func (srv *Server) SetPaused(paused bool) {
+	srv.paused.Store(paused)
+}
+
+// Paused reports whether the server is paused.
+func (srv *Server) Paused() bool {
+	return srv.paused.Load()
+}
+
+func (srv *Server) pausedReply() string {
+	if srv.PausedReply != "" {
+		return srv.PausedReply
+	}
+	return DefaultPausedReply
+}
+
+// ActiveConnections returns the number of currently connected clients.
+func (srv *Server) ActiveConnections() int64 {
+	return srv.activeConns.Load()
+}
+
+// PeakConnections returns the highest number of concurrently connected
+// clients seen since the server started.
+func (srv *Server) PeakConnections() int64 {
+	return srv.peakConns.Load()
+}
+
+func (srv *Server) trackConnection() func() {
+	n := srv.activeConns.Add(1)
+	for {
+		peak := srv.peakConns.Load()
+		if n <= peak || srv.peakConns.CompareAndSwap(peak, n) {
+			break
+		}
+	}
+	return func() { srv.activeConns.Add(-1) }
 }
 
 type session struct {
-	srv *Server
-	rwc net.Conn
-	br  *bufio.Reader
-	bw  *bufio.Writer
+	srv  *Server
+	rwc  net.Conn
+	conn net.Conn // accepted connection, rwc may wrap it in TLS
+	br   *bufio.Reader
+	bw   *bufio.Writer
+
+	id         string
+	log        *slog.Logger
+	remoteAddr net.Addr // client address from the PROXY header, if any
 
-	env Envelope // current envelope, or nil
+	env          EnvelopeContext // current envelope, or nil
+	from         MailAddress     // sender of env
+	rcpts        []MailAddress   // recipients accepted for env
+	buf          bytes.Buffer    // message for env, if buffered for OnData
+	smtpUTF8     bool            // SMTPUTF8 given on MAIL FROM for env
+	bdat         bool            // message for env is being sent with BDAT
+	bdatSize     int64           // bytes received with BDAT for env
+	bdatDeadline time.Time       // when DataTimeout ends for the BDAT message
+	idle         bool            // waiting for the next command, guarded by srv.mu
+	writeErr     error           // first error writing to the client
+	ctx          context.Context // transaction context, nil outside of one
+	baseCtx      context.Context // canceled when the session ends
+	cancel       context.CancelFunc
+	span         trace.Span // span for env, or nil
 
-	helloType     string
-	helloHost     string
-	authenticated string
+	helloType      string
+	helloHost      string
+	authenticated  string
+	clientIdentity string // identity of the verified TLS client certificate
+	tls            bool   // connection encrypted by STARTTLS or implicit TLS
 }
 
 func (srv *Server) newSession(rwc net.Conn) (s *session, err error) {
+	id := make([]byte, 6)
+	if _, err = rand.Read(id); err != nil {
+		return nil, err
+	}
 	s = &session{
-		srv: srv,
-		rwc: rwc,
-		br:  bufio.NewReader(rwc),
-		bw:  bufio.NewWriter(rwc),
+		srv:  srv,
+		rwc:  rwc,
+		conn: rwc,
+		br:   bufio.NewReader(rwc),
+		bw:   bufio.NewWriter(rwc),
+		id:   hex.EncodeToString(id),
 	}
+	s.baseCtx, s.cancel = context.WithCancel(context.Background())
+	s.log = srv.logger().With("remote_addr", rwc.RemoteAddr().String(), "session_id", s.id)
 	return
 }
 
+func (s *session) SessionID() string {
+	return s.id
+}
+
 func (s *session) IsAuthenticated() bool {
 	return s.authenticated != ""
 }
 
-func (s *session) errorf(format string, args ...interface{}) {
-	log.Printf("Client error: "+format, args...)
+func (s *session) AuthenticatedUser() string {
+	return s.authenticated
 }
 
-func (s *session) sendf(format string, args ...interface{}) {
-	if s.srv.WriteTimeout != 0 {
-		s.rwc.SetWriteDeadline(time.Now().Add(s.srv.WriteTimeout))
+func (s *session) ClientCertIdentity() string {
+	return s.clientIdentity
+}
+
+func (s *session) TLSState() (tls.ConnectionState, bool) {
+	tc, ok := s.rwc.(*tls.Conn)
+	if !ok || !s.tls {
+		return tls.ConnectionState{}, false
+	}
+	return tc.ConnectionState(), true
+}
+
+// sendf writes a reply to the client. Once a write has failed every
+// later call returns the same error without writing, the serve loop
+// ends the session when it sees the error. Replies to pipelined
+// commands are buffered until the last command has been handled.
+func (s *session) sendf(format string, args ...interface{}) error {
+	if s.writeErr != nil {
+		return s.writeErr
 	}
+	s.setWriteDeadline()
 	fmt.Fprintf(s.bw, format, args...)
-	s.bw.Flush()
+	if s.pipelined() {
+		return nil
+	}
+	return s.flush()
 }
 
-func (s *session) sendlinef(format string, args ...interface{}) {
-	s.sendf(format+"\r\n", args...)
+// pipelined reports whether the client has already sent another complete
+// command, so reading it will not block. RFC 2920 allows the replies to
+// a group of pipelined commands to be sent together.
+func (s *session) pipelined() bool {
+	n := s.br.Buffered()
+	if n == 0 || s.srv.DisablePipelining {
+		return false
+	}
+	b, _ := s.br.Peek(n)
+	return bytes.IndexByte(b, '\n') != -1
 }
 
-func (s *session) sendSMTPErrorOrLinef(err error, format string, args ...interface{}) {
-	if se, ok := err.(SMTPError); ok {
-		s.sendlinef("%s", se.Error())
-		return
+func (s *session) sendlinef(format string, args ...interface{}) error {
+	return s.sendf(format+"\r\n", args...)
+}
+
+func (s *session) sendSMTPErrorOrLinef(err error, format string, args ...interface{}) error {
+	var se SMTPError
+	if errors.As(err, &se) {
+		return s.sendlinef("%s", se.Error())
+	}
+	return s.sendlinef(format, args...)
+}
+
+// setWriteDeadline limits the time the next write may block to
+// WriteTimeout so that a client that stops reading can not hold the
+// session open forever.
+func (s *session) setWriteDeadline() {
+	if s.srv.WriteTimeout != 0 {
+		s.rwc.SetWriteDeadline(time.Now().Add(s.srv.WriteTimeout))
+	}
+}
+
+// flush writes buffered replies to the client, recording the first
+// write error.
+func (s *session) flush() error {
+	if err := s.bw.Flush(); err != nil && s.writeErr == nil {
+		s.writeErr = err
 	}
-	s.sendlinef(format, args...)
+	return s.writeErr
 }
 
 func (s *session) Addr() net.Addr {
+	if s.remoteAddr != nil {
+		return s.remoteAddr
+	}
 	return s.rwc.RemoteAddr()
 }
 
 func (s *session) Close() error { return s.rwc.Close() }
 
+func (s *session) HelloHost() string { return s.helloHost }
+
+func (s *session) Protocol() string {
+	p := "ESMTP"
+	switch {
+	case s.helloType == "HELO":
+		return "SMTP"
+	case s.srv.LMTP:
+		p = "LMTP"
+	}
+	if s.tls {
+		p += "S"
+	}
+	if s.IsAuthenticated() {
+		p += "A"
+	}
+	return p
+}
+
+func (s *session) Context() context.Context {
+	if s.ctx == nil {
+		return s.baseCtx
+	}
+	return s.ctx
+}
+
 func (s *session) serve() {
+	defer s.srv.trackConnection()()
 	defer s.rwc.Close()
+	defer s.flush()
+	defer s.cancel()
+	defer s.resetTransaction()
+	if tc, ok := s.rwc.(*tls.Conn); ok && s.tls {
+		// Complete the implicit TLS handshake now so the client
+		// certificate is known before the session begins.
+		if s.srv.ReadTimeout != 0 {
+			s.rwc.SetReadDeadline(time.Now().Add(s.srv.ReadTimeout))
+		}
+		s.setWriteDeadline()
+		err := tc.Handshake()
+		if oth := s.srv.OnTLSHandshake; oth != nil {
+			oth(s, false, err)
+		}
+		if err != nil {
+			s.log.Info("TLS handshake failed", "error", err)
+			return
+		}
+		s.rwc.SetReadDeadline(time.Time{})
+		s.logTLSState()
+		s.handleClientCert(tc)
+	}
+	if !s.srv.allowedAddr(s.Addr()) {
+		s.log.Info("rejecting connection from address not in AllowedNets")
+		s.sendlinef("%s", s.srv.responses().AccessDenied)
+		return
+	}
 	if onc := s.srv.OnNewConnection; onc != nil {
 		if err := onc(s); err != nil {
 			s.sendSMTPErrorOrLinef(err, "554 connection rejected")
 			return
 		}
 	}
-	s.sendf("220 %s ESMTP gosmtpd\r\n", s.srv.hostname())
+	if s.srv.FastTalkerDelay != 0 {
+		fast, err := s.isFastTalker()
+		if err != nil {
+			s.log.Warn("read error", "error", err)
+			return
+		}
+		if fast {
+			s.log.Info("rejecting client for sending data before banner")
+			if oft := s.srv.OnFastTalker; oft != nil {
+				oft(s)
+			}
+			s.sendlinef("554 5.7.1 Error: SMTP protocol synchronization error")
+			return
+		}
+		s.rwc.SetReadDeadline(time.Time{})
+	}
+	if err := s.sendf("220 %s %s\r\n", s.hostname(), s.srv.banner()); err != nil {
+		s.logWriteError(err)
+		return
+	}
 	for {
+		if s.writeErr != nil {
+			s.logWriteError(s.writeErr)
+			return
+		}
+		var idleDeadline time.Time
+		if s.srv.IdleTimeout != 0 {
+			idleDeadline = time.Now().Add(s.srv.IdleTimeout)
+		}
+		deadline := idleDeadline
 		if s.srv.ReadTimeout != 0 {
-			s.rwc.SetReadDeadline(time.Now().Add(s.srv.ReadTimeout))
+			if rd := time.Now().Add(s.srv.ReadTimeout); deadline.IsZero() || rd.Before(deadline) {
+				deadline = rd
+			}
+		}
+		if !deadline.IsZero() {
+			s.rwc.SetReadDeadline(deadline)
+		}
+		if !s.setIdle(true) {
+			s.sendShutdown()
+			return
+		}
+		sl, err := s.readLine()
+		running := s.setIdle(false)
+		if err == errLineTooLong {
+			s.log.Info("command line too long")
+			s.resetTransaction()
+			s.sendlinef("500 5.5.2 Line too long")
+			continue
 		}
-		sl, err := s.br.ReadSlice('\n')
 		if err != nil {
-			s.errorf("read error: %v", err)
+			if !running {
+				s.sendShutdown()
+				return
+			}
+			if ne, ok := err.(net.Error); ok && ne.Timeout() && !idleDeadline.IsZero() && !time.Now().Before(idleDeadline) {
+				s.log.Info("idle timeout")
+				s.sendlinef("421 4.4.2 Idle timeout")
+				return
+			}
+			s.logReadError(err)
 			return
 		}
 		line := cmdLine(string(sl))
@@ -228,37 +1071,63 @@ func (s *session) serve() {
 
 		switch line.Verb() {
 		case "HELO", "EHLO":
+			if s.srv.LMTP {
+				s.sendlinef("500 5.5.1 Error: LMTP server requires LHLO")
+				continue
+			}
+			s.handleHello(line.Verb(), line.Arg())
+		case "LHLO":
+			if !s.srv.LMTP {
+				s.sendlinef("502 5.5.2 Error: command not recognized")
+				continue
+			}
 			s.handleHello(line.Verb(), line.Arg())
 		case "STARTTLS":
-			if s.srv.StartTLS == nil {
+			if s.srv.StartTLS == nil || s.tls {
 				s.sendlinef("502 5.5.2 Error: command not recognized")
 				continue
 			}
+			// Anything pipelined after STARTTLS is discarded by
+			// handleStartTLS so must not delay the reply.
 			s.sendlinef("220 Ready to start TLS")
+			s.flush()
 			if err := s.handleStartTLS(); err != nil {
-				s.errorf("failed to start tls: %s", err)
+				s.log.Warn("failed to start tls", "error", err)
 				s.sendSMTPErrorOrLinef(err, "550 ??? failed")
 			}
 		case "QUIT":
 			s.sendlinef("221 2.0.0 Bye")
 			return
 		case "RSET":
-			s.env = nil
+			if otr := s.srv.OnTransactionReset; otr != nil && s.env != nil && len(s.rcpts) > 0 {
+				otr(s)
+			}
+			s.resetTransaction()
 			s.sendlinef("250 2.0.0 OK")
 		case "NOOP":
 			s.sendlinef("250 2.0.0 OK")
-		case "MAIL":
+		case "VRFY":
 			if !s.validateAuth() {
 				return
 			}
-			arg := line.Arg() // "From:<foo@bar.com>"
-			m := mailFromRE.FindStringSubmatch(arg)
+			s.handleVerify(line.Arg())
+		case "EXPN":
+			if !s.validateAuth() {
+				return
+			}
+			s.handleExpand(line.Arg())
+		case "MAIL":
+			if !s.validateAuth() {
+				return
+			}
+			arg := line.Arg() // "From:<foo@bar.com>"
+			m := mailFromRE.FindStringSubmatch(arg)
 			if m == nil {
-				log.Printf("invalid MAIL arg: %q", arg)
+				s.log.Info("invalid MAIL arg", "verb", "MAIL", "arg", arg)
 				s.sendlinef("501 5.1.7 Bad sender address syntax")
 				continue
 			}
-			s.handleMailFrom(m[1])
+			s.handleMailFrom(m[1], parseParams(arg))
 		case "RCPT":
 			if !s.validateAuth() {
 				return
@@ -271,107 +1140,484 @@ func (s *session) serve() {
 				return
 			}
 			s.handleData()
+		case "BDAT":
+			if s.srv.DisableChunking {
+				s.sendlinef("502 5.5.2 Error: command not recognized")
+				continue
+			}
+			if !s.validateAuth() {
+				return
+			}
+			s.handleBDAT(line.Arg())
 		default:
-			log.Printf("Client: %q, verhb: %q", line, line.Verb())
+			s.log.Info("command not recognized", "verb", line.Verb(), "line", line.String())
 			s.sendlinef("502 5.5.2 Error: command not recognized")
 		}
 	}
 }
 
+// isFastTalker waits for FastTalkerDelay and reports whether the client
+// sent anything before the banner was sent.
+func (s *session) isFastTalker() (bool, error) {
+	s.rwc.SetReadDeadline(time.Now().Add(s.srv.FastTalkerDelay))
+	_, err := s.br.Peek(1)
+	if ne, ok := err.(net.Error); ok && ne.Timeout() {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// setDataReadDeadline sets the read deadline for the next line of a
+// message to the sooner of ReadTimeout and the overall DATA deadline.
+func (s *session) setDataReadDeadline(deadline time.Time) {
+	d := deadline
+	if s.srv.ReadTimeout != 0 {
+		if rd := time.Now().Add(s.srv.ReadTimeout); d.IsZero() || rd.Before(d) {
+			d = rd
+		}
+	}
+	if !d.IsZero() {
+		s.rwc.SetReadDeadline(d)
+	}
+}
+
+// isDataTerminator reports whether sl is the line ending a DATA message.
+// A bare LF is accepted in place of CRLF for non-compliant clients. An
+// unterminated final line is never a terminator, readLine only returns
+// it with an error when the client disconnects.
+func isDataTerminator(sl []byte) bool {
+	return bytes.Equal(sl, []byte(".\r\n")) || bytes.Equal(sl, []byte(".\n"))
+}
+
+// readLine reads a CRLF terminated line of at most MaxLineLength bytes.
+// Longer lines are discarded and errLineTooLong is returned. The
+// returned slice is only valid until the next read.
+func (s *session) readLine() ([]byte, error) {
+	max := s.srv.maxLineLength()
+	var line []byte
+	for {
+		sl, err := s.br.ReadSlice('\n')
+		if err == bufio.ErrBufferFull {
+			if len(line)+len(sl) > max {
+				return nil, s.discardLine()
+			}
+			line = append(line, sl...)
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		if line == nil {
+			line = sl
+		} else {
+			line = append(line, sl...)
+		}
+		if len(line) > max {
+			return nil, errLineTooLong
+		}
+		return line, nil
+	}
+}
+
+// discardLine reads and discards the rest of the current line,
+// returning errLineTooLong if successful.
+func (s *session) discardLine() error {
+	for {
+		_, err := s.br.ReadSlice('\n')
+		if err == bufio.ErrBufferFull {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		return errLineTooLong
+	}
+}
+
 func (s *session) handleStartTLS() error {
 	tlsConn := tls.Server(s.rwc, s.srv.StartTLS)
+	s.setWriteDeadline()
 	err := tlsConn.Handshake()
+	if oth := s.srv.OnTLSHandshake; oth != nil {
+		oth(s, true, err)
+	}
 	if err != nil {
 		return err
 	}
 	s.rwc = net.Conn(tlsConn)
 	s.bw.Reset(s.rwc)
 	s.br.Reset(s.rwc)
+	s.tls = true
+	s.logTLSState()
+	s.handleClientCert(tlsConn)
 	return nil
 }
 
+// logTLSState logs the negotiated TLS version and cipher suite.
+func (s *session) logTLSState() {
+	state, _ := s.TLSState()
+	s.log.Info("TLS negotiated", "version", tls.VersionName(state.Version), "cipher", tls.CipherSuiteName(state.CipherSuite))
+}
+
+// handleClientCert records the identity of a verified client certificate
+// and authenticates the session if OnClientCert accepts it.
+func (s *session) handleClientCert(tc *tls.Conn) {
+	state := tc.ConnectionState()
+	if len(state.VerifiedChains) == 0 {
+		return
+	}
+	cert := state.PeerCertificates[0]
+	s.clientIdentity = certIdentity(cert)
+
+	occ := s.srv.OnClientCert
+	if occ == nil {
+		return
+	}
+	if err := occ(s, state.PeerCertificates); err != nil {
+		s.log.Info("client certificate rejected", "identity", s.clientIdentity, "error", err)
+		return
+	}
+	s.authenticated = s.clientIdentity
+	s.log.Info("successfully authenticated with client certificate", "identity", s.clientIdentity)
+}
+
+// certIdentity returns the common name of cert or, if it has none, its
+// first DNS, email or URI subject alternative name.
+func certIdentity(cert *x509.Certificate) string {
+	switch {
+	case cert.Subject.CommonName != "":
+		return cert.Subject.CommonName
+	case len(cert.DNSNames) > 0:
+		return cert.DNSNames[0]
+	case len(cert.EmailAddresses) > 0:
+		return cert.EmailAddresses[0]
+	case len(cert.URIs) > 0:
+		return cert.URIs[0].String()
+	}
+	return ""
+}
+
 func (s *session) handleHello(greeting, host string) {
+	if s.srv.RequireValidHelo && !validHelo(host) {
+		s.log.Info("rejecting invalid hello domain", "verb", greeting, "host", host)
+		s.sendlinef("501 5.5.4 Invalid domain name")
+		return
+	}
 	s.helloType = greeting
 	s.helloHost = host
-	fmt.Fprintf(s.bw, "250-%s\r\n", s.srv.hostname())
-	extensions := []string{}
-	if s.srv.OnAuthentication != nil {
-		extensions = append(extensions, "250-AUTH PLAIN")
-	}
-	if s.srv.StartTLS != nil {
-		extensions = append(extensions, "250-STARTTLS")
-	}
-	extensions = append(extensions, "250-PIPELINING",
-		"250-SIZE 10240000",
-		"250-ENHANCEDSTATUSCODES",
-		"250-8BITMIME",
-		"250 DSN")
-	for _, ext := range extensions {
-		fmt.Fprintf(s.bw, "%s\r\n", ext)
+	lines := []string{s.hostname()}
+	lines = append(lines, s.extensions()...)
+	var reply strings.Builder
+	for i, l := range lines {
+		sep := "-"
+		if i == len(lines)-1 {
+			sep = " "
+		}
+		fmt.Fprintf(&reply, "250%s%s\r\n", sep, l)
 	}
-	s.bw.Flush()
+	s.sendf("%s", reply.String())
 }
 
 func (s *session) handleAuth(line cmdLine) {
-	ah := s.srv.OnAuthentication
-	if ah == nil {
-		log.Printf("smtp: Server.OnAuthentication is nil; rejecting AUTH")
+	if !s.srv.authEnabled() {
+		s.log.Info("no authentication hook set; rejecting AUTH", "verb", "AUTH")
 		s.sendlinef("502 5.5.2 Error: command not recognized")
 		return
 	}
 
-	if ah != nil && s.IsAuthenticated() {
-		log.Printf("smtp: invalid second AUTH on connection")
+	if _, encrypted := s.TLSState(); s.srv.RequireTLSForAuth && !encrypted {
+		s.log.Info("rejecting AUTH on unencrypted connection", "verb", "AUTH")
+		s.sendlinef("538 5.7.11 Encryption required for requested authentication mechanism")
+		return
+	}
+
+	if s.IsAuthenticated() {
+		s.log.Info("invalid second AUTH on connection", "verb", "AUTH")
 		s.sendlinef("503 5.5.1 Error: unable to AUTH more than once")
 		return
 	}
 
-	p := strings.Split(line.Arg(), " ")
-	if len(p) != 2 && p[0] != "PLAIN" {
-		log.Printf("smtp: invalid AUTH argument format")
-		s.sendlinef("502 5.5.2 Error: command not recognized")
+	p := strings.Fields(line.Arg())
+	if len(p) < 1 || len(p) > 2 {
+		s.log.Info("invalid AUTH argument format", "verb", "AUTH")
+		s.sendlinef("501 5.5.4 Syntax: AUTH mechanism [initial-response]")
 		return
 	}
+	mech := strings.ToUpper(p[0])
 
-	c, err := base64.StdEncoding.DecodeString(p[1])
+	ah := s.srv.authHandler()
+	var authzid, user, password string
+	var err error
+	switch {
+	case mech == "LOGIN" && ah != nil:
+		user, password, err = s.authLogin(p[1:])
+	case mech == "PLAIN" && ah != nil:
+		authzid, user, password, err = s.authPlain(p[1:])
+	case mech == "XOAUTH2" && s.srv.OnOAuth != nil:
+		s.handleXOAuth2(p[1:])
+		return
+	default:
+		s.log.Info("unsupported AUTH mechanism", "verb", "AUTH", "mechanism", mech)
+		s.sendlinef("504 5.5.4 Unrecognized authentication type")
+		return
+	}
+	if err == errAuthAborted {
+		s.log.Info("AUTH aborted by client", "verb", "AUTH")
+		s.sendlinef("501 5.7.0 Authentication aborted")
+		return
+	}
 	if err != nil {
-		log.Printf("smtp: error decoding credentials %v", err)
-		s.sendlinef("535 5.7.8 Authentication credentials invalid")
+		s.log.Info("invalid AUTH exchange", "verb", "AUTH", "mechanism", mech, "error", err)
+		s.sendlinef("%s", s.srv.responses().AuthFailed)
 		return
 	}
 
-	cp := bytes.Split(c, []byte{0})
-	if len(cp) != 3 {
-		log.Printf("smtp: invalid decoded username and password")
-		s.sendlinef("535 5.7.8 Authentication credentials invalid")
+	if err := ah(s, authzid, user, password); err != nil {
+		s.log.Info("authentication failed", "verb", "AUTH", "error", err)
+		s.sendlinef("%s", s.srv.responses().AuthFailed)
+		return
+	}
+
+	if authzid == "" {
+		authzid = user
+	}
+	s.authenticated = authzid
+	s.log.Info("successfully authenticated", "verb", "AUTH", "user", user, "authzid", authzid)
+	s.sendlinef("235 2.7.0 Authentication Succeeded")
+}
+
+// handleXOAuth2 performs the AUTH XOAUTH2 exchange. The client response,
+// which may be supplied as an initial response in args, has the form
+// "user=<user>\x01auth=Bearer <token>\x01\x01". On failure the client is
+// sent an error challenge which it must acknowledge before the 535 reply.
+func (s *session) handleXOAuth2(args []string) {
+	var resp string
+	var err error
+	if len(args) > 0 && args[0] != "" {
+		resp, err = decodeAuthResponse(args[0])
+	} else {
+		s.sendlinef("334 ")
+		resp, err = s.readAuthResponse()
+	}
+	if err == errAuthAborted {
+		s.log.Info("AUTH aborted by client", "verb", "AUTH")
+		s.sendlinef("501 5.7.0 Authentication aborted")
+		return
+	}
+
+	var user, token string
+	if err == nil {
+		user, token, err = parseXOAuth2(resp)
+	}
+	if err != nil {
+		s.log.Info("invalid AUTH exchange", "verb", "AUTH", "mechanism", "XOAUTH2", "error", err)
+		s.sendlinef("%s", s.srv.responses().AuthFailed)
 		return
 	}
 
-	user := string(cp[1])
-	if err := ah(s, user, string(cp[2])); err != nil {
-		log.Printf("smtp: authentication failed: %v", err)
-		s.sendlinef("535 5.7.8 Authentication credentials invalid")
+	if err := s.srv.OnOAuth(s, user, token); err != nil {
+		s.log.Info("authentication failed", "verb", "AUTH", "mechanism", "XOAUTH2", "error", err)
+		s.sendlinef("334 %s", xoauth2Failure)
+		if s.srv.ReadTimeout != 0 {
+			s.rwc.SetReadDeadline(time.Now().Add(s.srv.ReadTimeout))
+		}
+		if _, err := s.readLine(); err != nil {
+			return
+		}
+		s.sendlinef("%s", s.srv.responses().AuthFailed)
 		return
 	}
 
 	s.authenticated = user
-	log.Printf("smtp: successfully authenticated %s", user)
+	s.log.Info("successfully authenticated", "verb", "AUTH", "mechanism", "XOAUTH2", "user", user)
 	s.sendlinef("235 2.7.0 Authentication Succeeded")
 }
 
+// parseXOAuth2 extracts the user and bearer token from a decoded XOAUTH2
+// client response.
+func parseXOAuth2(resp string) (user, token string, err error) {
+	for _, kv := range strings.Split(resp, "\x01") {
+		k, v, _ := strings.Cut(kv, "=")
+		switch k {
+		case "user":
+			user = v
+		case "auth":
+			scheme, t, ok := strings.Cut(v, " ")
+			if !ok || !strings.EqualFold(scheme, "Bearer") {
+				return "", "", errors.New("unsupported XOAUTH2 auth scheme")
+			}
+			token = t
+		}
+	}
+	if user == "" || token == "" {
+		return "", "", errors.New("invalid XOAUTH2 response")
+	}
+	return user, token, nil
+}
+
+// authPlain performs the AUTH PLAIN exchange. The credentials may be
+// supplied as an initial response in args, otherwise they are requested
+// with an empty challenge.
+func (s *session) authPlain(args []string) (authzid, user, password string, err error) {
+	var resp string
+	if len(args) > 0 && args[0] != "" {
+		resp, err = decodeAuthResponse(args[0])
+	} else {
+		s.sendlinef("334 ")
+		resp, err = s.readAuthResponse()
+	}
+	if err != nil {
+		return "", "", "", err
+	}
+
+	cp := strings.Split(resp, "\x00")
+	if len(cp) != 3 {
+		return "", "", "", errors.New("invalid decoded username and password")
+	}
+	return cp[0], cp[1], cp[2], nil
+}
+
+// authLogin performs the AUTH LOGIN challenge/response exchange. The
+// username may be supplied as an initial response in args.
+func (s *session) authLogin(args []string) (user, password string, err error) {
+	if len(args) > 0 && args[0] != "" {
+		user, err = decodeAuthResponse(args[0])
+	} else {
+		s.sendlinef("334 VXNlcm5hbWU6") // "Username:"
+		user, err = s.readAuthResponse()
+	}
+	if err != nil {
+		return "", "", err
+	}
+
+	s.sendlinef("334 UGFzc3dvcmQ6") // "Password:"
+	if password, err = s.readAuthResponse(); err != nil {
+		return "", "", err
+	}
+	return user, password, nil
+}
+
+// readAuthResponse reads and decodes a client response to a 334 AUTH
+// challenge.
+func (s *session) readAuthResponse() (string, error) {
+	if s.srv.ReadTimeout != 0 {
+		s.rwc.SetReadDeadline(time.Now().Add(s.srv.ReadTimeout))
+	}
+	sl, err := s.readLine()
+	if err != nil {
+		return "", err
+	}
+	return decodeAuthResponse(strings.TrimRight(string(sl), "\r\n"))
+}
+
+func decodeAuthResponse(r string) (string, error) {
+	switch r {
+	case "*":
+		return "", errAuthAborted
+	case "=": // RFC 4954 empty initial response
+		return "", nil
+	}
+	d, err := base64.StdEncoding.DecodeString(r)
+	if err != nil {
+		return "", err
+	}
+	return string(d), nil
+}
+
+func (srv *Server) authEnabled() bool {
+	return srv.OnAuthentication != nil || srv.OnAuthenticationAuthz != nil || srv.OnOAuth != nil
+}
+
+// authMechanisms returns the SASL mechanisms enabled by the configured
+// authentication hooks.
+func (srv *Server) authMechanisms() []string {
+	var mechs []string
+	if srv.authHandler() != nil {
+		mechs = append(mechs, passwordAuthMechanisms...)
+	}
+	if srv.OnOAuth != nil {
+		mechs = append(mechs, "XOAUTH2")
+	}
+	return mechs
+}
+
+// authHandler returns the configured authentication hook normalized to
+// accept both the authorization and authentication identities.
+func (srv *Server) authHandler() func(c Connection, authzid, user, password string) error {
+	if srv.OnAuthenticationAuthz != nil {
+		return srv.OnAuthenticationAuthz
+	}
+	if ah := srv.OnAuthentication; ah != nil {
+		return func(c Connection, authzid, user, password string) error {
+			if authzid != "" && authzid != user {
+				return fmt.Errorf("user %q may not act as %q", user, authzid)
+			}
+			return ah(c, user, password)
+		}
+	}
+	return nil
+}
+
+func (s *session) handleVerify(arg string) {
+	if arg == "" {
+		s.sendlinef("501 5.5.4 Syntax: VRFY address")
+		return
+	}
+	ov := s.srv.OnVerify
+	if ov == nil {
+		s.sendlinef("252 2.1.5 Cannot VRFY user, but will accept message and attempt delivery")
+		return
+	}
+	addr, err := ov(s, arg)
+	if err != nil {
+		s.log.Info("VRFY failed", "verb", "VRFY", "arg", arg, "error", err)
+		s.sendSMTPErrorOrLinef(err, "550 5.1.1 User unknown")
+		return
+	}
+	s.sendlinef("250 2.1.5 %s", addr)
+}
+
+func (s *session) handleExpand(arg string) {
+	oe := s.srv.OnExpand
+	if oe == nil {
+		s.sendlinef("502 5.5.1 Error: EXPN not supported")
+		return
+	}
+	if arg == "" {
+		s.sendlinef("501 5.5.4 Syntax: EXPN list")
+		return
+	}
+	members, err := oe(s, arg)
+	if err == nil && len(members) == 0 {
+		err = SMTPError("550 5.1.1 Mailing list has no members")
+	}
+	if err != nil {
+		s.log.Info("EXPN failed", "verb", "EXPN", "arg", arg, "error", err)
+		s.sendSMTPErrorOrLinef(err, "550 5.1.1 Mailing list unknown")
+		return
+	}
+	for i, m := range members {
+		sep := "-"
+		if i == len(members)-1 {
+			sep = " "
+		}
+		s.sendlinef("250%s2.1.5 %s", sep, m)
+	}
+}
+
 func (s *session) validateAuth() bool {
-	if s.srv.OnAuthentication == nil {
+	if !s.srv.authEnabled() && s.srv.OnClientCert == nil {
 		return true
 	}
-	if s.srv.OnAuthentication != nil && !s.IsAuthenticated() {
-		log.Printf("smtp: authentication required but session not authenticated; rejecting")
-		s.sendlinef("530 5.7.0  Authentication required")
+	if !s.IsAuthenticated() {
+		s.log.Info("authentication required but session not authenticated; rejecting")
+		s.sendlinef("%s", s.srv.responses().AuthRequired)
 		return false
 	}
 	return true
 }
 
-func (s *session) handleMailFrom(email string) {
+func (s *session) handleMailFrom(email string, params map[string]string) {
 	// TODO: 4.1.1.11.  If the server SMTP does not recognize or
 	// cannot implement one or more of the parameters associated
 	// qwith a particular MAIL FROM or RCPT TO command, it will return
@@ -381,24 +1627,99 @@ func (s *session) handleMailFrom(email string) {
 		s.sendlinef("503 5.5.1 Error: nested MAIL command")
 		return
 	}
-	cb := s.srv.OnNewMail
+	if s.srv.Paused() {
+		s.log.Info("rejecting MAIL FROM while paused", "verb", "MAIL", "from", email)
+		reply := s.srv.pausedReply()
+		s.sendlinef("%s", reply)
+		if strings.HasPrefix(reply, "421") {
+			s.flush()
+			s.rwc.Close()
+		}
+		return
+	}
+	if err := s.srv.checkParams(params); err != nil {
+		s.sendSMTPErrorOrLinef(err, "555 5.5.4 Unsupported parameter")
+		return
+	}
+	if err := validateDSNParams(params); err != nil {
+		s.sendSMTPErrorOrLinef(err, "501 5.5.4 Invalid parameter")
+		return
+	}
+	// RFC 4954: AUTH asserts the identity that originally submitted the
+	// message, or "<>" if it is unknown. It is only trusted from
+	// authenticated clients and otherwise ignored, without being decoded.
+	if auth, ok := params["AUTH"]; ok {
+		if !s.IsAuthenticated() {
+			delete(params, "AUTH")
+		} else if id, err := decodeXtext(auth); err != nil {
+			s.sendlinef("501 5.5.4 Invalid AUTH parameter")
+			return
+		} else {
+			params["AUTH"] = id
+		}
+	}
+	// RFC 6531: addresses may only contain UTF-8 if the client asked
+	// for SMTPUTF8 handling of the transaction
+	_, smtpUTF8 := params["SMTPUTF8"]
+	if !smtpUTF8 && !isASCII(email) {
+		s.sendlinef("553 5.6.7 Non-ASCII address requires SMTPUTF8")
+		return
+	}
+	if sz, ok := params["SIZE"]; ok {
+		size, err := strconv.ParseInt(sz, 10, 64)
+		if err != nil || size < 0 {
+			s.sendlinef("501 5.5.4 Syntax error in SIZE parameter")
+			return
+		}
+		if size > s.srv.maxMessageSize() {
+			s.log.Info("rejecting MAIL FROM: declared size exceeds maximum", "verb", "MAIL", "from", email, "size", size, "max_size", s.srv.maxMessageSize())
+			s.sendlinef("%s", s.srv.responses().SizeExceeded)
+			return
+		}
+	}
+	cb := s.srv.OnNewMailContext
+	if cb == nil && s.srv.OnNewMail != nil {
+		cb = func(c Connection, from MailAddress) (EnvelopeContext, error) {
+			env, err := s.srv.OnNewMail(c, from)
+			if err != nil {
+				return nil, err
+			}
+			return WrapEnvelope(env), nil
+		}
+	}
 	if cb == nil {
-		log.Printf("smtp: Server.OnNewMail is nil; rejecting MAIL FROM")
+		s.log.Error("Server.OnNewMail is nil; rejecting MAIL FROM", "verb", "MAIL")
 		s.sendf("451 Server.OnNewMail not configured\r\n")
 		return
 	}
-	s.env = nil
-	env, err := cb(s, addrString(email))
+	from := paramAddr{addrString(email), params}
+	s.beginTransaction()
+	if om := s.srv.OnMailFrom; om != nil {
+		if err := s.srv.checkPolicy("OnMailFrom", om(s, from)); err != nil {
+			s.log.Info("sender rejected by policy", "verb", "MAIL", "from", email, "error", err)
+			s.span.SetStatus(codes.Error, "sender rejected")
+			s.resetTransaction()
+			s.sendSMTPErrorOrLinef(err, "550 5.7.1 Sender rejected")
+			return
+		}
+	}
+	env, err := cb(s, from)
 	if err != nil {
-		log.Printf("rejecting MAIL FROM %q: %v", email, err)
-		s.sendf("451 denied\r\n")
-
-		s.bw.Flush()
-		time.Sleep(100 * time.Millisecond)
-		s.rwc.Close()
+		s.log.Info("rejecting MAIL FROM", "verb", "MAIL", "from", email, "error", err)
+		s.span.SetStatus(codes.Error, "sender rejected")
+		s.resetTransaction()
+		s.sendSMTPErrorOrLinef(err, "%s", s.srv.responses().SenderRejected)
+		if errors.Is(err, ErrDisconnect) {
+			s.flush()
+			time.Sleep(100 * time.Millisecond)
+			s.rwc.Close()
+		}
 		return
 	}
 	s.env = env
+	s.from = from
+	s.rcpts = nil
+	s.smtpUTF8 = smtpUTF8
 	s.sendlinef("250 2.1.0 Ok")
 }
 
@@ -412,18 +1733,44 @@ func (s *session) handleRcpt(line cmdLine) {
 		s.sendlinef("503 5.5.1 Error: need MAIL command")
 		return
 	}
+	if max := s.srv.MaxRecipients; max > 0 && len(s.rcpts) >= max {
+		s.sendlinef("%s", s.srv.responses().TooManyRecipients)
+		return
+	}
 	arg := line.Arg() // "To:<foo@bar.com>"
 	m := rcptToRE.FindStringSubmatch(arg)
 	if m == nil {
-		log.Printf("bad RCPT address: %q", arg)
+		s.log.Info("bad RCPT address", "verb", "RCPT", "arg", arg)
 		s.sendlinef("501 5.1.7 Bad sender address syntax")
 		return
 	}
-	err := s.env.AddRecipient(addrString(m[1]))
+	if !s.smtpUTF8 && !isASCII(m[1]) {
+		s.sendlinef("553 5.6.7 Non-ASCII address requires SMTPUTF8")
+		return
+	}
+	params := parseParams(arg)
+	if err := s.srv.checkParams(params); err != nil {
+		s.sendSMTPErrorOrLinef(err, "555 5.5.4 Unsupported parameter")
+		return
+	}
+	if err := validateDSNParams(params); err != nil {
+		s.sendSMTPErrorOrLinef(err, "501 5.5.4 Invalid parameter")
+		return
+	}
+	rcpt := paramAddr{addrString(m[1]), params}
+	if or := s.srv.OnRcpt; or != nil {
+		if err := s.srv.checkPolicy("OnRcpt", or(s, s.from, rcpt)); err != nil {
+			s.log.Info("recipient rejected by policy", "verb", "RCPT", "rcpt", rcpt.Email(), "error", err)
+			s.sendSMTPErrorOrLinef(err, "550 5.7.1 Recipient rejected")
+			return
+		}
+	}
+	err := s.env.AddRecipient(s.Context(), rcpt)
 	if err != nil {
 		s.sendSMTPErrorOrLinef(err, "550 bad recipient")
 		return
 	}
+	s.rcpts = append(s.rcpts, rcpt)
 	s.sendlinef("250 2.1.0 Ok")
 }
 
@@ -432,44 +1779,316 @@ func (s *session) handleData() {
 		s.sendlinef("503 5.5.1 Error: need RCPT command")
 		return
 	}
-	if err := s.env.BeginData(); err != nil {
+	if s.bdat {
+		s.sendlinef("503 5.5.1 Error: DATA not allowed after BDAT")
+		return
+	}
+	if s.srv.LMTP && len(s.rcpts) == 0 {
+		// There would be no recipients to send a reply for
+		s.sendlinef("503 5.5.1 Error: need RCPT command")
+		return
+	}
+	if err := s.env.BeginData(s.Context()); err != nil {
 		s.handleError(err)
 		return
 	}
 	s.sendlinef("354 Go ahead")
+	s.flush()
+
+	_, span := s.srv.tracer().Start(s.Context(), "smtp.data")
+	defer span.End()
+
+	var deadline time.Time
+	if s.srv.DataTimeout != 0 {
+		deadline = time.Now().Add(s.srv.DataTimeout)
+	}
+
+	var size int64
+	var writeErr error
+	tooLong, tooBig := false, false
 	for {
-		sl, err := s.br.ReadSlice('\n')
+		s.setDataReadDeadline(deadline)
+		sl, err := s.readLine()
+		if err == errLineTooLong {
+			// Keep reading to the end of the message so the rest of it
+			// isn't interpreted as commands.
+			tooLong = true
+			continue
+		}
+		if ne, ok := err.(net.Error); ok && ne.Timeout() && !deadline.IsZero() && time.Now().After(deadline) {
+			s.log.Info("timeout during DATA", "size", size)
+			span.SetStatus(codes.Error, "timeout")
+			s.resetTransaction()
+			s.sendlinef("421 4.4.2 Timeout during DATA")
+			s.flush()
+			s.rwc.Close()
+			return
+		}
 		if err != nil {
-			s.errorf("read error: %v", err)
+			span.SetStatus(codes.Error, "read error")
+			s.abortData(err)
 			return
 		}
-		if bytes.Equal(sl, []byte(".\r\n")) {
+		if isDataTerminator(sl) {
 			break
 		}
-		if sl[0] == '.' {
+		if len(sl) > 0 && sl[0] == '.' {
 			sl = sl[1:]
 		}
-		err = s.env.Write(sl)
-		if err != nil {
-			s.sendSMTPErrorOrLinef(err, "550 ??? failed")
+		// The limit applies to the message, not the dots added to it
+		// for transport.
+		size += int64(len(sl))
+		if size > s.srv.maxMessageSize() {
+			tooBig = true
+		}
+		if tooLong || tooBig || writeErr != nil {
+			continue
+		}
+		// An envelope rejecting the message, for example because it
+		// is too large for the backend, is only reported once the
+		// client has finished sending it.
+		writeErr = s.writeData(sl)
+	}
+	if tooLong {
+		s.log.Info("message line too long")
+		span.SetStatus(codes.Error, "line too long")
+		s.sendDataReply(nil, "500 5.5.2 Line too long")
+		s.resetTransaction()
+		return
+	}
+	if tooBig {
+		s.log.Info("message size exceeds maximum", "size", size, "max_size", s.srv.maxMessageSize())
+		span.SetStatus(codes.Error, "message too big")
+		s.sendDataReply(nil, "%s", s.srv.responses().SizeExceeded)
+		s.resetTransaction()
+		return
+	}
+	if writeErr != nil {
+		span.SetStatus(codes.Error, "envelope write failed")
+		s.sendDataReply(writeErr, "550 ??? failed")
+		s.resetTransaction()
+		return
+	}
+	span.SetAttributes(attribute.Int64("smtp.message_size", size))
+	span.End()
+	s.closeEnvelope(size)
+}
+
+// writeData passes message data to the envelope a line at a time, or
+// buffers it if it is to be passed to OnData first.
+func (s *session) writeData(data []byte) error {
+	if s.srv.OnData != nil {
+		s.buf.Write(data)
+		return nil
+	}
+	return s.writeLines(data)
+}
+
+// writeLines writes data to the envelope, which expects to be written a
+// line at a time.
+func (s *session) writeLines(data []byte) error {
+	for len(data) > 0 {
+		line := data
+		if idx := bytes.IndexByte(data, '\n'); idx != -1 {
+			line = data[:idx+1]
+		}
+		data = data[len(line):]
+		if err := s.env.Write(s.Context(), line); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// closeEnvelope completes the current transaction, queueing the message
+// with the envelope.
+func (s *session) closeEnvelope(size int64) {
+	if od := s.srv.OnData; od != nil {
+		data, err := od(s, s.from, s.rcpts, s.buf.Bytes())
+		if err = s.srv.checkPolicy("OnData", err); err != nil {
+			s.log.Info("message rejected by policy", "error", err)
+			s.sendDataReply(err, "554 5.7.1 Message rejected")
+			s.resetTransaction()
 			return
 		}
+		if data == nil {
+			data = s.buf.Bytes()
+		}
+		size = int64(len(data))
+		if size > s.srv.maxMessageSize() {
+			s.log.Info("modified message size exceeds maximum", "size", size, "max_size", s.srv.maxMessageSize())
+			s.sendDataReply(nil, "%s", s.srv.responses().SizeExceeded)
+			s.resetTransaction()
+			return
+		}
+		if err := s.writeLines(data); err != nil {
+			s.sendDataReply(err, "550 ??? failed")
+			s.resetTransaction()
+			return
+		}
+	}
+	if s.span != nil {
+		s.span.SetAttributes(
+			attribute.Int("smtp.recipients", len(s.rcpts)),
+			attribute.Int64("smtp.message_size", size),
+		)
 	}
-	if err := s.env.Close(); err != nil {
+	if s.srv.LMTP {
+		s.closeEnvelopeLMTP()
+		return
+	}
+	if err := s.env.Close(s.Context()); err != nil {
+		if s.span != nil {
+			s.span.RecordError(err)
+			s.span.SetStatus(codes.Error, "envelope close failed")
+		}
 		s.handleError(err)
+		s.resetTransaction()
 		return
 	}
 	s.sendlinef("250 2.0.0 Ok: queued")
-	s.env = nil
+	s.resetTransaction()
+}
+
+// closeEnvelopeLMTP completes the current transaction in LMTP mode,
+// replying with the outcome for each recipient.
+func (s *session) closeEnvelopeLMTP() {
+	var errs []error
+	if le, ok := s.env.(LMTPEnvelope); ok {
+		errs = le.CloseRecipients(s.Context())
+		if len(errs) != len(s.rcpts) {
+			s.log.Error("LMTP envelope returned wrong number of recipient statuses", "statuses", len(errs), "rcpt_count", len(s.rcpts))
+			s.sendDataReply(nil, "451 4.3.0 Error: delivery failed")
+			s.resetTransaction()
+			return
+		}
+	} else {
+		err := s.env.Close(s.Context())
+		for range s.rcpts {
+			errs = append(errs, err)
+		}
+	}
+	for i, err := range errs {
+		if err == nil {
+			s.sendlinef("250 2.1.5 <%s> Ok: delivered", s.rcpts[i].Email())
+			continue
+		}
+		s.log.Info("LMTP delivery failed", "rcpt", s.rcpts[i].Email(), "error", err)
+		s.sendSMTPErrorOrLinef(err, "451 4.3.0 <%s> Error: delivery failed", s.rcpts[i].Email())
+	}
+	s.resetTransaction()
+}
+
+// sendDataReply sends the reply to a message once it has been received,
+// which in LMTP mode is repeated for each recipient.
+func (s *session) sendDataReply(err error, format string, args ...interface{}) {
+	n := 1
+	if s.srv.LMTP {
+		n = len(s.rcpts)
+	}
+	for i := 0; i < n; i++ {
+		s.sendSMTPErrorOrLinef(err, format, args...)
+	}
+}
+
+// abortData abandons the current transaction after the connection
+// failed while the message was being received.
+func (s *session) abortData(err error) {
+	s.resetTransaction()
+	s.rwc.Close()
+	s.logReadError(err)
+	if isDisconnect(err) {
+		if oca := s.srv.OnClientAbort; oca != nil {
+			oca(s)
+		}
+	}
+}
+
+// logReadError logs a failed read from the client. Clients disconnecting
+// are routine so are only logged at debug level.
+func (s *session) logReadError(err error) {
+	if isDisconnect(err) {
+		s.log.Debug("client disconnected", "error", err)
+		return
+	}
+	s.log.Warn("read error", "error", err)
+}
+
+// logWriteError logs a failure writing to the client, at debug level if
+// the client had already disconnected.
+func (s *session) logWriteError(err error) {
+	if isDisconnect(err) {
+		s.log.Debug("client disconnected", "error", err)
+		return
+	}
+	s.log.Warn("write error", "error", err)
+}
+
+// sendShutdown tells the client the server is shutting down, logging
+// whether the notice could be delivered.
+func (s *session) sendShutdown() {
+	s.sendlinef("421 4.3.0 Service shutting down")
+	if err := s.flush(); err != nil {
+		s.log.Info("unable to send shutdown notice", "error", err)
+		return
+	}
+	s.log.Debug("sent shutdown notice")
+}
+
+// isDisconnect reports whether err was caused by the client closing or
+// resetting the connection.
+func isDisconnect(err error) bool {
+	return errors.Is(err, io.EOF) ||
+		errors.Is(err, io.ErrUnexpectedEOF) ||
+		errors.Is(err, io.ErrClosedPipe) ||
+		errors.Is(err, net.ErrClosed) ||
+		errors.Is(err, syscall.ECONNRESET) ||
+		errors.Is(err, syscall.EPIPE)
 }
 
 func (s *session) handleError(err error) {
-	if se, ok := err.(SMTPError); ok {
+	var se SMTPError
+	if errors.As(err, &se) {
 		s.sendlinef("%s", se)
 		return
 	}
-	log.Printf("Error: %s", err)
-	s.env = nil
+	s.log.Error("envelope error", "error", err)
+	s.resetTransaction()
+}
+
+// validHelo reports whether host is a fully qualified domain name or an
+// RFC 5321 address literal.
+func validHelo(host string) bool {
+	if strings.HasPrefix(host, "[") && strings.HasSuffix(host, "]") {
+		lit := host[1 : len(host)-1]
+		if len(lit) > 5 && strings.EqualFold(lit[:5], "IPv6:") {
+			ip := net.ParseIP(lit[5:])
+			return ip != nil && strings.Contains(lit[5:], ":")
+		}
+		ip := net.ParseIP(lit)
+		return ip != nil && ip.To4() != nil && !strings.Contains(lit, ":")
+	}
+
+	h, err := idna.Lookup.ToASCII(strings.TrimSuffix(host, "."))
+	if err != nil || len(h) > 253 {
+		return false
+	}
+	labels := strings.Split(h, ".")
+	if len(labels) < 2 {
+		return false
+	}
+	for _, l := range labels {
+		if len(l) == 0 || len(l) > 63 || l[0] == '-' || l[len(l)-1] == '-' {
+			return false
+		}
+		for i := 0; i < len(l); i++ {
+			c := l[i]
+			if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '-') {
+				return false
+			}
+		}
+	}
+	return true
 }
 
 type addrString string
@@ -478,14 +2097,108 @@ func (a addrString) Email() string {
 	return string(a)
 }
 
+// Hostname returns the lower case domain of the address. Internationalized
+// domains are returned in their ASCII (punycode) form.
 func (a addrString) Hostname() string {
 	e := string(a)
-	if idx := strings.Index(e, "@"); idx != -1 {
-		return strings.ToLower(e[idx+1:])
+	if idx := strings.LastIndex(e, "@"); idx != -1 {
+		host := e[idx+1:]
+		if h, err := idna.Lookup.ToASCII(host); err == nil {
+			host = h
+		}
+		return strings.ToLower(host)
 	}
 	return ""
 }
 
+func isASCII(s string) bool {
+	for i := 0; i < len(s); i++ {
+		if s[i] >= utf8.RuneSelf {
+			return false
+		}
+	}
+	return true
+}
+
+// parseParams returns the ESMTP parameters following the address in a
+// MAIL or RCPT argument, keyed by upper case parameter name. Parameters
+// without a value map to an empty string.
+func parseParams(arg string) map[string]string {
+	params := map[string]string{}
+	idx := strings.LastIndex(arg, ">")
+	if idx == -1 {
+		return params
+	}
+	for _, p := range strings.Fields(arg[idx+1:]) {
+		k, v, _ := strings.Cut(p, "=")
+		params[strings.ToUpper(k)] = v
+	}
+	return params
+}
+
+// decodeXtext decodes an RFC 3461 xtext value, in which characters are
+// escaped as "+" followed by two upper case hex digits.
+func decodeXtext(v string) (string, error) {
+	var b strings.Builder
+	for i := 0; i < len(v); i++ {
+		c := v[i]
+		switch {
+		case c == '+':
+			if i+2 >= len(v) {
+				return "", errors.New("truncated xtext escape")
+			}
+			n, err := strconv.ParseUint(v[i+1:i+3], 16, 8)
+			if err != nil || strings.ToUpper(v[i+1:i+3]) != v[i+1:i+3] {
+				return "", fmt.Errorf("invalid xtext escape %q", v[i:i+3])
+			}
+			b.WriteByte(byte(n))
+			i += 2
+		case c < '!' || c > '~' || c == '=':
+			return "", fmt.Errorf("invalid xtext character %q", c)
+		default:
+			b.WriteByte(c)
+		}
+	}
+	return b.String(), nil
+}
+
+type paramAddr struct {
+	addrString
+	params map[string]string
+}
+
+func (a paramAddr) Param(name string) (string, bool) {
+	v, ok := a.params[strings.ToUpper(name)]
+	return v, ok
+}
+
+// validateDSNParams checks the values of the RFC 3461 RET and NOTIFY
+// parameters.
+func validateDSNParams(params map[string]string) error {
+	if ret, ok := params["RET"]; ok {
+		switch strings.ToUpper(ret) {
+		case "FULL", "HDRS":
+		default:
+			return SMTPError("501 5.5.4 Invalid RET parameter")
+		}
+	}
+	if notify, ok := params["NOTIFY"]; ok {
+		values := strings.Split(strings.ToUpper(notify), ",")
+		for _, v := range values {
+			switch v {
+			case "SUCCESS", "FAILURE", "DELAY":
+			case "NEVER":
+				if len(values) != 1 {
+					return SMTPError("501 5.5.4 NOTIFY=NEVER can not be combined with other values")
+				}
+			default:
+				return SMTPError("501 5.5.4 Invalid NOTIFY parameter")
+			}
+		}
+	}
+	return nil
+}
+
 type cmdLine string
 
 func (cl cmdLine) checkValid() error {
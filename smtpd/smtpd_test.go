@@ -0,0 +1,391 @@
+package smtpd
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestHello(t *testing.T) {
+	srv := &Server{Hostname: "mx.example.com", OnNewMail: acceptMail}
+	c := dialTestConn(t, srv)
+	if r := c.reply(); !strings.HasPrefix(r, "220 mx.example.com ") {
+		t.Fatalf("got greeting %q", r)
+	}
+
+	c.expect("HELO client.example.com", "250-mx.example.com")
+	r := c.expect("EHLO client.example.com", "250-mx.example.com")
+	for _, ext := range []string{"PIPELINING", "8BITMIME", "ENHANCEDSTATUSCODES"} {
+		if !strings.Contains(r, ext) {
+			t.Errorf("EHLO reply missing %s: %q", ext, r)
+		}
+	}
+}
+
+func TestMailTransaction(t *testing.T) {
+	env := &testEnvelope{}
+	var from MailAddress
+	srv := &Server{
+		Hostname: "mx.example.com",
+		OnNewMail: func(c Connection, f MailAddress) (Envelope, error) {
+			from = f
+			return env, nil
+		},
+	}
+	c := dialTestConn(t, srv)
+	c.reply()
+
+	c.expect("EHLO client.example.com", "250")
+	c.expect("RCPT TO:<rcpt@example.com>", "503")
+	c.expect("DATA", "503")
+	c.expect("MAIL FROM:<sender@example.com>", "250")
+	c.expect("MAIL FROM:<sender@example.com>", "503")
+	c.expect("RCPT TO:<rcpt1@example.com>", "250")
+	c.expect("RCPT TO:<rcpt2@example.com>", "250")
+	c.expect("DATA", "354")
+	c.send("Subject: test\r\n\r\n..leading dot\r\nbody\r\n.\r\n")
+	c.reply()
+
+	if !env.closed {
+		t.Fatal("envelope not closed")
+	}
+	if from.Email() != "sender@example.com" {
+		t.Errorf("got sender %q", from.Email())
+	}
+	if len(env.rcpts) != 2 || env.rcpts[0].Email() != "rcpt1@example.com" || env.rcpts[1].Email() != "rcpt2@example.com" {
+		t.Errorf("got recipients %v", env.rcpts)
+	}
+	if want := "Subject: test\r\n\r\n.leading dot\r\nbody\r\n"; string(env.data) != want {
+		t.Errorf("got data %q, want %q", env.data, want)
+	}
+
+	// The transaction is complete so a new one may begin.
+	c.expect("MAIL FROM:<sender@example.com>", "250")
+	c.expect("RSET", "250")
+	c.expect("RCPT TO:<rcpt@example.com>", "503")
+	c.expect("QUIT", "221")
+}
+
+func TestAuthPlain(t *testing.T) {
+	var conn Connection
+	srv := &Server{
+		OnNewMail: acceptMail,
+		OnNewConnection: func(c Connection) error {
+			conn = c
+			return nil
+		},
+		OnAuthentication: func(c Connection, user, password string) error {
+			if user != "user" || password != "secret" {
+				return errors.New("bad credentials")
+			}
+			return nil
+		},
+	}
+	plain := func(user, password string) string {
+		return base64.StdEncoding.EncodeToString([]byte("\x00" + user + "\x00" + password))
+	}
+
+	c := dialTestConn(t, srv)
+	c.reply()
+	if r := c.expect("EHLO client.example.com", "250"); !strings.Contains(r, "AUTH ") || !strings.Contains(r, "PLAIN") {
+		t.Errorf("AUTH PLAIN not announced: %q", r)
+	}
+	c.expect("AUTH PLAIN "+plain("user", "wrong"), "535")
+	c.expect("AUTH PLAIN not-base64!", "535")
+
+	// The client may abort the exchange in reply to the challenge,
+	// leaving the session unauthenticated so that AUTH may be retried.
+	c.expect("AUTH PLAIN", "334")
+	c.expect("*", "501")
+	if conn.IsAuthenticated() {
+		t.Fatal("session authenticated after aborting AUTH")
+	}
+
+	// Without an initial response the credentials follow a challenge.
+	c.expect("AUTH PLAIN", "334")
+	c.expect(plain("user", "secret"), "235")
+	c.expect("AUTH PLAIN "+plain("user", "secret"), "503")
+}
+
+func TestAuthPlainAuthzid(t *testing.T) {
+	var conn Connection
+	var gotAuthzid string
+	srv := &Server{
+		OnNewMail: acceptMail,
+		OnNewConnection: func(c Connection) error {
+			conn = c
+			return nil
+		},
+		OnAuthenticationAuthz: func(c Connection, authzid, user, password string) error {
+			gotAuthzid = authzid
+			if user != "relay" || password != "secret" || authzid != "" && authzid != "alice" {
+				return errors.New("not authorized")
+			}
+			return nil
+		},
+	}
+	plain := func(authzid, user, password string) string {
+		return base64.StdEncoding.EncodeToString([]byte(authzid + "\x00" + user + "\x00" + password))
+	}
+
+	c := dialTestConn(t, srv)
+	c.reply()
+	c.expect("EHLO client.example.com", "250")
+	c.expect("AUTH PLAIN "+plain("bob", "relay", "secret"), "535")
+	if gotAuthzid != "bob" {
+		t.Errorf("hook got authzid %q, want %q", gotAuthzid, "bob")
+	}
+	c.expect("AUTH PLAIN "+plain("alice", "relay", "secret"), "235")
+	if gotAuthzid != "alice" {
+		t.Errorf("hook got authzid %q, want %q", gotAuthzid, "alice")
+	}
+	if u := conn.AuthenticatedUser(); u != "alice" {
+		t.Errorf("authenticated as %q, want the authzid", u)
+	}
+}
+
+func TestAuthPlainAuthzidWithoutAuthzHook(t *testing.T) {
+	srv := &Server{
+		OnNewMail:        acceptMail,
+		OnAuthentication: func(c Connection, user, password string) error { return nil },
+	}
+	c := dialTestConn(t, srv)
+	c.reply()
+	c.expect("EHLO client.example.com", "250")
+	// Acting as another identity needs OnAuthenticationAuthz.
+	c.expect("AUTH PLAIN "+base64.StdEncoding.EncodeToString([]byte("alice\x00relay\x00secret")), "535")
+	c.expect("AUTH PLAIN "+base64.StdEncoding.EncodeToString([]byte("relay\x00relay\x00secret")), "235")
+}
+
+func TestAuthArguments(t *testing.T) {
+	srv := &Server{
+		OnNewMail:        acceptMail,
+		OnAuthentication: func(c Connection, user, password string) error { return nil },
+	}
+	c := dialTestConn(t, srv)
+	c.reply()
+	c.expect("EHLO client.example.com", "250")
+	c.expect("AUTH", "501 5.5.4")
+	c.expect("AUTH CRAM-MD5", "504 5.5.4")
+	c.expect("AUTH PLAIN a b c", "501 5.5.4")
+	c.expect("NOOP", "250")
+}
+
+func TestAuthDisabled(t *testing.T) {
+	c := dialTestConn(t, &Server{OnNewMail: acceptMail})
+	c.reply()
+	if r := c.expect("EHLO client.example.com", "250"); strings.Contains(r, "AUTH") {
+		t.Errorf("AUTH announced without a hook: %q", r)
+	}
+	c.expect("AUTH PLAIN AHVzZXIAc2VjcmV0", "502")
+}
+
+func TestOversizeMessage(t *testing.T) {
+	env := &testEnvelope{}
+	srv := &Server{
+		MaxMessageSize: 100,
+		OnNewMail:      func(c Connection, from MailAddress) (Envelope, error) { return env, nil },
+	}
+	c := dialTestConn(t, srv)
+	c.reply()
+	c.expect("EHLO client.example.com", "250")
+
+	// A declared size over the limit is rejected straight away.
+	c.expect("MAIL FROM:<sender@example.com> SIZE=101", "552")
+
+	c.expect("MAIL FROM:<sender@example.com>", "250")
+	c.expect("RCPT TO:<rcpt@example.com>", "250")
+	c.expect("DATA", "354")
+	c.send(strings.Repeat("x", 70) + "\r\n" + strings.Repeat("x", 70) + "\r\n.\r\n")
+	if r := c.reply(); !strings.HasPrefix(r, "552 5.3.4 ") {
+		t.Errorf("got reply %q to oversize message", r)
+	}
+	if env.closed {
+		t.Error("oversize message passed to the envelope")
+	}
+
+	// The session continues after the rejection.
+	c.expect("MAIL FROM:<sender@example.com>", "250")
+}
+
+func TestMessageSizeAfterUnstuffing(t *testing.T) {
+	// The message is 10 bytes once the dot added for transport is
+	// removed.
+	c, env := dataSession(t, &Server{MaxMessageSize: 10})
+	c.send("..abcdefg\r\n.\r\n")
+	if r := c.reply(); !strings.HasPrefix(r, "250 ") {
+		t.Fatalf("got reply %q to message at the limit", r)
+	}
+	if string(env.data) != ".abcdefg\r\n" {
+		t.Errorf("got data %q", env.data)
+	}
+}
+
+func TestDataTimeout(t *testing.T) {
+	c, env := dataSession(t, &Server{DataTimeout: 200 * time.Millisecond})
+
+	// Trickle the message a byte at a time so that no single read
+	// times out but the message as a whole does.
+	stop := make(chan struct{})
+	defer close(stop)
+	go func() {
+		for {
+			select {
+			case <-stop:
+				return
+			case <-time.After(20 * time.Millisecond):
+			}
+			if _, err := c.conn.Write([]byte("x")); err != nil {
+				return
+			}
+		}
+	}()
+
+	if r := c.reply(); r != "421 4.4.2 Timeout during DATA" {
+		t.Errorf("got reply %q to slow message", r)
+	}
+	if _, err := c.br.ReadString('\n'); err != io.EOF {
+		t.Errorf("got %v after timeout, want EOF", err)
+	}
+	if env.closed {
+		t.Error("incomplete message passed to the envelope")
+	}
+}
+
+func TestMailAuthParameter(t *testing.T) {
+	froms := make(chan MailAddress, 1)
+	onNewMail := func(c Connection, from MailAddress) (Envelope, error) {
+		froms <- from
+		return &testEnvelope{}, nil
+	}
+	authParam := func() (string, bool) {
+		from := <-froms
+		if pa, ok := from.(ParameterizedAddress); ok {
+			return pa.Param("AUTH")
+		}
+		return "", false
+	}
+
+	// Unauthenticated clients' AUTH parameters are ignored, even if they
+	// are invalid.
+	c := dialTestConn(t, &Server{OnNewMail: onNewMail})
+	c.reply()
+	c.expect("EHLO client.example.com", "250")
+	c.expect("MAIL FROM:<sender@example.com> AUTH=bad+zz", "250")
+	if v, ok := authParam(); ok {
+		t.Errorf("got AUTH parameter %q from unauthenticated client", v)
+	}
+
+	c = dialTestConn(t, &Server{
+		OnNewMail:        onNewMail,
+		OnAuthentication: func(c Connection, user, password string) error { return nil },
+	})
+	c.reply()
+	c.expect("EHLO client.example.com", "250")
+	c.expect("AUTH PLAIN "+base64.StdEncoding.EncodeToString([]byte("\x00user\x00secret")), "235")
+	c.expect("MAIL FROM:<sender@example.com> AUTH=bad+zz", "501 5.5.4")
+	c.expect("MAIL FROM:<sender@example.com> AUTH=user+40example.com", "250")
+	if v, _ := authParam(); v != "user@example.com" {
+		t.Errorf("got AUTH parameter %q, want the decoded identity", v)
+	}
+}
+
+func TestMailRejected(t *testing.T) {
+	var reject error
+	srv := &Server{
+		OnNewMail: func(c Connection, from MailAddress) (Envelope, error) {
+			return nil, reject
+		},
+		Responses: Responses{SenderRejected: "451 4.3.0 Try again, see https://example.com/help"},
+	}
+	c := dialTestConn(t, srv)
+	c.reply()
+	c.expect("EHLO client.example.com", "250")
+
+	reject = errors.New("backend down")
+	c.expect("MAIL FROM:<sender@example.com>", "451 4.3.0 Try again, see https://example.com/help")
+	reject = fmt.Errorf("checking sender: %w", SMTPError("550 5.7.1 Sender blocked"))
+	c.expect("MAIL FROM:<sender@example.com>", "550 5.7.1 Sender blocked")
+
+	reject = fmt.Errorf("%w: %w", SMTPError("554 5.7.1 Go away"), ErrDisconnect)
+	c.expect("MAIL FROM:<sender@example.com>", "554 5.7.1 Go away")
+	if _, err := c.br.ReadString('\n'); err != io.EOF {
+		t.Fatalf("got %v after disconnecting reply, want EOF", err)
+	}
+}
+
+func TestMailRejectedDisconnectDefault(t *testing.T) {
+	srv := &Server{
+		OnNewMail: func(c Connection, from MailAddress) (Envelope, error) {
+			return nil, fmt.Errorf("abusive client: %w", ErrDisconnect)
+		},
+	}
+	c := dialTestConn(t, srv)
+	c.reply()
+	c.expect("EHLO client.example.com", "250")
+	c.expect("MAIL FROM:<sender@example.com>", "451 4.3.0 Error: unable to accept message")
+	if _, err := c.br.ReadString('\n'); err != io.EOF {
+		t.Fatalf("got %v after disconnecting reply, want EOF", err)
+	}
+}
+
+// dataSession returns a client that has been told to go ahead with the
+// message data, and the envelope it is written to.
+func dataSession(t *testing.T, srv *Server) (*testClient, *testEnvelope) {
+	t.Helper()
+	env := &testEnvelope{}
+	srv.OnNewMail = func(c Connection, from MailAddress) (Envelope, error) { return env, nil }
+	c := dialTestConn(t, srv)
+	c.reply()
+	c.expect("EHLO client.example.com", "250")
+	c.expect("MAIL FROM:<sender@example.com>", "250")
+	c.expect("RCPT TO:<rcpt@example.com>", "250")
+	c.expect("DATA", "354")
+	return c, env
+}
+
+func TestDataTerminators(t *testing.T) {
+	for _, tc := range []struct {
+		name, data, want string
+	}{
+		{"bare LF terminator", "Subject: test\r\n\r\nbody\r\n.\n", "Subject: test\r\n\r\nbody\r\n"},
+		{"stuffed lone dot", "Subject: test\r\n\r\n..\r\nbody\r\n.\r\n", "Subject: test\r\n\r\n.\r\nbody\r\n"},
+		{"stuffed dots", "Subject: test\r\n\r\n...\r\n..x\r\n.\r\n", "Subject: test\r\n\r\n..\r\n.x\r\n"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			c, env := dataSession(t, &Server{})
+			c.send(tc.data)
+			if r := c.reply(); !strings.HasPrefix(r, "250 ") {
+				t.Fatalf("got reply %q", r)
+			}
+			if !env.closed {
+				t.Fatal("envelope not closed")
+			}
+			if string(env.data) != tc.want {
+				t.Errorf("got data %q, want %q", env.data, tc.want)
+			}
+			c.expect("NOOP", "250")
+		})
+	}
+}
+
+func TestDataUnterminatedAtEOF(t *testing.T) {
+	aborted := make(chan struct{})
+	srv := &Server{OnClientAbort: func(c Connection) { close(aborted) }}
+	c, env := dataSession(t, srv)
+	c.send("Subject: test\r\n\r\nbody\r\n.")
+	c.conn.Close()
+
+	select {
+	case <-aborted:
+	case <-time.After(5 * time.Second):
+		t.Fatal("session did not end when the client disconnected")
+	}
+	if env.closed {
+		t.Errorf("incomplete message %q passed to the envelope", env.data)
+	}
+}
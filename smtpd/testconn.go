@@ -0,0 +1,21 @@
+package smtpd
+
+import "net"
+
+// NewTestConn starts a session of srv over an in-memory connection and
+// returns the client side of it, allowing hooks to be exercised in tests
+// without a listener. The connection is synchronous, the caller must
+// read each reply (starting with the greeting banner) before the server
+// will process further commands. Closing the returned connection ends
+// the session.
+func NewTestConn(srv *Server) net.Conn {
+	client, server := net.Pipe()
+	sess, err := srv.newSession(server)
+	if err != nil {
+		server.Close()
+		return client
+	}
+	srv.trackSession(sess)
+	go srv.serveLimited(sess)
+	return client
+}
@@ -0,0 +1,303 @@
+package main
+
+import (
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// snsHostRE matches the hosts SNS signing certificates and subscription
+// confirmation URLs may be served from.
+var snsHostRE = regexp.MustCompile(`^sns\.[a-z0-9-]+\.amazonaws\.com(\.cn)?$`)
+
+// snsMessage is an HTTP(S) notification delivered by SNS.
+type snsMessage struct {
+	Type             string
+	MessageId        string
+	Token            string
+	TopicArn         string
+	Subject          string
+	Message          string
+	Timestamp        string
+	SignatureVersion string
+	Signature        string
+	SigningCertURL   string
+	SubscribeURL     string
+}
+
+// signedString returns the canonical string SNS signs for the message.
+func (m *snsMessage) signedString() string {
+	var b strings.Builder
+	add := func(k, v string) {
+		b.WriteString(k)
+		b.WriteString("\n")
+		b.WriteString(v)
+		b.WriteString("\n")
+	}
+	add("Message", m.Message)
+	add("MessageId", m.MessageId)
+	if m.Type == "Notification" {
+		if m.Subject != "" {
+			add("Subject", m.Subject)
+		}
+	} else {
+		add("SubscribeURL", m.SubscribeURL)
+	}
+	add("Timestamp", m.Timestamp)
+	if m.Type != "Notification" {
+		add("Token", m.Token)
+	}
+	add("TopicArn", m.TopicArn)
+	add("Type", m.Type)
+	return b.String()
+}
+
+// sesNotification is the subset of an SES bounce or complaint
+// notification needed to suppress the affected recipients. Notifications
+// from configuration set event publishing use eventType rather than
+// notificationType.
+type sesNotification struct {
+	NotificationType string `json:"notificationType"`
+	EventType        string `json:"eventType"`
+	Bounce           *struct {
+		BounceType        string `json:"bounceType"`
+		BouncedRecipients []struct {
+			EmailAddress string `json:"emailAddress"`
+		} `json:"bouncedRecipients"`
+	} `json:"bounce"`
+	Complaint *struct {
+		ComplainedRecipients []struct {
+			EmailAddress string `json:"emailAddress"`
+		} `json:"complainedRecipients"`
+	} `json:"complaint"`
+}
+
+// snsHandler receives SES bounce and complaint notifications from SNS and
+// adds the affected recipients to a suppression list. Transient bounces
+// are suppressed for transientTTL, or ignored if it is zero. Only messages from
+// the allowed topics with a valid SNS signature are accepted.
+type snsHandler struct {
+	topics       map[string]bool
+	suppression  suppressionList
+	transientTTL atomic.Int64 // time.Duration, changed on reload
+	client       *http.Client
+
+	mu    sync.Mutex
+	certs map[string]*x509.Certificate
+}
+
+func newSnsHandler(topics string, suppression suppressionList, transientTTL time.Duration) *snsHandler {
+	h := &snsHandler{
+		topics:      map[string]bool{},
+		suppression: suppression,
+		client:      &http.Client{Timeout: 10 * time.Second},
+		certs:       map[string]*x509.Certificate{},
+	}
+	h.setTransientTTL(transientTTL)
+	for _, t := range strings.Split(topics, ",") {
+		if t = strings.TrimSpace(t); t != "" {
+			h.topics[t] = true
+		}
+	}
+	return h
+}
+
+// setTransientTTL changes how long recipients are suppressed after a
+// transient bounce.
+func (h *snsHandler) setTransientTTL(ttl time.Duration) {
+	h.transientTTL.Store(int64(ttl))
+}
+
+func (h *snsHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var m snsMessage
+	if err := json.NewDecoder(io.LimitReader(r.Body, 1<<20)).Decode(&m); err != nil {
+		http.Error(w, "invalid message", http.StatusBadRequest)
+		return
+	}
+	if !h.topics[m.TopicArn] {
+		slog.Warn("rejecting SNS message from unknown topic", "topic", m.TopicArn)
+		http.Error(w, "unknown topic", http.StatusForbidden)
+		return
+	}
+	if err := h.verify(&m); err != nil {
+		slog.Warn("rejecting SNS message with invalid signature", "topic", m.TopicArn, "error", err)
+		http.Error(w, "invalid signature", http.StatusForbidden)
+		return
+	}
+
+	switch m.Type {
+	case "SubscriptionConfirmation":
+		if err := h.confirmSubscription(&m); err != nil {
+			slog.Error("unable to confirm SNS subscription", "topic", m.TopicArn, "error", err)
+			http.Error(w, "subscription confirmation failed", http.StatusInternalServerError)
+			return
+		}
+		slog.Info("confirmed SNS subscription", "topic", m.TopicArn)
+	case "Notification":
+		if err := h.handleNotification(r, &m); err != nil {
+			slog.Error("unable to process SES notification", "topic", m.TopicArn, "message_id", m.MessageId, "error", err)
+			http.Error(w, "notification failed", http.StatusInternalServerError)
+			return
+		}
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+func (h *snsHandler) handleNotification(r *http.Request, m *snsMessage) error {
+	var n sesNotification
+	if err := json.Unmarshal([]byte(m.Message), &n); err != nil {
+		return err
+	}
+
+	var addrs []string
+	var expires time.Time
+	now := time.Now()
+	reason := n.NotificationType
+	if reason == "" {
+		reason = n.EventType
+	}
+	switch reason {
+	case "Bounce":
+		if n.Bounce == nil {
+			return nil
+		}
+		// Transient bounces, such as a full mailbox, may succeed later
+		if n.Bounce.BounceType != "Permanent" {
+			ttl := time.Duration(h.transientTTL.Load())
+			if ttl <= 0 {
+				return nil
+			}
+			reason = "TransientBounce"
+			expires = now.Add(ttl)
+		}
+		for _, r := range n.Bounce.BouncedRecipients {
+			addrs = append(addrs, r.EmailAddress)
+		}
+	case "Complaint":
+		if n.Complaint == nil {
+			return nil
+		}
+		for _, r := range n.Complaint.ComplainedRecipients {
+			addrs = append(addrs, r.EmailAddress)
+		}
+	default:
+		return nil
+	}
+
+	for _, a := range addrs {
+		slog.Info("suppressing recipient", "address", a, "reason", reason)
+		err := h.suppression.suppress(r.Context(), suppressionEntry{
+			Address: a,
+			Reason:  reason,
+			Added:   now,
+			Expires: expires,
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (h *snsHandler) verify(m *snsMessage) error {
+	var alg x509.SignatureAlgorithm
+	switch m.SignatureVersion {
+	case "1":
+		alg = x509.SHA1WithRSA
+	case "2":
+		alg = x509.SHA256WithRSA
+	default:
+		return fmt.Errorf("unsupported signature version %q", m.SignatureVersion)
+	}
+
+	sig, err := base64.StdEncoding.DecodeString(m.Signature)
+	if err != nil {
+		return err
+	}
+	cert, err := h.signingCert(m.SigningCertURL)
+	if err != nil {
+		return err
+	}
+	return cert.CheckSignature(alg, []byte(m.signedString()), sig)
+}
+
+// signingCert fetches and caches the SNS signing certificate at rawURL.
+func (h *snsHandler) signingCert(rawURL string) (*x509.Certificate, error) {
+	if err := checkSnsURL(rawURL); err != nil {
+		return nil, err
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if c, ok := h.certs[rawURL]; ok {
+		return c, nil
+	}
+
+	resp, err := h.client.Get(rawURL)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unable to fetch signing certificate: %s", resp.Status)
+	}
+	data, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, errors.New("signing certificate is not PEM encoded")
+	}
+	cert, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	h.certs[rawURL] = cert
+	return cert, nil
+}
+
+func (h *snsHandler) confirmSubscription(m *snsMessage) error {
+	if err := checkSnsURL(m.SubscribeURL); err != nil {
+		return err
+	}
+	resp, err := h.client.Get(m.SubscribeURL)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("subscription confirmation failed: %s", resp.Status)
+	}
+	return nil
+}
+
+// checkSnsURL ensures a URL from a message points to SNS so that a
+// forged message can not make the proxy fetch arbitrary URLs.
+func checkSnsURL(rawURL string) error {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return err
+	}
+	if u.Scheme != "https" || !snsHostRE.MatchString(u.Hostname()) {
+		return fmt.Errorf("URL %q is not an SNS URL", rawURL)
+	}
+	return nil
+}
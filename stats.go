@@ -0,0 +1,169 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// processStats tracks totals over the lifetime of the process. These
+// parallel the Prometheus counters but are kept internally so that a
+// summary can be logged on shutdown even if metric scraping missed the
+// last moments of the process.
+type processStats struct {
+	sync.Mutex
+	start  time.Time
+	sent   uint64
+	bytes  uint64
+	errors map[string]uint64
+
+	// Totals from previous runs loaded from the stats file. These are
+	// not included in the shutdown summary.
+	saved savedStats
+}
+
+// savedStats is the on-disk format of the stats file. All values are
+// cumulative totals across every run of the process.
+type savedStats struct {
+	Sent   uint64            `json:"sent"`
+	Bytes  uint64            `json:"bytes"`
+	Errors map[string]uint64 `json:"errors"`
+}
+
+var stats = &processStats{
+	start:  time.Now(),
+	errors: map[string]uint64{},
+}
+
+func (p *processStats) messageSent(user string, size int) {
+	emailSent.With(prometheus.Labels{"user": user}).Inc()
+
+	p.Lock()
+	defer p.Unlock()
+	p.sent++
+	p.bytes += uint64(size)
+}
+
+func (p *processStats) messageError(user, errType string) {
+	emailError.With(prometheus.Labels{"type": errType, "user": user}).Inc()
+
+	p.Lock()
+	defer p.Unlock()
+	p.errors[errType]++
+}
+
+func (p *processStats) logSummary(peakConnections int64) {
+	p.Lock()
+	defer p.Unlock()
+
+	errTypes := make([]string, 0, len(p.errors))
+	for t := range p.errors {
+		errTypes = append(errTypes, t)
+	}
+	sort.Strings(errTypes)
+
+	errs := make([]any, len(errTypes))
+	for i, t := range errTypes {
+		errs[i] = slog.Uint64(t, p.errors[t])
+	}
+
+	slog.Info("shutdown summary",
+		"uptime", time.Since(p.start).Round(time.Second),
+		"sent", p.sent,
+		"bytes", p.bytes,
+		"peak_connections", peakConnections,
+		slog.Group("errors", errs...),
+	)
+}
+
+// load seeds the counters from the totals in the stats file at path. It
+// must be called once, before any messages are handled. A missing file
+// is not an error.
+func (p *processStats) load(path string) error {
+	data, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	var saved savedStats
+	if err := json.Unmarshal(data, &saved); err != nil {
+		return fmt.Errorf("unable to parse stats file %s: %w", path, err)
+	}
+
+	emailSent.With(prometheus.Labels{"user": ""}).Add(float64(saved.Sent))
+	for t, n := range saved.Errors {
+		emailError.With(prometheus.Labels{"type": t, "user": ""}).Add(float64(n))
+	}
+
+	p.Lock()
+	defer p.Unlock()
+	p.saved = saved
+	return nil
+}
+
+// save writes the cumulative totals, including those loaded at startup,
+// to path. The file is replaced atomically so a crash while writing
+// will not lose the previous totals.
+func (p *processStats) save(path string) error {
+	p.Lock()
+	total := savedStats{
+		Sent:   p.saved.Sent + p.sent,
+		Bytes:  p.saved.Bytes + p.bytes,
+		Errors: map[string]uint64{},
+	}
+	for t, n := range p.saved.Errors {
+		total.Errors[t] += n
+	}
+	for t, n := range p.errors {
+		total.Errors[t] += n
+	}
+	p.Unlock()
+
+	data, err := json.Marshal(total)
+	if err != nil {
+		return err
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(path), ".stats-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// persist saves the stats to path every interval, which must be
+// positive, until stop is closed.
+func (p *processStats) persist(path string, interval time.Duration, stop <-chan struct{}) {
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-t.C:
+			if err := p.save(path); err != nil {
+				slog.Error("error saving stats file", "error", err)
+			}
+		}
+	}
+}
@@ -0,0 +1,321 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"code.crute.us/mcrute/ses-smtpd-proxy/smtpd"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/redis/go-redis/v9"
+)
+
+var suppressedRecipient = promauto.NewCounter(prometheus.CounterOpts{
+	Namespace: "smtpd",
+	Name:      "suppressed_recipient_total",
+	Help:      "Total number of recipients rejected because they are on the suppression list",
+})
+
+// suppressionEntry records why and when an address was suppressed. A
+// zero Expires means the entry never expires.
+type suppressionEntry struct {
+	Address string    `json:"address"`
+	Reason  string    `json:"reason"`
+	Added   time.Time `json:"added"`
+	Expires time.Time `json:"expires"`
+}
+
+func (e suppressionEntry) expired(now time.Time) bool {
+	return !e.Expires.IsZero() && !now.Before(e.Expires)
+}
+
+// suppressionList stores addresses that mail must not be sent to, for
+// example because they bounced or complained. Addresses are compared
+// case-insensitively.
+type suppressionList interface {
+	suppress(ctx context.Context, e suppressionEntry) error
+	isSuppressed(ctx context.Context, addr string) (bool, error)
+	list(ctx context.Context) ([]suppressionEntry, error)
+	remove(ctx context.Context, addr string) error
+}
+
+// newSuppressionList creates the suppressionList described by spec,
+// which is one of "memory", "file:<path>" or a redis:// or rediss:// URL.
+func newSuppressionList(spec string) (suppressionList, error) {
+	switch {
+	case spec == "" || spec == "memory":
+		return newMemorySuppressionList(), nil
+	case strings.HasPrefix(spec, "file:"):
+		return newFileSuppressionList(strings.TrimPrefix(spec, "file:"))
+	case strings.HasPrefix(spec, "redis://") || strings.HasPrefix(spec, "rediss://"):
+		opts, err := redis.ParseURL(spec)
+		if err != nil {
+			return nil, err
+		}
+		return &redisSuppressionList{client: redis.NewClient(opts)}, nil
+	default:
+		return nil, fmt.Errorf("unknown suppression store %q", spec)
+	}
+}
+
+// memorySuppressionList is a suppressionList held in memory, it is lost
+// when the process exits.
+type memorySuppressionList struct {
+	mu      sync.RWMutex
+	entries map[string]suppressionEntry
+}
+
+func newMemorySuppressionList() *memorySuppressionList {
+	return &memorySuppressionList{entries: map[string]suppressionEntry{}}
+}
+
+func (l *memorySuppressionList) suppress(ctx context.Context, e suppressionEntry) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.entries[strings.ToLower(e.Address)] = e
+	return nil
+}
+
+func (l *memorySuppressionList) isSuppressed(ctx context.Context, addr string) (bool, error) {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	e, ok := l.entries[strings.ToLower(addr)]
+	return ok && !e.expired(time.Now()), nil
+}
+
+func (l *memorySuppressionList) list(ctx context.Context) ([]suppressionEntry, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := time.Now()
+	out := make([]suppressionEntry, 0, len(l.entries))
+	for k, e := range l.entries {
+		if e.expired(now) {
+			delete(l.entries, k)
+			continue
+		}
+		out = append(out, e)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Address < out[j].Address })
+	return out, nil
+}
+
+func (l *memorySuppressionList) remove(ctx context.Context, addr string) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	delete(l.entries, strings.ToLower(addr))
+	return nil
+}
+
+// fileSuppressionList is a memorySuppressionList that is saved to a JSON
+// file after every change and loaded from it at startup.
+type fileSuppressionList struct {
+	mu   sync.Mutex
+	path string
+	mem  *memorySuppressionList
+}
+
+func newFileSuppressionList(path string) (*fileSuppressionList, error) {
+	l := &fileSuppressionList{path: path, mem: newMemorySuppressionList()}
+
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return l, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	var entries []suppressionEntry
+	if err := json.Unmarshal(data, &entries); err != nil {
+		return nil, fmt.Errorf("unable to parse suppression list %s: %w", path, err)
+	}
+	for _, e := range entries {
+		l.mem.suppress(context.Background(), e)
+	}
+	return l, nil
+}
+
+func (l *fileSuppressionList) suppress(ctx context.Context, e suppressionEntry) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.mem.suppress(ctx, e)
+	return l.save(ctx)
+}
+
+func (l *fileSuppressionList) isSuppressed(ctx context.Context, addr string) (bool, error) {
+	return l.mem.isSuppressed(ctx, addr)
+}
+
+func (l *fileSuppressionList) list(ctx context.Context) ([]suppressionEntry, error) {
+	return l.mem.list(ctx)
+}
+
+func (l *fileSuppressionList) remove(ctx context.Context, addr string) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.mem.remove(ctx, addr)
+	return l.save(ctx)
+}
+
+// save atomically replaces the file with the current entries, the caller
+// must hold l.mu.
+func (l *fileSuppressionList) save(ctx context.Context) error {
+	entries, _ := l.mem.list(ctx)
+	data, err := json.MarshalIndent(entries, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	f, err := os.CreateTemp(filepath.Dir(l.path), ".suppression-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), l.path)
+}
+
+// redisSuppressionKeyPrefix namespaces suppression entries in Redis.
+const redisSuppressionKeyPrefix = "ses-smtpd-proxy:suppression:"
+
+// redisSuppressionList is a suppressionList stored in Redis so that it
+// can be shared by several proxies. Each entry is a key holding the JSON
+// encoded suppressionEntry and expiring with it.
+type redisSuppressionList struct {
+	client *redis.Client
+}
+
+func (l *redisSuppressionList) key(addr string) string {
+	return redisSuppressionKeyPrefix + strings.ToLower(addr)
+}
+
+func (l *redisSuppressionList) suppress(ctx context.Context, e suppressionEntry) error {
+	var ttl time.Duration
+	if !e.Expires.IsZero() {
+		if ttl = time.Until(e.Expires); ttl <= 0 {
+			return nil
+		}
+	}
+	data, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	return l.client.Set(ctx, l.key(e.Address), data, ttl).Err()
+}
+
+func (l *redisSuppressionList) isSuppressed(ctx context.Context, addr string) (bool, error) {
+	n, err := l.client.Exists(ctx, l.key(addr)).Result()
+	return n > 0, err
+}
+
+func (l *redisSuppressionList) list(ctx context.Context) ([]suppressionEntry, error) {
+	out := []suppressionEntry{}
+	iter := l.client.Scan(ctx, 0, redisSuppressionKeyPrefix+"*", 100).Iterator()
+	for iter.Next(ctx) {
+		data, err := l.client.Get(ctx, iter.Val()).Bytes()
+		if err == redis.Nil {
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+		var e suppressionEntry
+		if err := json.Unmarshal(data, &e); err != nil {
+			return nil, err
+		}
+		out = append(out, e)
+	}
+	if err := iter.Err(); err != nil {
+		return nil, err
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Address < out[j].Address })
+	return out, nil
+}
+
+func (l *redisSuppressionList) remove(ctx context.Context, addr string) error {
+	return l.client.Del(ctx, l.key(addr)).Err()
+}
+
+// checkSuppressed is an smtpd OnRcpt hook rejecting recipients on the
+// suppression list.
+func checkSuppressed(l suppressionList) func(c smtpd.Connection, from, rcpt smtpd.MailAddress) error {
+	return func(c smtpd.Connection, from, rcpt smtpd.MailAddress) error {
+		suppressed, err := l.isSuppressed(c.Context(), rcpt.Email())
+		if err != nil {
+			return err
+		}
+		if suppressed {
+			suppressedRecipient.Inc()
+			return smtpd.SMTPError("550 5.1.1 Recipient address is suppressed due to previous bounces or complaints")
+		}
+		return nil
+	}
+}
+
+// suppressionAdminHandler lists suppressed addresses with GET and removes
+// the address given in the address query parameter with DELETE, or
+// every address if the all query parameter is "true".
+type suppressionAdminHandler struct {
+	suppression suppressionList
+}
+
+func (h *suppressionAdminHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		entries, err := h.suppression.list(r.Context())
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(entries)
+	case http.MethodDelete:
+		addr := r.URL.Query().Get("address")
+		if addr == "" && r.URL.Query().Get("all") == "true" {
+			if err := clearSuppressionList(r.Context(), h.suppression); err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		if addr == "" {
+			http.Error(w, "address is required", http.StatusBadRequest)
+			return
+		}
+		if err := h.suppression.remove(r.Context(), addr); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// clearSuppressionList removes every address from l.
+func clearSuppressionList(ctx context.Context, l suppressionList) error {
+	entries, err := l.list(ctx)
+	if err != nil {
+		return err
+	}
+	for _, e := range entries {
+		if err := l.remove(ctx, e.Address); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/sesv2/types"
+)
+
+// messageTagsHeader carries SES message tags for event publishing as a
+// comma separated list of name=value pairs. It is removed from the
+// message before it is sent.
+const messageTagsHeader = "X-SES-MESSAGE-TAGS"
+
+// maxTagLength is the SES limit on the length of tag names and values.
+const maxTagLength = 256
+
+// parseMessageTags parses the values of messageTagsHeader. Tag names and
+// values must be non-empty and contain only the characters SES allows.
+func parseMessageTags(values []string) ([]types.MessageTag, error) {
+	var tags []types.MessageTag
+	for _, v := range values {
+		for _, pair := range strings.Split(v, ",") {
+			if pair = strings.TrimSpace(pair); pair == "" {
+				continue
+			}
+			name, value, ok := strings.Cut(pair, "=")
+			if !ok {
+				return nil, fmt.Errorf("tag %q is not a name=value pair", pair)
+			}
+			name, value = strings.TrimSpace(name), strings.TrimSpace(value)
+			if err := validateTagPart(name); err != nil {
+				return nil, fmt.Errorf("invalid tag name %q: %w", name, err)
+			}
+			if err := validateTagPart(value); err != nil {
+				return nil, fmt.Errorf("invalid value for tag %q: %w", name, err)
+			}
+			tags = append(tags, types.MessageTag{Name: aws.String(name), Value: aws.String(value)})
+		}
+	}
+	return tags, nil
+}
+
+func validateTagPart(s string) error {
+	if s == "" {
+		return fmt.Errorf("must not be empty")
+	}
+	if len(s) > maxTagLength {
+		return fmt.Errorf("longer than %d characters", maxTagLength)
+	}
+	for _, c := range s {
+		switch {
+		case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c >= '0' && c <= '9', c == '_', c == '-':
+		default:
+			return fmt.Errorf("contains illegal character %q", c)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+)
+
+func TestParseMessageTags(t *testing.T) {
+	for _, tc := range []struct {
+		name   string
+		values []string
+		want   string // name=value pairs joined with ","
+		err    bool
+	}{
+		{name: "single", values: []string{"campaign=spring"}, want: "campaign=spring"},
+		{name: "spaces", values: []string{" campaign = spring ,  team=growth-2 "}, want: "campaign=spring,team=growth-2"},
+		{name: "repeated header", values: []string{"a=1", "b=2"}, want: "a=1,b=2"},
+		{name: "empty entries", values: []string{",a=1,,"}, want: "a=1"},
+		{name: "empty header", values: []string{""}, want: ""},
+		{name: "empty value", values: []string{"a="}, err: true},
+		{name: "empty name", values: []string{"=1"}, err: true},
+		{name: "no separator", values: []string{"campaign"}, err: true},
+		{name: "illegal name character", values: []string{"camp.aign=1"}, err: true},
+		{name: "illegal value character", values: []string{"campaign=spring sale"}, err: true},
+		{name: "non-ASCII", values: []string{"campaign=été"}, err: true},
+		{name: "value containing separator", values: []string{"a=1=2"}, err: true},
+		{name: "longest name", values: []string{strings.Repeat("a", maxTagLength) + "=1"}, want: strings.Repeat("a", maxTagLength) + "=1"},
+		{name: "name too long", values: []string{strings.Repeat("a", maxTagLength+1) + "=1"}, err: true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			tags, err := parseMessageTags(tc.values)
+			if tc.err {
+				if err == nil {
+					t.Errorf("got tags %v, want error", tags)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			var got []string
+			for _, tag := range tags {
+				got = append(got, aws.ToString(tag.Name)+"="+aws.ToString(tag.Value))
+			}
+			if strings.Join(got, ",") != tc.want {
+				t.Errorf("got tags %q, want %q", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestMessageTagsHeader(t *testing.T) {
+	fs := &fakeSender{}
+	e := &Envelope{
+		from:    "sender@example.com",
+		rcpts:   []string{"rcpt@example.com"},
+		sender:  fs,
+		maxSize: 1 << 20,
+	}
+	e.b.WriteString("X-SES-Message-Tags: campaign=spring\r\nSubject: test\r\n\r\nbody\r\n")
+	if err := e.Close(context.Background()); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+	if len(fs.sent) != 1 {
+		t.Fatalf("sent %d messages, want 1", len(fs.sent))
+	}
+	m := fs.sent[0]
+	if len(m.tags) != 1 || aws.ToString(m.tags[0].Name) != "campaign" || aws.ToString(m.tags[0].Value) != "spring" {
+		t.Errorf("got tags %v, want campaign=spring", m.tags)
+	}
+	if strings.Contains(strings.ToUpper(string(m.data)), messageTagsHeader) {
+		t.Errorf("tags header was sent: %q", m.data)
+	}
+
+	e = &Envelope{from: "sender@example.com", rcpts: []string{"rcpt@example.com"}, sender: fs, maxSize: 1 << 20}
+	e.b.WriteString("X-SES-Message-Tags: campaign=spring sale\r\n\r\nbody\r\n")
+	if err := e.Close(context.Background()); err == nil || !strings.HasPrefix(err.Error(), "554 5.6.0") {
+		t.Errorf("got error %v for invalid tags, want 554 5.6.0", err)
+	}
+}
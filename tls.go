@@ -0,0 +1,131 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"log/slog"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"code.crute.us/mcrute/ses-smtpd-proxy/smtpd"
+)
+
+// certReloader serves a certificate from disk through
+// tls.Config.GetCertificate. The certificate is swapped atomically when
+// reloaded so handshakes in progress are unaffected and connections
+// are never dropped.
+type certReloader struct {
+	certFile string
+	keyFile  string
+	cert     atomic.Pointer[tls.Certificate]
+}
+
+var (
+	certReloadersMu sync.Mutex
+	certReloaders   []*certReloader
+)
+
+func newCertReloader(certFile, keyFile string) (*certReloader, error) {
+	r := &certReloader{certFile: certFile, keyFile: keyFile}
+	if err := r.reload(); err != nil {
+		return nil, err
+	}
+
+	certReloadersMu.Lock()
+	defer certReloadersMu.Unlock()
+	certReloaders = append(certReloaders, r)
+
+	return r, nil
+}
+
+// reload reads the certificate and key from disk. The current
+// certificate is kept if the new one can not be loaded or parsed.
+func (r *certReloader) reload() error {
+	cert, err := tls.LoadX509KeyPair(r.certFile, r.keyFile)
+	if err != nil {
+		return err
+	}
+	if cert.Leaf == nil {
+		if cert.Leaf, err = x509.ParseCertificate(cert.Certificate[0]); err != nil {
+			return err
+		}
+	}
+	r.cert.Store(&cert)
+	return nil
+}
+
+func (r *certReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	return r.cert.Load(), nil
+}
+
+// reloadCertificates re-reads every certificate loaded with
+// newCertReloader from disk, logging any failures.
+func reloadCertificates() {
+	certReloadersMu.Lock()
+	defer certReloadersMu.Unlock()
+	for _, r := range certReloaders {
+		if err := r.reload(); err != nil {
+			slog.Error("error reloading certificate, keeping current certificate", "cert", r.certFile, "error", err)
+		} else {
+			slog.Info("reloaded certificate", "cert", r.certFile, "expires", r.cert.Load().Leaf.NotAfter)
+		}
+	}
+}
+
+// makeServerTLSConfig builds a TLS config for one of the HTTP servers.
+// If clientCAFile is non-empty clients must present a certificate
+// signed by one of the CAs it contains.
+func makeServerTLSConfig(certFile, keyFile, clientCAFile string) (*tls.Config, error) {
+	r, err := newCertReloader(certFile, keyFile)
+	if err != nil {
+		return nil, err
+	}
+
+	c := &tls.Config{
+		MinVersion:     tls.VersionTLS12,
+		GetCertificate: r.GetCertificate,
+	}
+
+	if clientCAFile != "" {
+		if c.ClientCAs, err = loadCertPool(clientCAFile); err != nil {
+			return nil, err
+		}
+		c.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+
+	return c, nil
+}
+
+// loadCertPool reads a bundle of PEM encoded CA certificates.
+func loadCertPool(path string) (*x509.CertPool, error) {
+	pem, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("no certificates found in %s", path)
+	}
+	return pool, nil
+}
+
+// clientCertAuthorizer returns an smtpd OnClientCert hook accepting
+// verified client certificates whose identity is in the comma separated
+// identities, or any verified certificate if identities is empty.
+func clientCertAuthorizer(identities string) func(c smtpd.Connection, certs []*x509.Certificate) error {
+	allowed := map[string]bool{}
+	for _, id := range strings.Split(identities, ",") {
+		if id = strings.TrimSpace(id); id != "" {
+			allowed[id] = true
+		}
+	}
+	return func(c smtpd.Connection, certs []*x509.Certificate) error {
+		if len(allowed) > 0 && !allowed[c.ClientCertIdentity()] {
+			return fmt.Errorf("client certificate identity %q is not allowed", c.ClientCertIdentity())
+		}
+		return nil
+	}
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"net/url"
+	"strings"
+)
+
+// listUnsubscribe injects RFC 8058 one-click List-Unsubscribe headers
+// into messages which do not already carry them. The URL template may
+// contain {recipient} and {message_id} placeholders which are replaced
+// with the URL-escaped recipient address and Message-ID.
+type listUnsubscribe struct {
+	template string
+}
+
+func newListUnsubscribe(template string) (*listUnsubscribe, error) {
+	u, err := url.Parse(strings.NewReplacer("{recipient}", "x", "{message_id}", "x").Replace(template))
+	if err != nil {
+		return nil, fmt.Errorf("invalid List-Unsubscribe URL template: %w", err)
+	}
+	// RFC 8058 s3.1 requires one-click URLs to be HTTPS
+	if u.Scheme != "https" {
+		return nil, fmt.Errorf("List-Unsubscribe URL template must be an https URL")
+	}
+	return &listUnsubscribe{template: template}, nil
+}
+
+// apply returns data with List-Unsubscribe headers added. The message
+// is returned unchanged if it already has the headers or if the URL can
+// not be built for it.
+func (l *listUnsubscribe) apply(data []byte, rcpts []string) []byte {
+	h, err := messageHeader(data)
+	if err != nil {
+		slog.Warn("unable to parse headers, not adding List-Unsubscribe", "error", err)
+		return data
+	}
+	if h.Get("List-Unsubscribe") != "" || h.Get("List-Unsubscribe-Post") != "" {
+		return data
+	}
+
+	u := l.template
+	if strings.Contains(u, "{recipient}") {
+		// The header is shared by all recipients so there is no single
+		// correct address to substitute.
+		if len(rcpts) != 1 {
+			slog.Info("multiple recipients, not adding List-Unsubscribe", "rcpt_count", len(rcpts))
+			return data
+		}
+		u = strings.ReplaceAll(u, "{recipient}", url.QueryEscape(rcpts[0]))
+	}
+	if strings.Contains(u, "{message_id}") {
+		mid := strings.Trim(h.Get("Message-Id"), "<> ")
+		if mid == "" {
+			slog.Info("message has no Message-ID, not adding List-Unsubscribe")
+			return data
+		}
+		u = strings.ReplaceAll(u, "{message_id}", url.QueryEscape(mid))
+	}
+
+	return prependHeaders(data,
+		fmt.Sprintf("List-Unsubscribe: <%s>", u),
+		"List-Unsubscribe-Post: List-Unsubscribe=One-Click",
+	)
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"sync"
+	"time"
+
+	"code.crute.us/mcrute/ses-smtpd-proxy/smtpd"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// userQuotaWindow is the period over which user quotas are counted.
+const userQuotaWindow = 24 * time.Hour
+
+var userQuotaExceeded = promauto.NewCounter(prometheus.CounterOpts{
+	Namespace: "smtpd",
+	Name:      "user_quota_exceeded_total",
+	Help:      "Total number of messages rejected because the sending user exceeded their quota",
+})
+
+// quotaManager limits the number of messages each authenticated user may
+// send in a rolling window. Implementations must be safe for concurrent
+// use.
+type quotaManager interface {
+	// allow reports whether user may send another message.
+	allow(user string) bool
+	// record counts a message sent by user.
+	record(user string)
+	// refund uncounts the message most recently recorded for user, if
+	// sending it failed after it was recorded.
+	refund(user string)
+	// usage returns the number of messages sent by user in the window.
+	usage(user string) int
+}
+
+// memoryQuotaManager is a quotaManager held in memory. Only users with a
+// configured limit are tracked, other users are unlimited. It is also a
+// prometheus.Collector exporting the usage of each user with a limit.
+type memoryQuotaManager struct {
+	mu     sync.Mutex
+	limits map[string]int
+	sent   map[string][]time.Time
+}
+
+var userQuotaUsageDesc = prometheus.NewDesc("smtpd_user_quota_usage",
+	"Messages sent by the user in the last 24 hours", []string{"user"}, nil)
+
+// newMemoryQuotaManager creates a quotaManager enforcing limits, keyed by
+// user.
+func newMemoryQuotaManager(limits map[string]int) *memoryQuotaManager {
+	q := &memoryQuotaManager{sent: map[string][]time.Time{}}
+	q.setLimits(limits)
+	return q
+}
+
+// setLimits replaces the limits, keeping the recorded usage of users
+// that still have a limit.
+func (q *memoryQuotaManager) setLimits(limits map[string]int) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.limits = limits
+	for user := range q.sent {
+		if _, ok := limits[user]; !ok {
+			delete(q.sent, user)
+		}
+	}
+}
+
+func (q *memoryQuotaManager) allow(user string) bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	limit, ok := q.limits[user]
+	return !ok || len(q.prune(user)) < limit
+}
+
+func (q *memoryQuotaManager) record(user string) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if _, ok := q.limits[user]; !ok {
+		return
+	}
+	q.sent[user] = append(q.prune(user), time.Now())
+}
+
+func (q *memoryQuotaManager) refund(user string) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if sent := q.prune(user); len(sent) > 0 {
+		q.sent[user] = sent[:len(sent)-1]
+	}
+}
+
+func (q *memoryQuotaManager) usage(user string) int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return len(q.prune(user))
+}
+
+func (q *memoryQuotaManager) Describe(ch chan<- *prometheus.Desc) {
+	ch <- userQuotaUsageDesc
+}
+
+func (q *memoryQuotaManager) Collect(ch chan<- prometheus.Metric) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for user := range q.limits {
+		ch <- prometheus.MustNewConstMetric(userQuotaUsageDesc, prometheus.GaugeValue, float64(len(q.prune(user))), user)
+	}
+}
+
+// prune discards sends older than the window and returns the rest, the
+// caller must hold q.mu.
+func (q *memoryQuotaManager) prune(user string) []time.Time {
+	cutoff := time.Now().Add(-userQuotaWindow)
+	sent := q.sent[user]
+	i := 0
+	for i < len(sent) && !sent[i].After(cutoff) {
+		i++
+	}
+	sent = sent[i:]
+	q.sent[user] = sent
+	return sent
+}
+
+// checkQuota returns an error rejecting the message if user has exceeded
+// their quota.
+func checkQuota(q quotaManager, user string) error {
+	if q == nil || q.allow(user) {
+		return nil
+	}
+	userQuotaExceeded.Inc()
+	return smtpd.SMTPError("452 4.2.1 Mailbox temporarily disabled: quota exceeded")
+}
@@ -0,0 +1,32 @@
+package main
+
+import "strings"
+
+const otherUserLabel = "other"
+
+// userTracker maps authenticated users to the value of the "user" metric
+// label. Only explicitly tracked users get their own label value, all
+// other authenticated users are counted as "other" to keep metric
+// cardinality bounded. A nil userTracker disables per-user metrics and
+// every message is counted with an empty label.
+type userTracker map[string]bool
+
+func newUserTracker(users string) userTracker {
+	t := userTracker{}
+	for _, u := range strings.Split(users, ",") {
+		if u = strings.TrimSpace(u); u != "" {
+			t[u] = true
+		}
+	}
+	return t
+}
+
+func (t userTracker) label(user string) string {
+	if t == nil || user == "" {
+		return ""
+	}
+	if t[user] {
+		return user
+	}
+	return otherUserLabel
+}
@@ -0,0 +1,515 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"math/rand"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/hashicorp/vault/api"
+	"github.com/hashicorp/vault/api/auth/approle"
+	awsauth "github.com/hashicorp/vault/api/auth/aws"
+	"github.com/hashicorp/vault/api/auth/kubernetes"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const defaultK8sTokenPath = "/var/run/secrets/kubernetes.io/serviceaccount/token"
+
+// vaultAuthMethod returns the Vault auth method configured in the
+// environment or nil if VAULT_TOKEN should be used. If more than one is
+// configured AppRole is preferred, then Kubernetes, then AWS IAM.
+func vaultAuthMethod() (api.AuthMethod, error) {
+	if roleID := os.Getenv("VAULT_APPROLE_ROLE_ID"); roleID != "" {
+		appRoleAuth, err := approle.NewAppRoleAuth(roleID, &approle.SecretID{
+			FromEnv: "VAULT_APPROLE_SECRET_ID",
+		})
+		if err != nil {
+			return nil, fmt.Errorf("unable to initialize AppRole auth method: %w", err)
+		}
+		return appRoleAuth, nil
+	}
+
+	if role := os.Getenv("VAULT_K8S_ROLE"); role != "" {
+		tokenPath := os.Getenv("VAULT_K8S_TOKEN_PATH")
+		if tokenPath == "" {
+			tokenPath = defaultK8sTokenPath
+		}
+		opts := []kubernetes.LoginOption{kubernetes.WithServiceAccountTokenPath(tokenPath)}
+		if mount := os.Getenv("VAULT_K8S_MOUNT_PATH"); mount != "" {
+			opts = append(opts, kubernetes.WithMountPath(mount))
+		}
+		k8sAuth, err := kubernetes.NewKubernetesAuth(role, opts...)
+		if err != nil {
+			return nil, fmt.Errorf("unable to initialize Kubernetes auth method: %w", err)
+		}
+		return k8sAuth, nil
+	}
+
+	if role := os.Getenv("VAULT_AWS_ROLE"); role != "" {
+		opts := []awsauth.LoginOption{awsauth.WithIAMAuth(), awsauth.WithRole(role)}
+		if mount := os.Getenv("VAULT_AWS_MOUNT_PATH"); mount != "" {
+			opts = append(opts, awsauth.WithMountPath(mount))
+		}
+		if header := os.Getenv("VAULT_AWS_HEADER_VALUE"); header != "" {
+			opts = append(opts, awsauth.WithIAMServerIDHeader(header))
+		}
+		awsAuth, err := awsauth.NewAWSAuth(opts...)
+		if err != nil {
+			return nil, fmt.Errorf("unable to initialize AWS auth method: %w", err)
+		}
+		return awsAuth, nil
+	}
+
+	return nil, nil
+}
+
+func logRenewal(renewal *api.RenewOutput) {
+	canRenew := "renewable"
+	if !renewal.Secret.Renewable {
+		canRenew = "not renewable"
+	}
+	leaseID := renewal.Secret.LeaseID
+	if leaseID == "" && renewal.Secret.MountType == "token" {
+		leaseID = "vault_token"
+	}
+	slog.Info("successfully renewed lease",
+		"lease_id", leaseID,
+		"renewed_at", renewal.RenewedAt.Format(time.RFC3339),
+		"duration", time.Duration(renewal.Secret.LeaseDuration)*time.Second,
+		"renewable", canRenew,
+	)
+}
+
+// renewSecret renews s for as long as Vault allows, calling onRenew (if
+// non-nil) after each renewal and onDone with the watcher's error (nil
+// if the lease simply can not be renewed any further) once renewal
+// stops. Closing stop ends renewal without calling onDone.
+func renewSecret(vc *api.Client, s *api.Secret, stop <-chan struct{}, onRenew func(*api.RenewOutput), onDone func(error)) error {
+	w, err := vc.NewLifetimeWatcher(&api.LifetimeWatcherInput{Secret: s})
+	if err != nil {
+		return err
+	}
+	go w.Start()
+
+	go func() {
+		for {
+			select {
+			case <-stop:
+				w.Stop()
+				return
+			case err := <-w.DoneCh():
+				if err != nil {
+					credentialRenewalError.Inc()
+				}
+				onDone(err)
+				return
+			case renewal := <-w.RenewCh():
+				credentialRenewalSuccess.Inc()
+				logRenewal(renewal)
+				if onRenew != nil {
+					onRenew(renewal)
+				}
+			}
+		}
+	}()
+
+	return nil
+}
+
+// renewToken keeps the VAULT_TOKEN the client was created with alive by
+// renewing it for as long as Vault allows or until stop is closed,
+// calling onDone once renewal stops. Tokens which are not renewable, such
+// as root tokens, are left alone.
+func renewToken(ctx context.Context, vc *api.Client, stop <-chan struct{}, onDone func(error)) error {
+	self, err := vc.Auth().Token().LookupSelfWithContext(ctx)
+	if err != nil {
+		return fmt.Errorf("unable to look up Vault token: %w", err)
+	}
+	renewable, err := self.TokenIsRenewable()
+	if err != nil {
+		return err
+	}
+	ttl, err := self.TokenTTL()
+	if err != nil {
+		return err
+	}
+	if !renewable || ttl == 0 {
+		slog.Info("Vault token is not renewable, it will not be renewed")
+		return nil
+	}
+
+	// The lifetime watcher only renews tokens from the auth section of
+	// a secret, which a lookup does not populate.
+	return renewSecret(vc, &api.Secret{
+		Auth: &api.SecretAuth{
+			ClientToken:   vc.Token(),
+			Renewable:     renewable,
+			LeaseDuration: int(ttl / time.Second),
+		},
+	}, stop, nil, onDone)
+}
+
+// vaultOptions are the settings shared by every credential read from
+// Vault.
+type vaultOptions struct {
+	fatalOnExpiry bool
+	engine        string // secret engine: "aws", "kv-v2" or "" to detect
+	kvVersion     int    // KV v2 secret version to read, latest if 0
+	namespace     string // Vault Enterprise namespace, VAULT_NAMESPACE if empty
+
+	// refreshAttempts is the number of times a new credential is read
+	// after the lease ends before giving up, and refreshDelay the delay
+	// before the second attempt, doubling for each subsequent attempt.
+	refreshAttempts int
+	refreshDelay    time.Duration
+}
+
+// getVaultSecret logs in to Vault and reads the AWS credential at path.
+// The returned credential expires with its lease. onSecretRenew is
+// called each time the lease is renewed. onLoginDone and onSecretDone
+// are called when renewal of the login token and AWS credential lease,
+// respectively, stops. Closing stop stops renewal of both.
+//
+// The credential is read from an AWS secrets engine or, for the kv-v2
+// engine, from the access_key and secret_key fields of a static secret
+// at path, whose first element is the engine's mount. KV secrets, and
+// AWS secrets read without a lease, are not renewed.
+func getVaultSecret(ctx context.Context, path string, opts vaultOptions, stop <-chan struct{}, onSecretRenew func(*api.RenewOutput), onLoginDone, onSecretDone func(error)) (aws.Credentials, *api.Client, error) {
+	var r aws.Credentials
+
+	vc, err := api.NewClient(api.DefaultConfig())
+	if err != nil {
+		return r, nil, err
+	}
+
+	// Set the namespace before logging in so that the login, the secret
+	// read and renewal of both happen within it.
+	namespace := opts.namespace
+	if namespace == "" {
+		namespace = os.Getenv("VAULT_NAMESPACE")
+	}
+	if namespace != "" {
+		vc.SetNamespace(namespace)
+	}
+
+	// Use AppRole or Kubernetes auth if either is configured in the
+	// environment, otherwise assume VAULT_TOKEN was provided in the
+	// environment and keep it renewed.
+	authMethod, err := vaultAuthMethod()
+	if err != nil {
+		return r, nil, err
+	}
+	if authMethod != nil {
+		if loginSecret, err := vc.Auth().Login(ctx, authMethod); err != nil {
+			return r, nil, fmt.Errorf("unable to login to Vault: %w", err)
+		} else {
+			if err := renewSecret(vc, loginSecret, stop, nil, onLoginDone); err != nil {
+				return r, nil, err
+			}
+		}
+	} else if err := renewToken(ctx, vc, stop, onLoginDone); err != nil {
+		return r, nil, err
+	}
+
+	var secret *api.Secret
+	var data map[string]interface{}
+	engine := opts.engine
+	switch engine {
+	case "kv-v2":
+		mount, name, ok := strings.Cut(path, "/")
+		if !ok {
+			return r, nil, fmt.Errorf("Vault KV v2 path %s must be of the form mount/name", path)
+		}
+		var kv *api.KVSecret
+		if opts.kvVersion > 0 {
+			kv, err = vc.KVv2(mount).GetVersion(ctx, name, opts.kvVersion)
+		} else {
+			kv, err = vc.KVv2(mount).Get(ctx, name)
+		}
+		if err != nil {
+			return r, nil, err
+		}
+		data = kv.Data
+	case "aws", "":
+		if secret, err = vc.Logical().ReadWithContext(ctx, path); err != nil {
+			return r, nil, err
+		}
+		if secret == nil {
+			return r, nil, fmt.Errorf("Vault returned no AWS secret")
+		}
+		data = secret.Data
+		if engine == "" {
+			// Without a configured engine guess that a secret with
+			// the credential nested in data was read from a KV v2
+			// engine's data path.
+			engine = "aws"
+			if nested, ok := data["data"].(map[string]interface{}); ok && data["access_key"] == nil && nested["access_key"] != nil {
+				engine = "kv-v2 (detected)"
+				data = nested
+				secret = nil
+			}
+		}
+	default:
+		return r, nil, fmt.Errorf("unknown Vault secret engine %q", engine)
+	}
+	slog.Info("read AWS credential from Vault", "path", path, "engine", engine, "namespace", namespace)
+
+	keyId, ok := data["access_key"].(string)
+	if !ok {
+		return r, nil, fmt.Errorf("Vault secret had no access_key")
+	}
+
+	secretKey, ok := data["secret_key"].(string)
+	if !ok {
+		return r, nil, fmt.Errorf("Vault secret had no secret_key")
+	}
+
+	r.AccessKeyID = keyId
+	r.SecretAccessKey = secretKey
+	if secret == nil || secret.LeaseID == "" {
+		return r, vc, nil
+	}
+	if secret.LeaseDuration > 0 {
+		r.CanExpire = true
+		r.Expires = time.Now().Add(time.Duration(secret.LeaseDuration) * time.Second)
+	}
+
+	return r, vc, renewSecret(vc, secret, stop, onSecretRenew, onSecretDone)
+}
+
+// vaultCredentials is an aws.CredentialsProvider which returns the AWS
+// credential most recently read from Vault. The credential's expiry
+// tracks its lease, being extended on each renewal, so the SDK will
+// re-retrieve it as the lease nears its end. When the lease can no
+// longer be renewed a new credential is read from Vault and swapped in,
+// unless opts.fatalOnExpiry is set in which case the error is reported on
+// credentialError as in earlier versions. If reading a new credential
+// fails it is retried with backoff, the last credential being used in
+// the meantime, and the error is only reported once all attempts fail.
+//
+// A credential is used until it is closed, when the route it was read for
+// is replaced on reload.
+type vaultCredentials struct {
+	path            string
+	opts            vaultOptions
+	credentialError chan<- error
+	done            chan struct{} // closed by close
+	closeOnce       sync.Once
+
+	stopMu sync.Mutex
+	stop   chan struct{} // stops renewal of the current login and lease
+
+	value   atomic.Pointer[aws.Credentials]
+	fetched atomic.Int64               // when value was read, in Unix nanoseconds
+	client  atomic.Pointer[api.Client] // client logged in to read value
+	cache   *aws.CredentialsCache
+}
+
+var (
+	vaultCredentialsMu  sync.Mutex
+	vaultCredentialsSet []*vaultCredentials
+)
+
+func newVaultCredentials(ctx context.Context, path string, opts vaultOptions, credentialError chan<- error) (*vaultCredentials, error) {
+	v := &vaultCredentials{
+		path:            path,
+		opts:            opts,
+		credentialError: credentialError,
+		done:            make(chan struct{}),
+	}
+	// The SDK caches credentials that do not expire forever so keep a
+	// handle to the cache to invalidate it when the credential changes.
+	v.cache = aws.NewCredentialsCache(v)
+	if err := v.refresh(ctx); err != nil {
+		return nil, err
+	}
+
+	vaultCredentialsMu.Lock()
+	defer vaultCredentialsMu.Unlock()
+	vaultCredentialsSet = append(vaultCredentialsSet, v)
+
+	return v, nil
+}
+
+// close stops renewing and refreshing the credential and removes it from
+// readiness checks and metrics. Clients holding the credential may keep
+// using it until its lease ends.
+func (v *vaultCredentials) close() {
+	v.closeOnce.Do(func() {
+		close(v.done)
+		v.setStop(nil)
+	})
+
+	vaultCredentialsMu.Lock()
+	defer vaultCredentialsMu.Unlock()
+	vaultCredentialsSet = slices.DeleteFunc(vaultCredentialsSet, func(c *vaultCredentials) bool { return c == v })
+}
+
+// setStop replaces the channel stopping renewal of the current login
+// token and lease with stop, closing the previous one so that the
+// watchers of a replaced login do not keep running.
+func (v *vaultCredentials) setStop(stop chan struct{}) {
+	v.stopMu.Lock()
+	defer v.stopMu.Unlock()
+	if v.stop != nil {
+		close(v.stop)
+	}
+	v.stop = stop
+}
+
+func (v *vaultCredentials) closed() bool {
+	select {
+	case <-v.done:
+		return true
+	default:
+		return false
+	}
+}
+
+func (v *vaultCredentials) Retrieve(ctx context.Context) (aws.Credentials, error) {
+	cred := v.value.Load()
+	if cred == nil {
+		return aws.Credentials{}, fmt.Errorf("no credential has been read from Vault path %s", v.path)
+	}
+	return *cred, nil
+}
+
+// IsExpired reports whether the lease on the current credential has
+// ended, or no credential has been read yet.
+func (v *vaultCredentials) IsExpired() bool {
+	cred := v.value.Load()
+	return cred == nil || cred.Expired()
+}
+
+// onSecretRenew extends the expiry of the current credential to the end
+// of the renewed lease.
+func (v *vaultCredentials) onSecretRenew(renewal *api.RenewOutput) {
+	cur := v.value.Load()
+	if cur == nil {
+		return
+	}
+	cred := *cur
+	cred.CanExpire = true
+	cred.Expires = renewal.RenewedAt.Add(time.Duration(renewal.Secret.LeaseDuration) * time.Second)
+	v.value.Store(&cred)
+}
+
+// refresh reads a new credential from Vault and swaps it in.
+func (v *vaultCredentials) refresh(ctx context.Context) error {
+	onLoginDone := v.reportError
+	if !v.opts.fatalOnExpiry {
+		// The next refresh logs in again so an expired login token is
+		// not fatal.
+		onLoginDone = func(err error) {
+			if err != nil {
+				slog.Warn("Vault login token renewal stopped", "error", err)
+			}
+		}
+	}
+
+	stop := make(chan struct{})
+	cred, vc, err := getVaultSecret(ctx, v.path, v.opts, stop, v.onSecretRenew, onLoginDone, v.onSecretDone)
+	if err != nil {
+		close(stop)
+		return err
+	}
+	v.setStop(stop)
+	if v.closed() {
+		v.setStop(nil)
+	}
+	v.value.Store(&cred)
+	v.fetched.Store(time.Now().UnixNano())
+	v.client.Store(vc)
+	v.cache.Invalidate()
+	return nil
+}
+
+func (v *vaultCredentials) onSecretDone(err error) {
+	if v.closed() {
+		return
+	}
+	if v.opts.fatalOnExpiry {
+		v.reportError(err)
+		return
+	}
+
+	slog.Info("Vault lease ended, fetching new credential", "path", v.path, "error", err)
+	if err := v.refreshWithRetry(context.Background()); err != nil {
+		v.credentialError <- err
+	}
+}
+
+// refreshWithRetry calls refresh until it succeeds or opts.refreshAttempts
+// attempts have been made, returning the last error. It gives up without
+// error once the credential is closed.
+func (v *vaultCredentials) refreshWithRetry(ctx context.Context) error {
+	for attempt := 1; ; attempt++ {
+		err := v.refresh(ctx)
+		if err == nil || v.closed() {
+			return nil
+		}
+		credentialRefreshError.Inc()
+		if attempt >= v.opts.refreshAttempts {
+			return fmt.Errorf("unable to fetch Vault credential %s after %d attempts: %w", v.path, attempt, err)
+		}
+
+		delay := v.opts.refreshDelay << (attempt - 1)
+		delay = delay/2 + time.Duration(rand.Int63n(int64(delay/2)+1))
+		slog.Warn("retrying Vault credential fetch", "path", v.path, "delay", delay, "attempt", attempt, "max_attempts", v.opts.refreshAttempts, "error", err)
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-v.done:
+			return nil
+		case <-time.After(delay):
+		}
+	}
+}
+
+// check verifies that Vault is reachable and the login token is still
+// valid.
+func (v *vaultCredentials) check(ctx context.Context) error {
+	_, err := v.client.Load().Auth().Token().LookupSelfWithContext(ctx)
+	return err
+}
+
+func (v *vaultCredentials) reportError(err error) {
+	if err != nil && !v.closed() {
+		v.credentialError <- err
+	}
+}
+
+var vaultCredentialAgeDesc = prometheus.NewDesc("smtpd_credential_age_seconds",
+	"Time since the AWS credential was read from Vault", []string{"path"}, nil)
+
+// vaultCredentialAge is a prometheus.Collector reporting the age of each
+// Vault credential. If more than one credential was read from a path the
+// oldest is reported.
+type vaultCredentialAge struct{}
+
+func (vaultCredentialAge) Describe(ch chan<- *prometheus.Desc) {
+	ch <- vaultCredentialAgeDesc
+}
+
+func (vaultCredentialAge) Collect(ch chan<- prometheus.Metric) {
+	vaultCredentialsMu.Lock()
+	defer vaultCredentialsMu.Unlock()
+	ages := map[string]time.Duration{}
+	for _, v := range vaultCredentialsSet {
+		age := time.Since(time.Unix(0, v.fetched.Load()))
+		if age > ages[v.path] {
+			ages[v.path] = age
+		}
+	}
+	for path, age := range ages {
+		ch <- prometheus.MustNewConstMetric(vaultCredentialAgeDesc, prometheus.GaugeValue, age.Seconds(), path)
+	}
+}
@@ -0,0 +1,190 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+)
+
+// fakeVault serves a Vault token lookup and an AWS credential read,
+// recording the namespace each request was made in.
+func fakeVault(t *testing.T) (addr string, namespaces func() map[string]string) {
+	t.Helper()
+	var mu sync.Mutex
+	seen := map[string]string{}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		seen[r.URL.Path] = r.Header.Get("X-Vault-Namespace")
+		mu.Unlock()
+
+		w.Header().Set("Content-Type", "application/json")
+		switch r.URL.Path {
+		case "/v1/auth/token/lookup-self":
+			w.Write([]byte(`{"data": {"renewable": false, "ttl": 0}}`))
+		case "/v1/aws/creds/mail":
+			w.Write([]byte(`{"data": {"access_key": "AKIDEXAMPLE", "secret_key": "secret"}}`))
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	t.Cleanup(srv.Close)
+	return srv.URL, func() map[string]string {
+		mu.Lock()
+		defer mu.Unlock()
+		return seen
+	}
+}
+
+func TestVaultNamespace(t *testing.T) {
+	for _, tc := range []struct {
+		name, option, env, want string
+	}{
+		{name: "option", option: "team-a", want: "team-a"},
+		{name: "environment", env: "team-b", want: "team-b"},
+		{name: "option overrides environment", option: "team-a", env: "team-b", want: "team-a"},
+		{name: "none"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			addr, namespaces := fakeVault(t)
+			testVaultEnv(t, addr)
+			t.Setenv("VAULT_NAMESPACE", tc.env)
+
+			stop := make(chan struct{})
+			defer close(stop)
+			ignore := func(error) {}
+			cred, _, err := getVaultSecret(context.Background(), "aws/creds/mail", vaultOptions{engine: "aws", namespace: tc.option}, stop, nil, ignore, ignore)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if cred.AccessKeyID != "AKIDEXAMPLE" {
+				t.Errorf("got access key %q", cred.AccessKeyID)
+			}
+
+			seen := namespaces()
+			for _, path := range []string{"/v1/auth/token/lookup-self", "/v1/aws/creds/mail"} {
+				ns, ok := seen[path]
+				if !ok {
+					t.Errorf("no request to %s", path)
+				} else if ns != tc.want {
+					t.Errorf("request to %s in namespace %q, want %q", path, ns, tc.want)
+				}
+			}
+		})
+	}
+}
+
+// testVaultEnv points the Vault client at addr using token auth.
+func testVaultEnv(t *testing.T, addr string) {
+	t.Helper()
+	t.Setenv("VAULT_ADDR", addr)
+	t.Setenv("VAULT_TOKEN", "token")
+	t.Setenv("VAULT_NAMESPACE", "")
+	for _, name := range []string{"VAULT_APPROLE_ROLE_ID", "VAULT_K8S_ROLE", "VAULT_AWS_ROLE"} {
+		t.Setenv(name, "")
+	}
+}
+
+func TestVaultRefreshStopsPreviousLogin(t *testing.T) {
+	addr, _ := fakeVault(t)
+	testVaultEnv(t, addr)
+
+	v, err := newVaultCredentials(context.Background(), "aws/creds/mail", vaultOptions{engine: "aws"}, make(chan error, 1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer v.close()
+
+	first := v.stop
+	if err := v.refresh(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-first:
+	default:
+		t.Error("renewal of the previous login was not stopped by refresh")
+	}
+
+	current := v.stop
+	v.close()
+	select {
+	case <-current:
+	default:
+		t.Error("renewal of the current login was not stopped by close")
+	}
+}
+
+func TestVaultRefreshRetryMetrics(t *testing.T) {
+	addr, _ := fakeVault(t)
+	testVaultEnv(t, addr)
+
+	v := &vaultCredentials{
+		path: "aws/creds/missing",
+		opts: vaultOptions{engine: "aws", refreshAttempts: 2, refreshDelay: time.Millisecond},
+		done: make(chan struct{}),
+	}
+	renewal := counterValue(t, credentialRenewalError)
+	refresh := counterValue(t, credentialRefreshError)
+	if err := v.refreshWithRetry(context.Background()); err == nil {
+		t.Fatal("refresh of a missing credential succeeded")
+	}
+	if got := counterValue(t, credentialRefreshError) - refresh; got != 2 {
+		t.Errorf("refresh errors increased by %v, want 2", got)
+	}
+	if got := counterValue(t, credentialRenewalError) - renewal; got != 0 {
+		t.Errorf("renewal errors increased by %v, want 0", got)
+	}
+}
+
+// TestVaultCredentialsSwap checks that the SDK's credential cache picks
+// up a credential swapped in by a refresh, both when it is invalidated
+// and when the cached credential's lease ends.
+func TestVaultCredentialsSwap(t *testing.T) {
+	ctx := context.Background()
+	v := &vaultCredentials{path: "aws/creds/mail"}
+	v.cache = aws.NewCredentialsCache(v)
+	if _, err := v.Retrieve(ctx); err == nil {
+		t.Fatal("Retrieve succeeded before a credential was read")
+	}
+	if !v.IsExpired() {
+		t.Error("missing credential not reported as expired")
+	}
+
+	retrieve := func() string {
+		t.Helper()
+		cred, err := v.cache.Retrieve(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return cred.AccessKeyID
+	}
+
+	v.value.Store(&aws.Credentials{AccessKeyID: "first", SecretAccessKey: "secret"})
+	if id := retrieve(); id != "first" {
+		t.Fatalf("got credential %q, want first", id)
+	}
+
+	// A credential without a lease is cached until invalidated.
+	v.value.Store(&aws.Credentials{AccessKeyID: "second", SecretAccessKey: "secret", CanExpire: true, Expires: time.Now().Add(100 * time.Millisecond)})
+	if id := retrieve(); id != "first" {
+		t.Fatalf("got credential %q before invalidation, want first", id)
+	}
+	v.cache.Invalidate()
+	if id := retrieve(); id != "second" {
+		t.Fatalf("got credential %q after invalidation, want second", id)
+	}
+
+	// A leased credential is re-retrieved once its lease ends.
+	v.value.Store(&aws.Credentials{AccessKeyID: "third", SecretAccessKey: "secret"})
+	if id := retrieve(); id != "second" {
+		t.Fatalf("got credential %q before expiry, want second", id)
+	}
+	time.Sleep(150 * time.Millisecond)
+	if id := retrieve(); id != "third" {
+		t.Fatalf("got credential %q after expiry, want third", id)
+	}
+}